@@ -6,14 +6,49 @@ import (
 )
 
 const (
-	defaultPort              = "8080"
-	defaultPasswdFilePath    = "/etc/passwd"
-	defaultGroupFilePath     = "/etc/group"
-	defaultWriteTimeoutInSec = 30
-	defaultReadTimeoutInSec  = 30
-	defaultIdleTimeoutInSec  = 60
+	defaultPort               = "8080"
+	defaultPasswdFilePath     = "/etc/passwd"
+	defaultGroupFilePath      = "/etc/group"
+	defaultSourceType         = "file"
+	defaultConflictPolicy     = "first"
+	defaultWriteTimeoutInSec  = 30
+	defaultReadTimeoutInSec   = 30
+	defaultIdleTimeoutInSec   = 60
+	defaultHistorySize        = 16
+	defaultWatchStrategy      = "inotify"
+	defaultWatchIntervalInSec = 5
 )
 
+// SourceConfig declares a source of users and groups. Type selects the kind of source, "file" by default,
+// the other fields are the settings of the source. Settings holds the settings of the kinds of source that
+// have no dedicated field.
+type SourceConfig struct {
+	Type                 string
+	PasswdFilePath       string
+	GroupFilePath        string
+	ExtraPasswdFilePaths []string
+	ExtraGroupFilePaths  []string
+	PasswdDropInDir      string
+	GroupDropInDir       string
+	ConflictPolicy       string
+	LenientParsing       bool
+	ShadowFilePath       string
+	GShadowFilePath      string
+	WatchStrategy        string
+	WatchIntervalInSec   int
+	Settings             map[string]string
+}
+
+// WebhookConfig declares a URL the changes of the users and groups are POSTed to. Events selects the names
+// of the events, e.g. group-modified, and Names the names of the users or groups, both are optional. When
+// Secret is set, the requests are signed with HMAC-SHA256.
+type WebhookConfig struct {
+	URL    string
+	Events []string
+	Names  []string
+	Secret string
+}
+
 // Config loads its fields from the configuration file that user provide, or uses the default settings
 type Config struct {
 	ListenHost        string
@@ -25,20 +60,72 @@ type Config struct {
 	LogFilePath       string
 	PasswdFilePath    string
 	GroupFilePath     string
+	// ExtraPasswdFilePaths and ExtraGroupFilePaths are read in order after PasswdFilePath and GroupFilePath
+	ExtraPasswdFilePaths []string
+	ExtraGroupFilePaths  []string
+	// the files in the drop-in directories are read last, in the lexical order of their names
+	PasswdDropInDir string
+	GroupDropInDir  string
+	// ConflictPolicy tells which entries are kept when several files have the same name: first, last or error
+	ConflictPolicy string
+	// LenientParsing skips the malformed lines instead of failing the whole file, see GET /diagnostics/parse
+	LenientParsing bool
+	// ShadowFilePath is optional, the account status of the users is only available when it is set
+	ShadowFilePath string
+	// GShadowFilePath is optional, the administrators of the groups are only available when it is set
+	GShadowFilePath string
+	// WatchStrategy tells how the changes of the files are detected: inotify, poll, which compares the
+	// modification time, size and inode of the files, or checksum, which compares their content hash. poll and
+	// checksum check the files every WatchIntervalInSec.
+	WatchStrategy      string
+	WatchIntervalInSec int
+	// Sources are merged in order. When it is empty, a single file source is made of the file paths above
+	Sources []SourceConfig
+	// LegacyStringIDs makes the unversioned REST routes encode uid and gid as JSON strings
+	LegacyStringIDs bool
+	// Webhooks are notified of the changes of the users and groups
+	Webhooks []WebhookConfig
+	// WebhookQueueDir keeps the pending webhook deliveries across restarts. They are only kept in memory when
+	// it is empty
+	WebhookQueueDir string
+	// HistorySize is the number of snapshots of the users and groups kept for GET /history and GET /diff.
+	// HistoryMaxAgeInSec drops the snapshots older than it, unless it is 0. The current one is always kept.
+	HistorySize        int
+	HistoryMaxAgeInSec int
+	// HistoryDir keeps the snapshots of the history across restarts. They are only kept in memory when it is
+	// empty
+	HistoryDir string
+	// AdminToken enables POST /admin/reload for the requests with the header "Authorization: Bearer <token>".
+	// The admin routes are disabled when it is empty
+	AdminToken string
 }
 
 // Init loads the configuration file at configFilePath if len(configFilePath) > 0
 func Init(configFilePath string) (setting *Config, err error) {
 	setting = &Config{
-		ListenHost:        "",
-		Port:              defaultPort,
-		WriteTimeoutInSec: defaultWriteTimeoutInSec,
-		ReadTimeoutInSec:  defaultReadTimeoutInSec,
-		IdleTimeoutInSec:  defaultIdleTimeoutInSec,
-		RestDomain:        "",
-		LogFilePath:       "",
-		PasswdFilePath:    defaultPasswdFilePath,
-		GroupFilePath:     defaultGroupFilePath,
+		ListenHost:         "",
+		Port:               defaultPort,
+		WriteTimeoutInSec:  defaultWriteTimeoutInSec,
+		ReadTimeoutInSec:   defaultReadTimeoutInSec,
+		IdleTimeoutInSec:   defaultIdleTimeoutInSec,
+		RestDomain:         "",
+		LogFilePath:        "",
+		PasswdFilePath:     defaultPasswdFilePath,
+		GroupFilePath:      defaultGroupFilePath,
+		PasswdDropInDir:    "",
+		GroupDropInDir:     "",
+		ConflictPolicy:     defaultConflictPolicy,
+		LenientParsing:     false,
+		ShadowFilePath:     "",
+		GShadowFilePath:    "",
+		WatchStrategy:      defaultWatchStrategy,
+		WatchIntervalInSec: defaultWatchIntervalInSec,
+		LegacyStringIDs:    false,
+		WebhookQueueDir:    "",
+		HistorySize:        defaultHistorySize,
+		HistoryMaxAgeInSec: 0,
+		HistoryDir:         "",
+		AdminToken:         "",
 	}
 
 	if len(configFilePath) == 0 {
@@ -55,3 +142,27 @@ func Init(configFilePath string) (setting *Config, err error) {
 	}
 	return
 }
+
+// SourceConfigs returns the sources of users and groups declared in the configuration
+func (c *Config) SourceConfigs() []SourceConfig {
+	if len(c.Sources) > 0 {
+		return c.Sources
+	}
+	return []SourceConfig{
+		{
+			Type:                 defaultSourceType,
+			PasswdFilePath:       c.PasswdFilePath,
+			GroupFilePath:        c.GroupFilePath,
+			ExtraPasswdFilePaths: c.ExtraPasswdFilePaths,
+			ExtraGroupFilePaths:  c.ExtraGroupFilePaths,
+			PasswdDropInDir:      c.PasswdDropInDir,
+			GroupDropInDir:       c.GroupDropInDir,
+			ConflictPolicy:       c.ConflictPolicy,
+			LenientParsing:       c.LenientParsing,
+			ShadowFilePath:       c.ShadowFilePath,
+			GShadowFilePath:      c.GShadowFilePath,
+			WatchStrategy:        c.WatchStrategy,
+			WatchIntervalInSec:   c.WatchIntervalInSec,
+		},
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -14,6 +15,8 @@ const (
 	dummyLogFile        = "./testData/log"
 	dummyPasswdFilePath = "./testData/passwd"
 	dummyGroupFilePath  = "./testData/group"
+	dummyShadowFilePath = "./testData/shadow"
+	dummyGShadowPath    = "./testData/gshadow"
 )
 
 func assert(t *testing.T, condition bool) {
@@ -35,4 +38,72 @@ func TestConfigLoadFromFile(t *testing.T) {
 	assert(t, setting.LogFilePath == dummyLogFile)
 	assert(t, setting.PasswdFilePath == dummyPasswdFilePath)
 	assert(t, setting.GroupFilePath == dummyGroupFilePath)
+	assert(t, setting.ShadowFilePath == dummyShadowFilePath)
+	assert(t, setting.GShadowFilePath == dummyGShadowPath)
+	assert(t, setting.LegacyStringIDs)
+
+	// without sources, a file source is made of the file paths
+	sources := setting.SourceConfigs()
+	assert(t, len(sources) == 1)
+	assert(t, sources[0].Type == defaultSourceType)
+	assert(t, sources[0].PasswdFilePath == dummyPasswdFilePath)
+	assert(t, sources[0].GroupFilePath == dummyGroupFilePath)
+	assert(t, sources[0].ShadowFilePath == dummyShadowFilePath)
+	assert(t, sources[0].GShadowFilePath == dummyGShadowPath)
+	assert(t, sources[0].ConflictPolicy == defaultConflictPolicy)
+	assert(t, sources[0].WatchStrategy == defaultWatchStrategy)
+	assert(t, sources[0].WatchIntervalInSec == defaultWatchIntervalInSec)
+	assert(t, len(sources[0].ExtraPasswdFilePaths) == 0)
+}
+
+func TestConfigSources(t *testing.T) {
+	setting, err := Init("")
+	assert(t, err == nil)
+
+	err = json.Unmarshal([]byte(`{"Sources": [
+		{"PasswdFilePath": "/etc/passwd", "GroupFilePath": "/etc/group", "WatchStrategy": "checksum"},
+		{"Type": "fixture", "Settings": {"path": "/var/lib/paas/fixture.json"}}
+	]}`), setting)
+	assert(t, err == nil)
+
+	sources := setting.SourceConfigs()
+	assert(t, len(sources) == 2)
+	assert(t, len(sources[0].Type) == 0)
+	assert(t, sources[0].WatchStrategy == "checksum" && sources[0].WatchIntervalInSec == 0)
+	assert(t, sources[1].Type == "fixture")
+	assert(t, sources[1].Settings["path"] == "/var/lib/paas/fixture.json")
+}
+
+func TestConfigWebhooks(t *testing.T) {
+	setting, err := Init("")
+	assert(t, err == nil)
+	assert(t, len(setting.Webhooks) == 0)
+
+	err = json.Unmarshal([]byte(`{"WebhookQueueDir": "/var/lib/paas/webhooks", "Webhooks": [
+		{"URL": "https://relay.example.com/slack", "Events": ["group-modified"], "Names": ["wheel"], "Secret": "s3cret"},
+		{"URL": "https://audit.example.com/paas"}
+	]}`), setting)
+	assert(t, err == nil)
+
+	assert(t, setting.WebhookQueueDir == "/var/lib/paas/webhooks")
+	assert(t, len(setting.Webhooks) == 2)
+	assert(t, setting.Webhooks[0].Events[0] == "group-modified")
+	assert(t, setting.Webhooks[0].Names[0] == "wheel")
+	assert(t, setting.Webhooks[0].Secret == "s3cret")
+	assert(t, len(setting.Webhooks[1].Events) == 0 && len(setting.Webhooks[1].Secret) == 0)
+}
+
+func TestConfigDefault(t *testing.T) {
+	setting, err := Init("")
+	assert(t, err == nil)
+
+	assert(t, setting.Port == defaultPort)
+	assert(t, setting.PasswdFilePath == defaultPasswdFilePath)
+	assert(t, setting.GroupFilePath == defaultGroupFilePath)
+	assert(t, setting.HistorySize == defaultHistorySize)
+	assert(t, setting.HistoryMaxAgeInSec == 0)
+	assert(t, len(setting.ShadowFilePath) == 0)
+	assert(t, len(setting.GShadowFilePath) == 0)
+	assert(t, !setting.LegacyStringIDs)
+	assert(t, len(setting.AdminToken) == 0)
 }
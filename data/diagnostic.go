@@ -0,0 +1,59 @@
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Diagnostic describes a line that fails to be parsed
+type Diagnostic struct {
+	File string `json:"file"`
+	// Line starts from 1
+	Line int `json:"line"`
+	// Content is the raw line, omitted for the redacted files, see parseLines
+	Content string `json:"content,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// parseLines calls parse on every line of the file at path that is neither empty nor commented. In lenient mode, a
+// line failing parse is skipped and reported in the returned diagnostics, otherwise it fails the whole file.
+// The content of the line is never reported when redact is true, i.e. for the shadow and gshadow files: their
+// lines carry the password hashes, which must never be reported nor logged. Their parsers only keep the fields
+// they need and leave the line out of their errors, as the errors are reported too.
+func parseLines(path string, lenient, redact bool, parse func(line string) error) ([]*Diagnostic, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &fileError{path: path, err: err}
+	}
+
+	var res []*Diagnostic
+	lines := strings.Split(string(buf), "\n")
+
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		// skip commented or empty lines
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// parse the current line
+		err := parse(line)
+		if err == nil {
+			continue
+		}
+		if !lenient {
+			return nil, &fileError{path: path, err: fmt.Errorf("%s:%d: %s", path, i+1, err)}
+		}
+
+		diagnostic := &Diagnostic{
+			File:   path,
+			Line:   i + 1,
+			Reason: err.Error(),
+		}
+		if !redact {
+			diagnostic.Content = line
+		}
+		res = append(res, diagnostic)
+	}
+	return res, nil
+}
@@ -0,0 +1,56 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	malformedPasswdPath = "../testData/passwd_malformed"
+	malformedShadowPath = "../testData/shadow_malformed"
+)
+
+func TestParseLenient(t *testing.T) {
+	_, _, err := parsePasswdFile(malformedPasswdPath, false)
+	assert(t, err != nil)
+	assert(t, strings.HasPrefix(err.Error(), malformedPasswdPath+":4:"))
+
+	users, diagnostics, err := parsePasswdFile(malformedPasswdPath, true)
+	assert(t, err == nil)
+	assert(t, len(users) == 2)
+	assert(t, users[0].Name == "root" && users[1].Name == "_uucp")
+	assert(t, len(diagnostics) == 2)
+	assert(t, diagnostics[0].File == malformedPasswdPath)
+	assert(t, diagnostics[0].Line == 4)
+	assert(t, diagnostics[0].Content == "broken line")
+	assert(t, diagnostics[1].Line == 5)
+	assert(t, strings.HasPrefix(diagnostics[1].Reason, "Invalid UID one"))
+
+	shadows, diagnostics, err := parseShadowFile(malformedShadowPath, true)
+	assert(t, err == nil)
+	assert(t, len(shadows) == 1)
+	assert(t, len(diagnostics) == 1)
+	assert(t, diagnostics[0].Line == 2)
+	// the password hash must never be reported
+	assert(t, len(diagnostics[0].Content) == 0)
+	assert(t, !strings.Contains(diagnostics[0].Reason, "$6$salt$hash"))
+
+	_, err = parseLines("../testData/not_exist", true, false, func(line string) error { return nil })
+	assert(t, err != nil)
+}
+
+func TestLenientManager(t *testing.T) {
+	src, err := NewFileSource(malformedPasswdPath, originalGroupPath)
+	assert(t, err == nil)
+	_, err = NewManager([]Source{src})
+	assert(t, err != nil)
+
+	src, err = NewFileSource(malformedPasswdPath, originalGroupPath, WithLenientParsing(),
+		WithShadowFile(malformedShadowPath))
+	assert(t, err == nil)
+	lenientMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	assert(t, len(lenientMgr.GetAllUsers()) == 2)
+	assert(t, len(lenientMgr.GetAllGroups()) == 8)
+	assert(t, len(lenientMgr.GetParseDiagnostics()) == 3)
+}
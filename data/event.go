@@ -0,0 +1,215 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// EventAction tells how an entry has changed
+type EventAction string
+
+const (
+	// EventAdded is an entry which is not in the previous snapshot
+	EventAdded EventAction = "added"
+	// EventRemoved is an entry which is not in the new snapshot
+	EventRemoved EventAction = "removed"
+	// EventModified is an entry whose fields have changed
+	EventModified EventAction = "modified"
+
+	// EventKindUser and EventKindGroup are the kinds of entries an Event is about
+	EventKindUser  = "user"
+	EventKindGroup = "group"
+
+	// the number of the last events kept for the subscribers to resume from
+	eventLogSize = 1024
+	// the number of events buffered for a subscriber before it is dropped for being too slow
+	subscriberBufferSize = 64
+)
+
+// Event is a change of a user or a group found by comparing the snapshots before and after a reload. The
+// entries are matched by name, when several entries have the same name only the first one is compared.
+type Event struct {
+	// ID increases with every event, starting at 1 when the Manager is created
+	ID uint64 `json:"id"`
+	// Generation is the version of the content after the change
+	Generation uint64      `json:"generation"`
+	Time       time.Time   `json:"time"`
+	Kind       string      `json:"kind"`
+	Action     EventAction `json:"action"`
+	// either User or Group is set according to Kind. It is the new entry, or the previous one when removed.
+	User  *User  `json:"user,omitempty"`
+	Group *Group `json:"group,omitempty"`
+	// PreviousUser or PreviousGroup is the entry before the change when modified, e.g. to tell the members
+	// added to a group
+	PreviousUser  *User  `json:"previousUser,omitempty"`
+	PreviousGroup *Group `json:"previousGroup,omitempty"`
+}
+
+// EntryID returns the UID or the GID of the entry of the event
+func (e *Event) EntryID() int {
+	if e.User != nil {
+		return e.User.UID
+	}
+	return e.Group.GID
+}
+
+// Subscription delivers the events of the Manager until it is closed
+type Subscription struct {
+	// Backlog is the events retained since the requested ID, in order, they come before the events of C
+	Backlog []*Event
+	// Missed is true when some events since the requested ID are no longer retained, the subscriber should
+	// reload everything
+	Missed bool
+	// C is closed when the subscriber is too slow to keep up, it can resume from its last event
+	C <-chan *Event
+
+	log *eventLog
+	ch  chan *Event
+}
+
+// Close stops the delivery of the events
+func (s *Subscription) Close() {
+	// a Subscription made outside of the Manager, e.g. by a test, has no log
+	if s.log != nil {
+		s.log.unsubscribe(s.ch)
+	}
+}
+
+// eventLog keeps the last events and fans them out to the subscribers
+type eventLog struct {
+	lock        sync.Mutex
+	lastID      uint64
+	events      []*Event
+	subscribers map[chan *Event]struct{}
+}
+
+func (l *eventLog) publish(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, e := range events {
+		l.lastID++
+		e.ID = l.lastID
+	}
+	l.events = append(l.events, events...)
+	if len(l.events) > eventLogSize {
+		l.events = append([]*Event{}, l.events[len(l.events)-eventLogSize:]...)
+	}
+
+	for ch := range l.subscribers {
+		if !deliver(ch, events) {
+			// never block the reload on a slow subscriber
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// deliver returns false if the buffer of ch is full
+func deliver(ch chan *Event, events []*Event) bool {
+	for _, e := range events {
+		select {
+		case ch <- e:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// subscribe returns the events after lastEventID along with the channel of the upcoming events. A
+// lastEventID of 0 only subscribes to the upcoming events.
+func (l *eventLog) subscribe(lastEventID uint64) *Subscription {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	ch := make(chan *Event, subscriberBufferSize)
+	if l.subscribers == nil {
+		l.subscribers = make(map[chan *Event]struct{})
+	}
+	l.subscribers[ch] = struct{}{}
+	res := &Subscription{C: ch, log: l, ch: ch, Backlog: make([]*Event, 0)}
+	if lastEventID == 0 {
+		return res
+	}
+
+	// an ID greater than the last one comes from before a restart
+	res.Missed = lastEventID > l.lastID
+	if len(l.events) > 0 && l.events[0].ID > lastEventID+1 {
+		res.Missed = true
+	}
+	for _, e := range l.events {
+		if e.ID > lastEventID {
+			res.Backlog = append(res.Backlog, e)
+		}
+	}
+	return res
+}
+
+func (l *eventLog) unsubscribe(ch chan *Event) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.subscribers[ch]; ok {
+		delete(l.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (m *manager) Subscribe(lastEventID uint64) *Subscription {
+	return m.events.subscribe(lastEventID)
+}
+
+// diffUsers returns the events turning the users of before into the ones of after
+func diffUsers(before, after *userData, now time.Time) []*Event {
+	var res []*Event
+	for _, u := range before.userSlice {
+		if before.userMapByName[u.Name][0] == u && len(after.userMapByName[u.Name]) == 0 {
+			res = append(res, &Event{Time: now, Kind: EventKindUser, Action: EventRemoved, User: u})
+		}
+	}
+	for _, u := range after.userSlice {
+		previous := before.userMapByName[u.Name]
+		switch {
+		case len(previous) == 0:
+			res = append(res, &Event{Time: now, Kind: EventKindUser, Action: EventAdded, User: u})
+		case after.userMapByName[u.Name][0] != u:
+			// a duplicated name, only the first entry is compared
+		case *previous[0] != *u:
+			res = append(res, &Event{Time: now, Kind: EventKindUser, Action: EventModified, User: u,
+				PreviousUser: previous[0]})
+		}
+	}
+	return res
+}
+
+// sameGroup compares the fields read from the sources, i.e. not the sets derived from them
+func sameGroup(a, b *Group) bool {
+	return a.Name == b.Name && a.GID == b.GID && a.Source == b.Source && sameValue(a.Members, b.Members) &&
+		sameValue(a.Admins, b.Admins) && sameValue(a.ShadowMembers, b.ShadowMembers)
+}
+
+// diffGroups returns the events turning the groups of before into the ones of after
+func diffGroups(before, after *groupData, now time.Time) []*Event {
+	var res []*Event
+	for _, g := range before.groupSlice {
+		if before.groupMapByName[g.Name][0] == g && len(after.groupMapByName[g.Name]) == 0 {
+			res = append(res, &Event{Time: now, Kind: EventKindGroup, Action: EventRemoved, Group: g})
+		}
+	}
+	for _, g := range after.groupSlice {
+		previous := before.groupMapByName[g.Name]
+		switch {
+		case len(previous) == 0:
+			res = append(res, &Event{Time: now, Kind: EventKindGroup, Action: EventAdded, Group: g})
+		case after.groupMapByName[g.Name][0] != g:
+			// a duplicated name, only the first entry is compared
+		case !sameGroup(previous[0], g):
+			res = append(res, &Event{Time: now, Kind: EventKindGroup, Action: EventModified, Group: g,
+				PreviousGroup: previous[0]})
+		}
+	}
+	return res
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	src := &staticSource{
+		users: []*User{
+			&User{Name: "root", UID: 0, GID: 0, Shell: "/bin/sh"},
+			&User{Name: "daemon", UID: 1, GID: 1},
+		},
+		groups: []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root"}}},
+	}
+	eventMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	sub := eventMgr.Subscribe(0)
+	defer sub.Close()
+	assert(t, len(sub.Backlog) == 0 && !sub.Missed)
+
+	// someone is added to wheel, root changes its shell and daemon is replaced by dwoodlins
+	src.users = []*User{
+		&User{Name: "root", UID: 0, GID: 0, Shell: "/bin/bash"},
+		&User{Name: "dwoodlins", UID: 1001, GID: 1001},
+	}
+	src.groups = []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root", "dwoodlins"}}}
+	eventMgr.(*manager).handleChange(UserChange | GroupChange)
+
+	generation := eventMgr.Version().Generation
+	expected := []struct {
+		kind   string
+		action EventAction
+		name   string
+	}{
+		{EventKindUser, EventRemoved, "daemon"},
+		{EventKindUser, EventModified, "root"},
+		{EventKindUser, EventAdded, "dwoodlins"},
+		{EventKindGroup, EventModified, "wheel"},
+	}
+	for i, exp := range expected {
+		e := <-sub.C
+		assert(t, e.ID == uint64(i+1))
+		assert(t, e.Generation == generation)
+		assert(t, e.Kind == exp.kind && e.Action == exp.action)
+		if e.Kind == EventKindUser {
+			assert(t, e.User.Name == exp.name && e.Group == nil && e.PreviousGroup == nil)
+			assert(t, (e.PreviousUser != nil) == (e.Action == EventModified))
+		} else {
+			assert(t, e.Group.Name == exp.name && e.User == nil && e.PreviousUser == nil)
+			// the previous entry tells the members added
+			assert(t, len(e.PreviousGroup.Members) == 1 && e.PreviousGroup.Members[0] == "root")
+		}
+		if e.Action == EventModified && e.Kind == EventKindUser {
+			assert(t, e.PreviousUser.Shell == "/bin/sh" && e.User.Shell == "/bin/bash")
+		}
+	}
+	assert(t, len(sub.C) == 0)
+	assert(t, (&Event{User: &User{UID: 1001}}).EntryID() == 1001)
+
+	// a reload without any change has no event
+	eventMgr.(*manager).handleChange(UserChange | GroupChange)
+	assert(t, len(sub.C) == 0)
+
+	// resume after the second event
+	resumed := eventMgr.Subscribe(2)
+	defer resumed.Close()
+	assert(t, !resumed.Missed)
+	assert(t, len(resumed.Backlog) == 2 && resumed.Backlog[0].ID == 3)
+
+	// an ID from before a restart
+	restarted := eventMgr.Subscribe(100)
+	defer restarted.Close()
+	assert(t, restarted.Missed && len(restarted.Backlog) == 0)
+}
+
+func TestEventLog(t *testing.T) {
+	log := &eventLog{}
+	slow := log.subscribe(0)
+	closed := log.subscribe(0)
+	closed.Close()
+	closed.Close()
+	_, ok := <-closed.C
+	assert(t, !ok)
+
+	now := time.Now()
+	for i := 0; i < eventLogSize+10; i++ {
+		log.publish([]*Event{&Event{Time: now, Kind: EventKindUser, Action: EventAdded, User: &User{UID: i}}})
+	}
+	assert(t, len(log.events) == eventLogSize)
+	assert(t, log.events[0].ID == 11)
+
+	// the slow subscriber is dropped once its buffer is full
+	count := 0
+	for range slow.C {
+		count++
+	}
+	assert(t, count == subscriberBufferSize)
+	slow.Close()
+
+	// the events before the oldest retained one are lost
+	sub := log.subscribe(5)
+	assert(t, sub.Missed && len(sub.Backlog) == eventLogSize)
+	sub = log.subscribe(10)
+	assert(t, !sub.Missed && len(sub.Backlog) == eventLogSize)
+	sub = log.subscribe(eventLogSize + 10)
+	assert(t, !sub.Missed && len(sub.Backlog) == 0)
+}
@@ -0,0 +1,614 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The expressions of the searches are made of comparisons and function calls, combined by and, or, not and
+// parentheses, e.g. uid >= 1000 and shell != "/usr/sbin/nologin" and memberOf("docker")
+//
+//	expr       := and { ("or" | "||") and }
+//	and        := unary { ("and" | "&&") unary }
+//	unary      := ("not" | "!") unary | "(" expr ")" | comparison | call
+//	comparison := field ("==" | "!=" | "<" | "<=" | ">" | ">=" | "=~" | "!~") literal
+//	call       := function "(" [ argument { "," argument } ] ")"
+//	argument   := field | literal
+//	literal    := integer | string in double quotes with the escapes of Go
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenInt
+	// the comparison operators
+	tokenOp
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// pos is the offset of the token in the expression, starting from 1 in the errors
+	pos int
+}
+
+// the operators and punctuation, longest first so that <= is not read as <
+var symbolTokens = []struct {
+	text string
+	kind tokenKind
+}{
+	{"==", tokenOp}, {"!=", tokenOp}, {"<=", tokenOp}, {">=", tokenOp}, {"=~", tokenOp}, {"!~", tokenOp},
+	{"&&", tokenAnd}, {"||", tokenOr},
+	{"<", tokenOp}, {">", tokenOp}, {"!", tokenNot}, {"(", tokenLParen}, {")", tokenRParen}, {",", tokenComma},
+}
+
+var keywordTokens = map[string]tokenKind{
+	"and": tokenAnd,
+	"or":  tokenOr,
+	"not": tokenNot,
+}
+
+// exprError is a syntax or type error at an offset of the expression
+type exprError struct {
+	pos int
+	msg string
+}
+
+func (e *exprError) Error() string {
+	return fmt.Sprintf("Invalid expression at %d: %s", e.pos+1, e.msg)
+}
+
+func errorAt(pos int, format string, a ...interface{}) error {
+	return &exprError{pos: pos, msg: fmt.Sprintf(format, a...)}
+}
+
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// lex splits src into tokens, ending with tokenEOF
+func lex(src string) ([]token, error) {
+	var res []token
+	i := 0
+Loop:
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentChar(c, true):
+			start := i
+			for i < len(src) && isIdentChar(src[i], false) {
+				i++
+			}
+			text := src[start:i]
+			kind, ok := keywordTokens[strings.ToLower(text)]
+			if !ok {
+				kind = tokenIdent
+			}
+			res = append(res, token{kind: kind, text: text, pos: start})
+		case isDigit(c) || c == '-' && i+1 < len(src) && isDigit(src[i+1]):
+			start := i
+			for i++; i < len(src) && isDigit(src[i]); i++ {
+			}
+			res = append(res, token{kind: tokenInt, text: src[start:i], pos: start})
+		case c == '"':
+			start := i
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(src) {
+				return nil, errorAt(start, "unterminated string")
+			}
+			i++
+			text, err := strconv.Unquote(src[start:i])
+			if err != nil {
+				return nil, errorAt(start, "invalid string %s", src[start:i])
+			}
+			res = append(res, token{kind: tokenString, text: text, pos: start})
+		default:
+			for _, symbol := range symbolTokens {
+				if strings.HasPrefix(src[i:], symbol.text) {
+					res = append(res, token{kind: symbol.kind, text: symbol.text, pos: i})
+					i += len(symbol.text)
+					continue Loop
+				}
+			}
+			if c == '=' {
+				return nil, errorAt(i, "use == to compare")
+			}
+			return nil, errorAt(i, "unexpected character %q", c)
+		}
+	}
+	return append(res, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// valueType is the type of the fields and literals
+type valueType int
+
+const (
+	typeString valueType = iota
+	typeInt
+)
+
+func (t valueType) String() string {
+	if t == typeInt {
+		return "an integer"
+	}
+	return "a string"
+}
+
+// node is a boolean node of the expression
+type node interface {
+	// String returns the node as written in an expression, fully parenthesized
+	String() string
+}
+
+type logicalNode struct {
+	and         bool
+	left, right node
+}
+
+type notNode struct {
+	operand node
+}
+
+type literal struct {
+	typ    valueType
+	text   string
+	number int
+	pos    int
+}
+
+type compareNode struct {
+	field string
+	op    string
+	value *literal
+	pos   int
+
+	def     *fieldDef
+	pattern *regexp.Regexp
+}
+
+// argument is either a field or a literal
+type argument struct {
+	field string
+	value *literal
+	pos   int
+
+	def *fieldDef
+}
+
+type callNode struct {
+	name string
+	args []*argument
+	pos  int
+
+	pattern *regexp.Regexp
+}
+
+func (l *literal) String() string {
+	if l.typ == typeInt {
+		return l.text
+	}
+	return strconv.Quote(l.text)
+}
+
+func (n *logicalNode) String() string {
+	op := "or"
+	if n.and {
+		op = "and"
+	}
+	return "(" + n.left.String() + " " + op + " " + n.right.String() + ")"
+}
+
+func (n *notNode) String() string {
+	return "not " + n.operand.String()
+}
+
+func (n *compareNode) String() string {
+	return n.field + " " + n.op + " " + n.value.String()
+}
+
+func (n *callNode) String() string {
+	var args []string
+	for _, arg := range n.args {
+		if arg.value != nil {
+			args = append(args, arg.value.String())
+		} else {
+			args = append(args, arg.field)
+		}
+	}
+	return n.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+type parser struct {
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	res := p.tokens[p.next]
+	if res.kind != tokenEOF {
+		p.next++
+	}
+	return res
+}
+
+// describe returns how tok is referred to in the errors
+func describe(tok token) string {
+	switch tok.kind {
+	case tokenEOF:
+		return "the end"
+	case tokenString:
+		return strconv.Quote(tok.text)
+	}
+	return tok.text
+}
+
+// parse parses src into its root node
+func parse(src string) (node, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, errorAt(0, "empty expression")
+	}
+	res, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, errorAt(tok.pos, "unexpected %s, expecting and or or", describe(tok))
+	}
+	return res, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	res, err := p.parseAnd()
+	for err == nil && p.peek().kind == tokenOr {
+		p.take()
+		var right node
+		if right, err = p.parseAnd(); err == nil {
+			res = &logicalNode{left: res, right: right}
+		}
+	}
+	return res, err
+}
+
+func (p *parser) parseAnd() (node, error) {
+	res, err := p.parseUnary()
+	for err == nil && p.peek().kind == tokenAnd {
+		p.take()
+		var right node
+		if right, err = p.parseUnary(); err == nil {
+			res = &logicalNode{and: true, left: res, right: right}
+		}
+	}
+	return res, err
+}
+
+func (p *parser) parseUnary() (node, error) {
+	tok := p.take()
+	switch tok.kind {
+	case tokenNot:
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	case tokenLParen:
+		res, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.take(); closing.kind != tokenRParen {
+			return nil, errorAt(closing.pos, "unexpected %s, expecting )", describe(closing))
+		}
+		return res, nil
+	case tokenIdent:
+		if p.peek().kind == tokenLParen {
+			return p.parseCall(tok)
+		}
+		op := p.take()
+		if op.kind != tokenOp {
+			return nil, errorAt(op.pos, "unexpected %s, expecting a comparison operator after %s",
+				describe(op), tok.text)
+		}
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{field: tok.text, op: op.text, value: value, pos: tok.pos}, nil
+	}
+	return nil, errorAt(tok.pos, "unexpected %s, expecting a comparison or a function call", describe(tok))
+}
+
+func (p *parser) parseLiteral() (*literal, error) {
+	tok := p.take()
+	switch tok.kind {
+	case tokenString:
+		return &literal{typ: typeString, text: tok.text, pos: tok.pos}, nil
+	case tokenInt:
+		number, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return nil, errorAt(tok.pos, "%s is out of range", tok.text)
+		}
+		return &literal{typ: typeInt, text: tok.text, number: number, pos: tok.pos}, nil
+	}
+	return nil, errorAt(tok.pos, "unexpected %s, expecting a string or an integer", describe(tok))
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	res := &callNode{name: name.text, pos: name.pos}
+	p.take()
+	if p.peek().kind == tokenRParen {
+		p.take()
+		return res, nil
+	}
+	for {
+		tok := p.peek()
+		if tok.kind == tokenIdent {
+			p.take()
+			res.args = append(res.args, &argument{field: tok.text, pos: tok.pos})
+		} else {
+			value, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			res.args = append(res.args, &argument{value: value, pos: tok.pos})
+		}
+		switch tok = p.take(); tok.kind {
+		case tokenRParen:
+			return res, nil
+		case tokenComma:
+		default:
+			return nil, errorAt(tok.pos, "unexpected %s, expecting , or )", describe(tok))
+		}
+	}
+}
+
+// fieldDef is a field of the users or groups that can be compared
+type fieldDef struct {
+	typ    valueType
+	text   func(entry interface{}) string
+	number func(entry interface{}) int
+}
+
+var userFieldDefs = map[string]*fieldDef{
+	"name":    &fieldDef{typ: typeString, text: func(e interface{}) string { return e.(*User).Name }},
+	"uid":     &fieldDef{typ: typeInt, number: func(e interface{}) int { return e.(*User).UID }},
+	"gid":     &fieldDef{typ: typeInt, number: func(e interface{}) int { return e.(*User).GID }},
+	"comment": &fieldDef{typ: typeString, text: func(e interface{}) string { return e.(*User).Comment }},
+	"home":    &fieldDef{typ: typeString, text: func(e interface{}) string { return e.(*User).Home }},
+	"shell":   &fieldDef{typ: typeString, text: func(e interface{}) string { return e.(*User).Shell }},
+	"source":  &fieldDef{typ: typeString, text: func(e interface{}) string { return e.(*User).Source }},
+}
+
+var groupFieldDefs = map[string]*fieldDef{
+	"name":   &fieldDef{typ: typeString, text: func(e interface{}) string { return e.(*Group).Name }},
+	"gid":    &fieldDef{typ: typeInt, number: func(e interface{}) int { return e.(*Group).GID }},
+	"source": &fieldDef{typ: typeString, text: func(e interface{}) string { return e.(*Group).Source }},
+}
+
+// the functions, the ones testing the membership only apply to either the users or the groups
+const (
+	funcStartsWith = "startsWith"
+	funcEndsWith   = "endsWith"
+	funcGlob       = "glob"
+	// memberOf(group) tells whether the user belongs to the group, by name or GID, like `id -G`
+	funcMemberOf = "memberOf"
+	// hasMember(user) and hasAdmin(user) tell whether the user is listed in the members or admins of the group
+	funcHasMember = "hasMember"
+	funcHasAdmin  = "hasAdmin"
+)
+
+// the kinds of the parameters of the functions
+type paramKind string
+
+const (
+	paramField paramKind = "a string field"
+	paramText  paramKind = "a string"
+	// a name, or for memberOf a GID as well
+	paramName paramKind = "a name"
+)
+
+var funcParams = map[string][]paramKind{
+	funcStartsWith: {paramField, paramText},
+	funcEndsWith:   {paramField, paramText},
+	funcGlob:       {paramField, paramText},
+	funcMemberOf:   {paramName},
+	funcHasMember:  {paramName},
+	funcHasAdmin:   {paramName},
+}
+
+var userFuncs = []string{funcStartsWith, funcEndsWith, funcGlob, funcMemberOf}
+var groupFuncs = []string{funcStartsWith, funcEndsWith, funcGlob, funcHasMember, funcHasAdmin}
+
+// checker checks the fields, the types and the functions of an expression, and compiles its patterns
+type checker struct {
+	fields map[string]*fieldDef
+	funcs  []string
+	// kind is either EventKindUser or EventKindGroup
+	kind string
+}
+
+func (c *checker) check(n node) error {
+	switch n := n.(type) {
+	case *logicalNode:
+		if err := c.check(n.left); err != nil {
+			return err
+		}
+		return c.check(n.right)
+	case *notNode:
+		return c.check(n.operand)
+	case *compareNode:
+		return c.checkCompare(n)
+	case *callNode:
+		return c.checkCall(n)
+	}
+	return nil
+}
+
+func (c *checker) field(name string, pos int) (*fieldDef, error) {
+	def := c.fields[name]
+	if def == nil {
+		names := make([]string, 0, len(c.fields))
+		for name := range c.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errorAt(pos, "unknown field %s, the fields of a %s are %s", name, c.kind,
+			strings.Join(names, ", "))
+	}
+	return def, nil
+}
+
+func (c *checker) checkCompare(n *compareNode) error {
+	def, err := c.field(n.field, n.pos)
+	if err != nil {
+		return err
+	}
+	n.def = def
+	if n.value.typ != def.typ {
+		return errorAt(n.value.pos, "%s is %s, it cannot be compared with %s", n.field, def.typ, n.value)
+	}
+
+	switch n.op {
+	case "==", "!=":
+	case "<", "<=", ">", ">=":
+		if def.typ != typeInt {
+			return errorAt(n.pos, "%s is a string, it cannot be compared with %s", n.field, n.op)
+		}
+	case "=~", "!~":
+		if def.typ != typeString {
+			return errorAt(n.pos, "%s is an integer, it cannot be matched with %s", n.field, n.op)
+		}
+		if n.pattern, err = regexp.Compile(n.value.text); err != nil {
+			return errorAt(n.value.pos, "invalid regex: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkCall(n *callNode) error {
+	known := false
+	for _, name := range c.funcs {
+		known = known || name == n.name
+	}
+	if !known {
+		return errorAt(n.pos, "unknown function %s, the functions of a %s are %s", n.name, c.kind,
+			strings.Join(c.funcs, ", "))
+	}
+
+	params := funcParams[n.name]
+	if len(n.args) != len(params) {
+		return errorAt(n.pos, "%s takes %d arguments", n.name, len(params))
+	}
+
+	for i, arg := range n.args {
+		valid := arg.value != nil
+		switch params[i] {
+		case paramField:
+			if valid = arg.value == nil; valid {
+				def, err := c.field(arg.field, arg.pos)
+				if err != nil {
+					return err
+				}
+				arg.def, valid = def, def.typ == typeString
+			}
+		case paramText:
+			valid = valid && arg.value.typ == typeString
+		case paramName:
+			valid = valid && (arg.value.typ == typeString || n.name == funcMemberOf)
+		}
+		if !valid {
+			return errorAt(arg.pos, "argument %d of %s must be %s", i+1, n.name, params[i])
+		}
+	}
+
+	if n.name == funcGlob {
+		pattern, err := globToRegexp(n.args[1].value.text)
+		if err == nil {
+			n.pattern, err = regexp.Compile(pattern)
+		}
+		if err != nil {
+			return errorAt(n.args[1].pos, "invalid glob: %s", err)
+		}
+	}
+	return nil
+}
+
+// UserExpression is a boolean expression over the fields of the users, see ParseUserExpression
+type UserExpression struct {
+	root node
+}
+
+// GroupExpression is a boolean expression over the fields of the groups, see ParseGroupExpression
+type GroupExpression struct {
+	root node
+}
+
+// ParseUserExpression parses and type checks src, a boolean expression over the fields of the users, i.e.
+// name, uid, gid, comment, home, shell and source. The strings are compared with ==, != and the regular
+// expressions with =~ and !~, the integers with ==, !=, <, <=, > and >=. The functions are startsWith(field,
+// prefix), endsWith(field, suffix), glob(field, pattern) and memberOf(group), where group is a name or a GID.
+func ParseUserExpression(src string) (*UserExpression, error) {
+	root, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{fields: userFieldDefs, funcs: userFuncs, kind: EventKindUser}
+	if err = c.check(root); err != nil {
+		return nil, err
+	}
+	return &UserExpression{root: root}, nil
+}
+
+// ParseGroupExpression parses and type checks src, a boolean expression over the fields of the groups, i.e.
+// name, gid and source, see ParseUserExpression. Instead of memberOf, the functions hasMember(user) and
+// hasAdmin(user) tell whether the user is listed in the members or administrators of the group.
+func ParseGroupExpression(src string) (*GroupExpression, error) {
+	root, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{fields: groupFieldDefs, funcs: groupFuncs, kind: EventKindGroup}
+	if err = c.check(root); err != nil {
+		return nil, err
+	}
+	return &GroupExpression{root: root}, nil
+}
+
+// String returns the expression as parsed, fully parenthesized
+func (e *UserExpression) String() string {
+	return e.root.String()
+}
+
+// String returns the expression as parsed, fully parenthesized
+func (e *GroupExpression) String() string {
+	return e.root.String()
+}
@@ -0,0 +1,67 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	for src, expected := range map[string]string{
+		`uid >= 1000 and shell != "/usr/sbin/nologin" and memberOf("docker")`: `((uid >= 1000 and shell != "/usr/sbin/nologin") and memberOf("docker"))`,
+		`name == "root" or uid > 0 and gid < 10`:                              `(name == "root" or (uid > 0 and gid < 10))`,
+		`(name == "root" || uid > 0) && !(gid == -2)`:                         `((name == "root" or uid > 0) and not gid == -2)`,
+		`NOT startsWith(home, "/home/") AND glob(shell, "*/nologin")`:         `(not startsWith(home, "/home/") and glob(shell, "*/nologin"))`,
+		`comment =~ "^\"quoted\"$"`:                                           `comment =~ "^\"quoted\"$"`,
+	} {
+		expr, err := ParseUserExpression(src)
+		assert(t, err == nil)
+		assert(t, expr.String() == expected)
+	}
+
+	for src, position := range map[string]string{
+		``:                        "at 1: empty expression",
+		`uid = 0`:                 "at 5: use == to compare",
+		`uid == `:                 "at 8: unexpected the end",
+		`uid == 0 and`:            "at 13: unexpected the end",
+		`(uid == 0`:               "at 10: unexpected the end, expecting )",
+		`uid == 0 name == "root"`: "at 10: unexpected name",
+		`name == "root`:           "at 9: unterminated string",
+		`uid == 0 # comment`:      "at 10: unexpected character",
+		`memberOf("a" "b")`:       "at 14: unexpected",
+		`uid`:                     "at 4: unexpected the end, expecting a comparison operator",
+	} {
+		_, err := ParseUserExpression(src)
+		assert(t, err != nil && strings.Contains(err.Error(), position))
+	}
+}
+
+func TestCheckExpression(t *testing.T) {
+	for src, reason := range map[string]string{
+		`password == "x"`:             "unknown field password",
+		`uid == "0"`:                  "uid is an integer, it cannot be compared with \"0\"",
+		`shell == 0`:                  "shell is a string",
+		`shell < "/bin/sh"`:           "shell is a string, it cannot be compared with <",
+		`uid =~ "1.*"`:                "uid is an integer",
+		`name =~ "("`:                 "invalid regex",
+		`hasMember("root")`:           "unknown function hasMember",
+		`memberOf()`:                  "memberOf takes 1 arguments",
+		`memberOf(name)`:              "argument 1 of memberOf must be a name",
+		`startsWith("/home", home)`:   "argument 1 of startsWith must be a string field",
+		`startsWith(uid, "1")`:        "argument 1 of startsWith must be a string field",
+		`endsWith(home, 1)`:           "argument 2 of endsWith must be a string",
+		`glob(shell, "/bin/[")`:       "invalid glob",
+		`uid == 99999999999999999999`: "out of range",
+		`uid >= 0 and shell == "/sh" ` + `and comments == ""`: "unknown field comments",
+	} {
+		_, err := ParseUserExpression(src)
+		assert(t, err != nil && strings.Contains(err.Error(), reason))
+	}
+
+	// the groups have their own fields and functions
+	_, err := ParseGroupExpression(`hasMember("root") and not hasAdmin("root") and gid > 0`)
+	assert(t, err == nil)
+	for _, src := range []string{`memberOf("root")`, `shell == "/bin/sh"`, `hasMember(0)`} {
+		_, err = ParseGroupExpression(src)
+		assert(t, err != nil)
+	}
+}
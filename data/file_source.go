@@ -0,0 +1,565 @@
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chaowang101/paas/config"
+	"github.com/howeyc/fsnotify"
+)
+
+// passwd file offset
+const (
+	userNameOffset = 0
+	// skip password offset
+	uidOffset = iota + 1
+	userGidOffset
+	commentOffset
+	homeOffset
+	shellOffset
+)
+
+// group file offset
+const (
+	groupNameOffset = 0
+	// skip password offset
+	groupGidOffset = iota + 1
+	memberOffset
+)
+
+const (
+	// FileSourceType is the type of the Source reading local passwd and group files
+	FileSourceType = "file"
+
+	fieldDelim  = ":"
+	memberDelim = ","
+
+	numberOfFieldGroupEntry  = 4
+	numberOfFieldPasswdField = 7
+)
+
+// ConflictPolicy tells which entries are kept when several passwd files, or several group files, have an
+// entry with the same name. Entries with the same name in a single file are never a conflict.
+type ConflictPolicy string
+
+const (
+	// FirstWins keeps the entries of the first file having the name, like the NSS files module does
+	FirstWins ConflictPolicy = "first"
+	// LastWins keeps the entries of the last file having the name, i.e. a later file overrides an earlier one
+	LastWins ConflictPolicy = "last"
+	// ConflictError fails the loading when a name is found in several files
+	ConflictError ConflictPolicy = "error"
+)
+
+// fileSource is the Source reading the users and groups from local passwd and group files, optionally along
+// with the shadow and gshadow files. The files are monitored with fsnotify through their directories, or
+// compared at an interval, depending on the WatchStrategy.
+type fileSource struct {
+	passwdFilePath string
+	groupFilePath  string
+	// read after passwdFilePath and groupFilePath, in order
+	extraPasswdFilePaths []string
+	extraGroupFilePaths  []string
+	// optional, the files in a drop-in directory are read last in the lexical order of their names
+	passwdDropInDir string
+	groupDropInDir  string
+	conflictPolicy  ConflictPolicy
+	// skip the malformed lines instead of failing the whole file
+	lenient bool
+	// optional, empty if the shadow file is not read
+	shadowFilePath string
+	// optional, empty if the gshadow file is not read
+	gshadowFilePath string
+	watchStrategy   WatchStrategy
+	// the interval of PollWatch and ChecksumWatch
+	watchInterval time.Duration
+
+	exit chan struct{}
+	// Stop might be called more than once, e.g. by a Reload replacing the sources and by the shutdown
+	stopOnce sync.Once
+	// merges the bursts of file events into a single notification, set by Start
+	debouncer *debouncer
+	// the directories watched with InotifyWatch, set by Start
+	dirs []*watchedDir
+	// the goroutines watching the files, waited for by Stop
+	wg        sync.WaitGroup
+	watchLock sync.Mutex
+	lastCheck time.Time
+}
+
+// Option customizes the file Source returned by NewFileSource
+type Option func(src *fileSource)
+
+// WithShadowFile makes the Source read the shadow file at shadowPath to derive the account status of the
+// users. Only the password aging information is kept.
+func WithShadowFile(shadowPath string) Option {
+	return func(src *fileSource) {
+		src.shadowFilePath = shadowPath
+	}
+}
+
+// WithGShadowFile makes the Source read the gshadow file at gshadowPath to find the administrators of the
+// groups, and the members only listed in the gshadow file.
+func WithGShadowFile(gshadowPath string) Option {
+	return func(src *fileSource) {
+		src.gshadowFilePath = gshadowPath
+	}
+}
+
+// WithExtraPasswdFiles makes the Source read the passwd files at paths, in order, after the main passwd file
+func WithExtraPasswdFiles(paths ...string) Option {
+	return func(src *fileSource) {
+		src.extraPasswdFilePaths = append(src.extraPasswdFilePaths, paths...)
+	}
+}
+
+// WithExtraGroupFiles makes the Source read the group files at paths, in order, after the main group file
+func WithExtraGroupFiles(paths ...string) Option {
+	return func(src *fileSource) {
+		src.extraGroupFilePaths = append(src.extraGroupFilePaths, paths...)
+	}
+}
+
+// WithPasswdDropInDir makes the Source read every file in dir as a passwd file, in the lexical order of their
+// names, after all the other passwd files. Hidden files and files ending with "~" are skipped.
+func WithPasswdDropInDir(dir string) Option {
+	return func(src *fileSource) {
+		src.passwdDropInDir = dir
+	}
+}
+
+// WithGroupDropInDir makes the Source read every file in dir as a group file, in the lexical order of their
+// names, after all the other group files. Hidden files and files ending with "~" are skipped.
+func WithGroupDropInDir(dir string) Option {
+	return func(src *fileSource) {
+		src.groupDropInDir = dir
+	}
+}
+
+// WithConflictPolicy sets how the entries with the same name in several files are resolved, FirstWins by default
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(src *fileSource) {
+		src.conflictPolicy = policy
+	}
+}
+
+// WithLenientParsing makes the Source skip the malformed lines and keep the valid entries, instead of failing
+// the whole file. The skipped lines are reported in the Diagnostics of the snapshots.
+func WithLenientParsing() Option {
+	return func(src *fileSource) {
+		src.lenient = true
+	}
+}
+
+// WithWatchStrategy sets how the changes of the files are detected, InotifyWatch by default. interval is the
+// interval of PollWatch and ChecksumWatch, DefaultWatchInterval if 0.
+func WithWatchStrategy(strategy WatchStrategy, interval time.Duration) Option {
+	return func(src *fileSource) {
+		src.watchStrategy = strategy
+		if interval != 0 {
+			src.watchInterval = interval
+		}
+	}
+}
+
+// NewFileSource instantiate a new Source to read the users and groups from the provided passwd file and group
+// file. Start() monitors any change that happens to those files.
+func NewFileSource(passwdPath, groupPath string, opts ...Option) (Source, error) {
+	src := &fileSource{
+		passwdFilePath: passwdPath,
+		groupFilePath:  groupPath,
+		conflictPolicy: FirstWins,
+		watchStrategy:  InotifyWatch,
+		watchInterval:  DefaultWatchInterval,
+		exit:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(src)
+	}
+
+	switch src.conflictPolicy {
+	case FirstWins, LastWins, ConflictError:
+	default:
+		return nil, fmt.Errorf("Unknown conflict policy %s", src.conflictPolicy)
+	}
+	switch src.watchStrategy {
+	case InotifyWatch, PollWatch, ChecksumWatch:
+	default:
+		return nil, fmt.Errorf("Unknown watch strategy %s", src.watchStrategy)
+	}
+	if src.watchInterval < 0 {
+		return nil, fmt.Errorf("Invalid watch interval %s", src.watchInterval)
+	}
+
+	for _, path := range src.paths() {
+		if res, err := pathExists(path); !res {
+			if err != nil {
+				log.Printf("Fail to find path %s, error:%s", path, err)
+			}
+			return nil, fmt.Errorf("File %s does not exist", path)
+		}
+	}
+	return src, nil
+}
+
+func newFileSourceFromConfig(setting *config.SourceConfig) (Source, error) {
+	var opts []Option
+	if len(setting.ShadowFilePath) > 0 {
+		opts = append(opts, WithShadowFile(setting.ShadowFilePath))
+	}
+	if len(setting.GShadowFilePath) > 0 {
+		opts = append(opts, WithGShadowFile(setting.GShadowFilePath))
+	}
+	opts = append(opts, WithExtraPasswdFiles(setting.ExtraPasswdFilePaths...),
+		WithExtraGroupFiles(setting.ExtraGroupFilePaths...))
+	if len(setting.PasswdDropInDir) > 0 {
+		opts = append(opts, WithPasswdDropInDir(setting.PasswdDropInDir))
+	}
+	if len(setting.GroupDropInDir) > 0 {
+		opts = append(opts, WithGroupDropInDir(setting.GroupDropInDir))
+	}
+	if setting.LenientParsing {
+		opts = append(opts, WithLenientParsing())
+	}
+	if len(setting.ConflictPolicy) > 0 {
+		opts = append(opts, WithConflictPolicy(ConflictPolicy(setting.ConflictPolicy)))
+	}
+	if len(setting.WatchStrategy) > 0 || setting.WatchIntervalInSec != 0 {
+		strategy := WatchStrategy(setting.WatchStrategy)
+		if len(strategy) == 0 {
+			strategy = InotifyWatch
+		}
+		opts = append(opts, WithWatchStrategy(strategy, time.Duration(setting.WatchIntervalInSec)*time.Second))
+	}
+	return NewFileSource(setting.PasswdFilePath, setting.GroupFilePath, opts...)
+}
+
+// watchedPaths returns all the files and drop-in directories read by the Source, along with the data that
+// changes when they change
+func (s *fileSource) watchedPaths() map[string]Change {
+	res := map[string]Change{
+		s.passwdFilePath: UserChange,
+		s.groupFilePath:  GroupChange,
+	}
+	for _, path := range append([]string{s.shadowFilePath, s.passwdDropInDir}, s.extraPasswdFilePaths...) {
+		if len(path) > 0 {
+			res[path] |= UserChange
+		}
+	}
+	for _, path := range append([]string{s.gshadowFilePath, s.groupDropInDir}, s.extraGroupFilePaths...) {
+		if len(path) > 0 {
+			res[path] |= GroupChange
+		}
+	}
+	return res
+}
+
+// paths returns all the files and drop-in directories read by the Source, in a stable order
+func (s *fileSource) paths() []string {
+	res := []string{s.passwdFilePath}
+	res = append(res, s.extraPasswdFilePaths...)
+	res = append(res, s.groupFilePath)
+	res = append(res, s.extraGroupFilePaths...)
+	for _, path := range []string{s.passwdDropInDir, s.groupDropInDir, s.shadowFilePath, s.gshadowFilePath} {
+		if len(path) > 0 {
+			res = append(res, path)
+		}
+	}
+	return res
+}
+
+// listFiles returns the main file, the extra files and the files in the drop-in directory, in reading order
+func listFiles(mainPath string, extraPaths []string, dropInDir string) ([]string, error) {
+	res := append([]string{mainPath}, extraPaths...)
+	if len(dropInDir) == 0 {
+		return res, nil
+	}
+
+	// ReadDir returns the entries sorted by name
+	infos, err := ioutil.ReadDir(dropInDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if isDropInFile(info) {
+			res = append(res, filepath.Join(dropInDir, info.Name()))
+		}
+	}
+	return res, nil
+}
+
+// isDropInFile tells whether the entry of a drop-in directory is read, the sub-directories, hidden files and
+// the backup files of editors are skipped
+func isDropInFile(info os.FileInfo) bool {
+	name := info.Name()
+	return !info.IsDir() && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, "~")
+}
+
+// resolveConflicts returns, for every name found in several files, the index of the file whose entries with the
+// name are kept. names holds the names of the entries of each file, in reading order.
+func resolveConflicts(policy ConflictPolicy, kind string, files []string, names [][]string) (map[string]int, error) {
+	firstFile := make(map[string]int)
+	res := make(map[string]int)
+	for i := range names {
+		for _, name := range names[i] {
+			first, ok := firstFile[name]
+			if !ok {
+				firstFile[name] = i
+				continue
+			}
+			if first == i {
+				continue
+			}
+
+			switch policy {
+			case ConflictError:
+				return nil, fmt.Errorf("Conflicting %s %s in %s and %s", kind, name, files[first], files[i])
+			case LastWins:
+				res[name] = i
+			default:
+				res[name] = first
+			}
+		}
+	}
+	return res, nil
+}
+
+func (s *fileSource) Name() string {
+	return FileSourceType + ":" + strings.Join(s.paths(), ",")
+}
+
+// LoadUsers parses the passwd files, along with the shadow file if it is configured
+func (s *fileSource) LoadUsers() (*UserSnapshot, error) {
+	files, err := listFiles(s.passwdFilePath, s.extraPasswdFilePaths, s.passwdDropInDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var diagnostics []*Diagnostic
+	usersOfFiles := make([][]*User, len(files))
+	names := make([][]string, len(files))
+	for i, path := range files {
+		var fileDiagnostics []*Diagnostic
+		if usersOfFiles[i], fileDiagnostics, err = parsePasswdFile(path, s.lenient); err != nil {
+			return nil, err
+		}
+		diagnostics = append(diagnostics, fileDiagnostics...)
+		for _, u := range usersOfFiles[i] {
+			names[i] = append(names[i], u.Name)
+		}
+	}
+	winners, err := resolveConflicts(s.conflictPolicy, "user", files, names)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0)
+	for i := range usersOfFiles {
+		for _, u := range usersOfFiles[i] {
+			if winner, ok := winners[u.Name]; !ok || winner == i {
+				users = append(users, u)
+			}
+		}
+	}
+	res := &UserSnapshot{Users: users, Diagnostics: diagnostics}
+	if len(s.shadowFilePath) == 0 {
+		return res, nil
+	}
+
+	if res.Shadows, diagnostics, err = parseShadowFile(s.shadowFilePath, s.lenient); err != nil {
+		return nil, err
+	}
+	res.Diagnostics = append(res.Diagnostics, diagnostics...)
+	return res, nil
+}
+
+// LoadGroups parses the group files, along with the gshadow file if it is configured
+func (s *fileSource) LoadGroups() (*GroupSnapshot, error) {
+	files, err := listFiles(s.groupFilePath, s.extraGroupFilePaths, s.groupDropInDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var diagnostics []*Diagnostic
+	groupsOfFiles := make([][]*Group, len(files))
+	names := make([][]string, len(files))
+	for i, path := range files {
+		var fileDiagnostics []*Diagnostic
+		if groupsOfFiles[i], fileDiagnostics, err = parseGroupFile(path, s.lenient); err != nil {
+			return nil, err
+		}
+		diagnostics = append(diagnostics, fileDiagnostics...)
+		for _, g := range groupsOfFiles[i] {
+			names[i] = append(names[i], g.Name)
+		}
+	}
+	winners, err := resolveConflicts(s.conflictPolicy, "group", files, names)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]*Group, 0)
+	for i := range groupsOfFiles {
+		for _, g := range groupsOfFiles[i] {
+			if winner, ok := winners[g.Name]; !ok || winner == i {
+				groups = append(groups, g)
+			}
+		}
+	}
+	res := &GroupSnapshot{Groups: groups, Diagnostics: diagnostics}
+	if len(s.gshadowFilePath) == 0 {
+		return res, nil
+	}
+
+	gshadowMapByName, diagnostics, err := parseGShadowFile(s.gshadowFilePath, s.lenient)
+	if err != nil {
+		return nil, err
+	}
+	res.Diagnostics = append(res.Diagnostics, diagnostics...)
+	for _, g := range groups {
+		if entry := gshadowMapByName[g.Name]; entry != nil {
+			applyGShadow(g, entry)
+		}
+	}
+	return res, nil
+}
+
+func (s *fileSource) Start(notify func(change Change)) error {
+	if s.watchStrategy != InotifyWatch {
+		s.wg.Add(1)
+		go s.pollFiles(s.fingerprints(), notify)
+		return nil
+	}
+
+	s.debouncer = newDebouncer(watchDebounceDelay, watchMaxDelay, notify)
+	for _, dir := range s.watchedDirs() {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		if err = watcher.Watch(dir.path); err != nil {
+			watcher.Close()
+			return err
+		}
+		s.watchLock.Lock()
+		dir.watcher = watcher
+		dir.status.State = WatcherRunning
+		s.dirs = append(s.dirs, dir)
+		s.watchLock.Unlock()
+		s.wg.Add(1)
+		go s.watchDir(watcher, dir)
+	}
+	return nil
+}
+
+// Stop returns once the files are no longer watched, and the change being notified, if any, is handled
+func (s *fileSource) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.exit)
+		s.wg.Wait()
+		if s.debouncer != nil {
+			s.debouncer.stop()
+		}
+	})
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func parseGroup(line string) (*Group, error) {
+	strList := strings.Split(strings.TrimSpace(line), fieldDelim)
+	if len(strList) != numberOfFieldGroupEntry {
+		return nil, fmt.Errorf("Malformed content %s", line)
+	}
+	gid, err := parseID(strList[groupGidOffset])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid GID %s in %s", strList[groupGidOffset], line)
+	}
+	res := &Group{
+		Name:    strings.TrimSpace(strList[groupNameOffset]),
+		GID:     gid,
+		Members: make([]string, 0),
+	}
+
+	members := strList[memberOffset]
+	if len(members) != 0 {
+		memberList := strings.Split(strings.TrimSpace(members), memberDelim)
+		res.Members = append(res.Members, memberList...)
+	}
+
+	return res, nil
+}
+
+// parseGroupFile parses the group file at groupFilePath, the Source of every group is set to groupFilePath
+func parseGroupFile(groupFilePath string, lenient bool) ([]*Group, []*Diagnostic, error) {
+	res := make([]*Group, 0)
+	diagnostics, err := parseLines(groupFilePath, lenient, false, func(line string) error {
+		group, err := parseGroup(line)
+		if err != nil {
+			return err
+		}
+		group.Source = groupFilePath
+		res = append(res, group)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, diagnostics, nil
+}
+
+func parseUser(line string) (*User, error) {
+	strList := strings.Split(strings.TrimSpace(line), fieldDelim)
+	if len(strList) != numberOfFieldPasswdField {
+		return nil, fmt.Errorf("Malformed content %s", line)
+	}
+	uid, err := parseID(strList[uidOffset])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid UID %s in %s", strList[uidOffset], line)
+	}
+	gid, err := parseID(strList[userGidOffset])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid GID %s in %s", strList[userGidOffset], line)
+	}
+	res := &User{
+		Name:    strings.TrimSpace(strList[userNameOffset]),
+		UID:     uid,
+		GID:     gid,
+		Comment: strings.TrimSpace(strList[commentOffset]),
+		Home:    strings.TrimSpace(strList[homeOffset]),
+		Shell:   strings.TrimSpace(strList[shellOffset]),
+	}
+	return res, nil
+}
+
+// parsePasswdFile parses the passwd file at passwdFilePath, the Source of every user is set to passwdFilePath
+func parsePasswdFile(passwdFilePath string, lenient bool) ([]*User, []*Diagnostic, error) {
+	res := make([]*User, 0)
+	diagnostics, err := parseLines(passwdFilePath, lenient, false, func(line string) error {
+		user, err := parseUser(line)
+		if err != nil {
+			return err
+		}
+		user.Source = passwdFilePath
+		res = append(res, user)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, diagnostics, nil
+}
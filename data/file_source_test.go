@@ -0,0 +1,145 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chaowang101/paas/config"
+)
+
+func TestParseInvalidID(t *testing.T) {
+	user, err := parseUser("root:*:0:0:System Administrator:/var/root:/bin/sh")
+	assert(t, err == nil)
+	assert(t, user.UID == 0 && user.GID == 0)
+
+	for _, line := range []string{
+		"root:*:root:0:System Administrator:/var/root:/bin/sh",
+		"root:*:0::System Administrator:/var/root:/bin/sh",
+		"root:*:1.5:0:System Administrator:/var/root:/bin/sh",
+	} {
+		_, err = parseUser(line)
+		assert(t, err != nil)
+	}
+
+	group, err := parseGroup("nobody:*:-2:")
+	assert(t, err == nil)
+	assert(t, group.GID == -2)
+
+	_, err = parseGroup("nobody:*:nobody:")
+	assert(t, err != nil)
+}
+
+func TestNewFileSource(t *testing.T) {
+	_, err := NewFileSource(originalPasswdPath, "../testData/group_not_exist")
+	assert(t, err != nil)
+
+	_, err = NewFileSource(originalPasswdPath, originalGroupPath, WithShadowFile("../testData/shadow_not_exist"))
+	assert(t, err != nil)
+
+	src, err := newFileSourceFromConfig(&config.SourceConfig{
+		PasswdFilePath:  originalPasswdPath,
+		GroupFilePath:   originalGroupPath,
+		GShadowFilePath: originalGShadowPath,
+	})
+	assert(t, err == nil)
+	assert(t, strings.HasPrefix(src.Name(), FileSourceType+":"))
+	assert(t, strings.Contains(src.Name(), originalGShadowPath))
+
+	users, err := src.LoadUsers()
+	assert(t, err == nil)
+	assert(t, len(users.Users) == 6)
+	assert(t, len(users.Shadows) == 0)
+
+	groups, err := src.LoadGroups()
+	assert(t, err == nil)
+	assert(t, len(groups.Groups) == 8)
+	assert(t, groups.Groups[3].Name == "staff")
+	assert(t, len(groups.Groups[3].Admins) == 2)
+}
+
+func TestFileSourceConflictPolicy(t *testing.T) {
+	const passwdDropInDir = "../testData/passwd.d"
+	const groupDropInDir = "../testData/group.d"
+
+	src, err := NewFileSource(originalPasswdPath, originalGroupPath, WithPasswdDropInDir(passwdDropInDir),
+		WithGroupDropInDir(groupDropInDir))
+	assert(t, err == nil)
+	users, err := src.LoadUsers()
+	assert(t, err == nil)
+	// the backup file 20-app~ is skipped
+	assert(t, len(users.Users) == 7)
+	for _, u := range users.Users {
+		switch u.Name {
+		case "daemon":
+			assert(t, u.UID == 1 && u.Source == originalPasswdPath)
+		case "app":
+			assert(t, u.UID == 2000 && u.Source == passwdDropInDir+"/10-app")
+		}
+	}
+	groups, err := src.LoadGroups()
+	assert(t, err == nil)
+	assert(t, len(groups.Groups) == 9)
+	assert(t, groups.Groups[3].Name == "staff" && groups.Groups[3].GID == 20)
+
+	src, err = NewFileSource(originalPasswdPath, originalGroupPath, WithPasswdDropInDir(passwdDropInDir),
+		WithExtraGroupFiles(groupDropInDir+"/10-app"), WithConflictPolicy(LastWins))
+	assert(t, err == nil)
+	users, err = src.LoadUsers()
+	assert(t, err == nil)
+	assert(t, len(users.Users) == 7)
+	for _, u := range users.Users {
+		switch u.Name {
+		case "daemon":
+			assert(t, u.UID == 3 && u.Source == passwdDropInDir+"/10-app")
+		case "app":
+			assert(t, u.UID == 2001 && u.Source == passwdDropInDir+"/20-app")
+		}
+	}
+	groups, err = src.LoadGroups()
+	assert(t, err == nil)
+	assert(t, len(groups.Groups) == 9)
+	assert(t, groups.Groups[len(groups.Groups)-1].Name == "staff")
+	assert(t, groups.Groups[len(groups.Groups)-1].GID == 21)
+
+	src, err = NewFileSource(originalPasswdPath, originalGroupPath, WithPasswdDropInDir(passwdDropInDir),
+		WithConflictPolicy(ConflictError))
+	assert(t, err == nil)
+	_, err = src.LoadUsers()
+	assert(t, err != nil)
+	// no conflict among the group files
+	_, err = src.LoadGroups()
+	assert(t, err == nil)
+
+	_, err = NewFileSource(originalPasswdPath, originalGroupPath, WithConflictPolicy("random"))
+	assert(t, err != nil)
+}
+
+func TestFileSourceWatchDropInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd.d")
+	assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	src, err := NewFileSource(originalPasswdPath, originalGroupPath, WithPasswdDropInDir(dir))
+	assert(t, err == nil)
+	dropInMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	assert(t, dropInMgr.Start() == nil)
+	defer dropInMgr.Stop()
+	assert(t, dropInMgr.GetUserByUID(2000) == nil)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "10-app"), []byte("app:*:2000:2000:App:/srv/app:/bin/sh\n"), 0644)
+	assert(t, err == nil)
+	time.Sleep(1 * time.Second)
+	user := dropInMgr.GetUserByUID(2000)
+	assert(t, user != nil)
+	assert(t, user.Source == filepath.Join(dir, "10-app"))
+
+	err = os.Remove(filepath.Join(dir, "10-app"))
+	assert(t, err == nil)
+	time.Sleep(1 * time.Second)
+	assert(t, dropInMgr.GetUserByUID(2000) == nil)
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// gshadow file offset
+const (
+	gshadowNameOffset = 0
+	// skip password offset
+	adminOffset = iota + 1
+	gshadowMemberOffset
+)
+
+const numberOfFieldGShadowEntry = 4
+
+// gshadowEntry is an entry read from the /etc/gshadow file. The file is redacted, see parseLines.
+type gshadowEntry struct {
+	name    string
+	admins  []string
+	members []string
+}
+
+func splitMembers(field string) []string {
+	res := make([]string, 0)
+	field = strings.TrimSpace(field)
+	if len(field) == 0 {
+		return res
+	}
+	for _, m := range strings.Split(field, memberDelim) {
+		if m = strings.TrimSpace(m); len(m) > 0 {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func parseGShadow(line string) (*gshadowEntry, error) {
+	strList := strings.Split(strings.TrimSpace(line), fieldDelim)
+	if len(strList) != numberOfFieldGShadowEntry {
+		// the file is redacted, see parseLines
+		return nil, fmt.Errorf("Malformed gshadow entry with %d fields", len(strList))
+	}
+	return &gshadowEntry{
+		name:    strings.TrimSpace(strList[gshadowNameOffset]),
+		admins:  splitMembers(strList[adminOffset]),
+		members: splitMembers(strList[gshadowMemberOffset]),
+	}, nil
+}
+
+func parseGShadowFile(gshadowFilePath string, lenient bool) (map[string]*gshadowEntry, []*Diagnostic, error) {
+	res := make(map[string]*gshadowEntry)
+	diagnostics, err := parseLines(gshadowFilePath, lenient, true, func(line string) error {
+		entry, err := parseGShadow(line)
+		if err != nil {
+			return err
+		}
+		// like getsgnam(), the first entry of a name wins
+		if _, ok := res[entry.name]; !ok {
+			res[entry.name] = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, diagnostics, nil
+}
+
+// applyGShadow sets the administrators of group, and the members that are only listed in the gshadow entry
+func applyGShadow(group *Group, entry *gshadowEntry) {
+	group.Admins = append(make([]string, 0, len(entry.admins)), entry.admins...)
+
+	memberSet := make(map[string]struct{}, len(group.Members))
+	for _, m := range group.Members {
+		memberSet[m] = struct{}{}
+	}
+	group.ShadowMembers = make([]string, 0)
+	for _, m := range entry.members {
+		if _, ok := memberSet[m]; !ok {
+			group.ShadowMembers = append(group.ShadowMembers, m)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseGShadow(t *testing.T) {
+	entry, err := parseGShadow("staff:!$6$salt$hash:root,_taskgated:root,_uucp")
+	assert(t, err == nil)
+	assert(t, entry.name == "staff")
+	assert(t, len(entry.admins) == 2 && entry.admins[1] == "_taskgated")
+	assert(t, len(entry.members) == 2 && entry.members[1] == "_uucp")
+
+	entry, err = parseGShadow("certusers:*::")
+	assert(t, err == nil)
+	assert(t, len(entry.admins) == 0)
+	assert(t, len(entry.members) == 0)
+
+	// the password hash must never end up in the error
+	_, err = parseGShadow("staff:!$6$salt$hash:root")
+	assert(t, err != nil)
+	assert(t, !strings.Contains(err.Error(), "$6$salt$hash"))
+}
+
+func TestApplyGShadow(t *testing.T) {
+	group, err := parseGroup("staff:*:20:root")
+	assert(t, err == nil)
+	entry, err := parseGShadow("staff:!:root,_taskgated:root,_uucp")
+	assert(t, err == nil)
+
+	applyGShadow(group, entry)
+	assert(t, len(group.Admins) == 2)
+	assert(t, group.Admins[0] == "root" && group.Admins[1] == "_taskgated")
+	assert(t, len(group.ShadowMembers) == 1 && group.ShadowMembers[0] == "_uucp")
+	// the members of the group file are not changed
+	assert(t, len(group.Members) == 1)
+}
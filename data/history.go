@@ -0,0 +1,333 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHistorySize is the number of snapshots kept by default
+	DefaultHistorySize = 16
+
+	historyDirPerm  = 0700
+	historyFilePerm = 0600
+	historyFileExt  = ".json"
+)
+
+// FieldChange is the change of a single field of a user or a group
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// EntryDiff is the change of a user or a group between two snapshots. Fields is only set when modified.
+type EntryDiff struct {
+	Kind   string         `json:"kind"`
+	Action EventAction    `json:"action"`
+	Name   string         `json:"name"`
+	ID     int            `json:"id"`
+	Fields []*FieldChange `json:"fields,omitempty"`
+}
+
+// Diff is the changes of the users and groups from a snapshot to another, in the same order as the events
+type Diff struct {
+	From    *Version     `json:"from"`
+	To      *Version     `json:"to"`
+	Changes []*EntryDiff `json:"changes"`
+}
+
+// persistedSnapshot is the content of a snapshot in a file of the history directory
+type persistedSnapshot struct {
+	Version          Version
+	Users            []*User
+	Shadows          []*Shadow
+	UserDiagnostics  []*Diagnostic
+	Groups           []*Group
+	GroupDiagnostics []*Diagnostic
+}
+
+// history keeps the last snapshots, oldest first. The snapshot being served is always kept, the other ones
+// are dropped when there are more than size of them, or when they are older than maxAge, if not 0. When dir
+// is set, every snapshot is also kept in a file of dir until it is dropped.
+type history struct {
+	lock      sync.RWMutex
+	size      int
+	maxAge    time.Duration
+	dir       string
+	snapshots []*snapshot
+}
+
+func (h *history) path(generation uint64) string {
+	// padded so that the files sort in the order of the generations
+	return filepath.Join(h.dir, fmt.Sprintf("%020d%s", generation, historyFileExt))
+}
+
+// persist writes s atomically into dir
+func (h *history) persist(s *snapshot) error {
+	b, err := json.Marshal(&persistedSnapshot{
+		Version:          s.version,
+		Users:            s.user.userSlice,
+		Shadows:          s.user.shadows,
+		UserDiagnostics:  s.user.diagnostics,
+		Groups:           s.group.groupSlice,
+		GroupDiagnostics: s.group.diagnostics,
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(h.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Chmod(historyFilePerm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), h.path(s.version.Generation))
+}
+
+// load reads the snapshots persisted in dir, if set. It returns the version of the last one, or nil if there
+// is none.
+func (h *history) load() (*Version, error) {
+	if len(h.dir) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(h.dir, historyDirPerm); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), historyFileExt) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(h.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		persisted := new(persistedSnapshot)
+		if err = json.Unmarshal(b, persisted); err != nil {
+			log.Printf("Skip the snapshot %s due to error: %s\n", f.Name(), err)
+			continue
+		}
+		h.snapshots = append(h.snapshots, &snapshot{
+			version: persisted.Version,
+			user:    newUserData(persisted.Users, persisted.Shadows, persisted.UserDiagnostics),
+			group:   newGroupData(persisted.Groups, persisted.GroupDiagnostics),
+		})
+	}
+	if len(h.snapshots) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(h.snapshots, func(i, j int) bool {
+		return h.snapshots[i].version.Generation < h.snapshots[j].version.Generation
+	})
+	h.trim(time.Now())
+	res := h.snapshots[len(h.snapshots)-1].version
+	return &res, nil
+}
+
+func (h *history) add(s *snapshot) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.snapshots = append(h.snapshots, s)
+	if len(h.dir) > 0 {
+		if err := h.persist(s); err != nil {
+			log.Printf("Fail to persist the snapshot of generation %d due to error: %s\n", s.version.Generation,
+				err)
+		}
+	}
+	h.trim(s.version.Modified)
+}
+
+// trim must be called with lock held
+func (h *history) trim(now time.Time) {
+	drop := 0
+	if h.size > 0 && len(h.snapshots) > h.size {
+		drop = len(h.snapshots) - h.size
+	}
+	if h.maxAge > 0 {
+		for drop < len(h.snapshots)-1 && now.Sub(h.snapshots[drop].version.Modified) > h.maxAge {
+			drop++
+		}
+	}
+	if drop >= len(h.snapshots) {
+		drop = len(h.snapshots) - 1
+	}
+	if drop <= 0 {
+		return
+	}
+	if len(h.dir) > 0 {
+		for _, s := range h.snapshots[:drop] {
+			if err := os.Remove(h.path(s.version.Generation)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Fail to remove the snapshot of generation %d due to error: %s\n",
+					s.version.Generation, err)
+			}
+		}
+	}
+	h.snapshots = append([]*snapshot{}, h.snapshots[drop:]...)
+}
+
+// list returns the versions of the snapshots, oldest first
+func (h *history) list() []*Version {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.trim(time.Now())
+
+	res := make([]*Version, 0, len(h.snapshots))
+	for _, s := range h.snapshots {
+		version := s.version
+		res = append(res, &version)
+	}
+	return res
+}
+
+// get returns the snapshot of generation, or nil if it is not kept
+func (h *history) get(generation uint64) *snapshot {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, s := range h.snapshots {
+		if s.version.Generation == generation {
+			return s
+		}
+	}
+	return nil
+}
+
+// replaced returns the time the snapshot of generation was replaced by the next one, or the zero time if it is
+// the last one
+func (h *history) replaced(generation uint64) time.Time {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for i, s := range h.snapshots {
+		if s.version.Generation == generation && i+1 < len(h.snapshots) {
+			return h.snapshots[i+1].version.Modified
+		}
+	}
+	return time.Time{}
+}
+
+// getAt returns the snapshot served at time t, or nil if it is not kept
+func (h *history) getAt(t time.Time) *snapshot {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for i := len(h.snapshots) - 1; i >= 0; i-- {
+		if !h.snapshots[i].version.Modified.After(t) {
+			return h.snapshots[i]
+		}
+	}
+	return nil
+}
+
+func (m *manager) At(generation uint64) Reader {
+	// never return a nil *snapshot as a non nil Reader
+	s := m.history.get(generation)
+	if s == nil {
+		return nil
+	}
+	if replaced := m.history.replaced(generation); !replaced.IsZero() {
+		return s.atTime(replaced)
+	}
+	return s
+}
+
+func (m *manager) AtTime(t time.Time) Reader {
+	if s := m.history.getAt(t); s != nil {
+		return s.atTime(t)
+	}
+	return nil
+}
+
+func (m *manager) History() []*Version {
+	return m.history.list()
+}
+
+func (m *manager) Diff(from, to uint64) *Diff {
+	fromSnapshot := m.history.get(from)
+	toSnapshot := m.history.get(to)
+	if fromSnapshot == nil || toSnapshot == nil {
+		return nil
+	}
+
+	res := &Diff{Changes: make([]*EntryDiff, 0)}
+	fromVersion, toVersion := fromSnapshot.version, toSnapshot.version
+	res.From, res.To = &fromVersion, &toVersion
+
+	for _, e := range diffUsers(fromSnapshot.user, toSnapshot.user, toVersion.Modified) {
+		entry := &EntryDiff{Kind: e.Kind, Action: e.Action, Name: e.User.Name, ID: e.User.UID}
+		if e.Action == EventModified {
+			entry.Fields = userFieldChanges(fromSnapshot.user.userMapByName[e.User.Name][0], e.User)
+		}
+		res.Changes = append(res.Changes, entry)
+	}
+	for _, e := range diffGroups(fromSnapshot.group, toSnapshot.group, toVersion.Modified) {
+		entry := &EntryDiff{Kind: e.Kind, Action: e.Action, Name: e.Group.Name, ID: e.Group.GID}
+		if e.Action == EventModified {
+			entry.Fields = groupFieldChanges(fromSnapshot.group.groupMapByName[e.Group.Name][0], e.Group)
+		}
+		res.Changes = append(res.Changes, entry)
+	}
+	return res
+}
+
+// sameValue compares the values of two fields, a nil list is the same as an empty one, as they are both
+// empty in the files
+func sameValue(a, b interface{}) bool {
+	if listA, ok := a.([]string); ok {
+		if listB, ok := b.([]string); ok && len(listA) == 0 && len(listB) == 0 {
+			return true
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// fieldChanges returns the changes of the fields, named as in JSON, whose values differ
+func fieldChanges(fields []string, from, to []interface{}) []*FieldChange {
+	var res []*FieldChange
+	for i, field := range fields {
+		if !sameValue(from[i], to[i]) {
+			res = append(res, &FieldChange{Field: field, From: from[i], To: to[i]})
+		}
+	}
+	return res
+}
+
+var userFields = []string{"name", "uid", "gid", "comment", "home", "shell", "source"}
+
+func userFieldChanges(from, to *User) []*FieldChange {
+	values := func(u *User) []interface{} {
+		return []interface{}{u.Name, u.UID, u.GID, u.Comment, u.Home, u.Shell, u.Source}
+	}
+	return fieldChanges(userFields, values(from), values(to))
+}
+
+var groupFields = []string{"name", "gid", "members", "admins", "shadowMembers", "source"}
+
+func groupFieldChanges(from, to *Group) []*FieldChange {
+	values := func(g *Group) []interface{} {
+		return []interface{}{g.Name, g.GID, g.Members, g.Admins, g.ShadowMembers, g.Source}
+	}
+	return fieldChanges(groupFields, values(from), values(to))
+}
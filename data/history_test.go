@@ -0,0 +1,205 @@
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	src := &staticSource{
+		users: []*User{
+			&User{Name: "root", UID: 0, GID: 0, Shell: "/bin/sh"},
+			&User{Name: "daemon", UID: 1, GID: 1},
+		},
+		groups: []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root"}}},
+	}
+	_, err := NewManager([]Source{src}, WithHistory(0, 0))
+	assert(t, err != nil)
+	_, err = NewManager([]Source{src}, WithHistory(1, -time.Second))
+	assert(t, err != nil)
+
+	historyMgr, err := NewManager([]Source{src}, WithHistory(3, 0))
+	assert(t, err == nil)
+	versions := historyMgr.History()
+	assert(t, len(versions) == 1 && versions[0].Generation == 1)
+
+	src.users = []*User{
+		&User{Name: "root", UID: 0, GID: 0, Shell: "/bin/bash", Home: "/root"},
+		&User{Name: "dwoodlins", UID: 1001, GID: 1001},
+	}
+	src.groups = []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root", "dwoodlins"}}}
+	historyMgr.(*manager).handleChange(UserChange | GroupChange)
+	// no change, no new snapshot
+	historyMgr.(*manager).handleChange(UserChange | GroupChange)
+	assert(t, len(historyMgr.History()) == 2)
+
+	diff := historyMgr.Diff(1, 2)
+	assert(t, diff.From.Generation == 1 && diff.To.Generation == 2)
+	assert(t, len(diff.Changes) == 4)
+	removed, modified, added, group := diff.Changes[0], diff.Changes[1], diff.Changes[2], diff.Changes[3]
+	assert(t, removed.Action == EventRemoved && removed.Name == "daemon" && removed.ID == 1 && removed.Fields == nil)
+	assert(t, added.Action == EventAdded && added.Name == "dwoodlins" && added.ID == 1001)
+	assert(t, modified.Action == EventModified && modified.Kind == EventKindUser && len(modified.Fields) == 2)
+	assert(t, modified.Fields[0].Field == "home" && modified.Fields[0].From == "" && modified.Fields[0].To == "/root")
+	assert(t, modified.Fields[1].Field == "shell" && modified.Fields[1].From == "/bin/sh")
+	assert(t, group.Kind == EventKindGroup && group.Name == "wheel" && len(group.Fields) == 1)
+	assert(t, group.Fields[0].Field == "members" && len(group.Fields[0].To.([]string)) == 2)
+
+	// the reverse diff
+	diff = historyMgr.Diff(2, 1)
+	assert(t, len(diff.Changes) == 4 && diff.Changes[0].Name == "dwoodlins")
+	assert(t, diff.Changes[0].Action == EventRemoved)
+	assert(t, len(historyMgr.Diff(2, 2).Changes) == 0)
+	assert(t, historyMgr.Diff(1, 3) == nil)
+
+	// the oldest snapshots are dropped
+	for i := 0; i < 3; i++ {
+		src.users = append(src.users, &User{Name: "app", UID: 2000 + i, GID: 2000})
+		historyMgr.(*manager).handleChange(UserChange)
+	}
+	versions = historyMgr.History()
+	assert(t, len(versions) == 3)
+	assert(t, versions[0].Generation == 3 && versions[2].Generation == 5)
+	assert(t, historyMgr.Version().Generation == 5)
+	assert(t, historyMgr.Diff(1, 5) == nil)
+}
+
+func TestHistoryMaxAge(t *testing.T) {
+	now := time.Now()
+	h := &history{size: 10, maxAge: time.Hour}
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 30 * time.Minute, 0} {
+		h.add(&snapshot{version: Version{Generation: uint64(i + 1), Modified: now.Add(-age)}})
+	}
+	// the snapshots of 2 and 3 hours ago are dropped
+	versions := h.list()
+	assert(t, len(versions) == 2 && versions[0].Generation == 3)
+
+	// the current snapshot is always kept
+	h = &history{size: 10, maxAge: time.Minute}
+	h.add(&snapshot{version: Version{Generation: 1, Modified: now.Add(-time.Hour)}})
+	assert(t, len(h.list()) == 1)
+	assert(t, h.get(1) != nil && h.get(2) == nil)
+}
+
+func TestTimeTravel(t *testing.T) {
+	src := &staticSource{
+		users:  []*User{&User{Name: "root", UID: 0, GID: 0}},
+		groups: []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root"}}},
+	}
+	travelMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	first := travelMgr.Version()
+
+	src.users = append(src.users, &User{Name: "dwoodlins", UID: 1001, GID: 1001})
+	src.groups = []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root", "dwoodlins"}}}
+	travelMgr.(*manager).handleChange(UserChange | GroupChange)
+	second := travelMgr.Version()
+	assert(t, second.Generation == 2)
+
+	reader := travelMgr.At(1)
+	assert(t, reader != nil)
+	assert(t, *reader.Version() == *first)
+	assert(t, len(reader.GetAllUsers()) == 1)
+	assert(t, reader.GetUserByUID(1001) == nil)
+	assert(t, len(reader.GetUsersByGID(0).Users) == 1)
+	assert(t, len(reader.GetGroupByQuery("", "", []string{"dwoodlins"}, nil)) == 0)
+	assert(t, len(travelMgr.At(2).GetAllUsers()) == 2)
+	assert(t, travelMgr.At(3) == nil)
+
+	assert(t, travelMgr.AtTime(first.Modified.Add(-time.Nanosecond)) == nil)
+	assert(t, travelMgr.AtTime(first.Modified).Version().Generation == 1)
+	assert(t, travelMgr.AtTime(second.Modified).Version().Generation == 2)
+	assert(t, travelMgr.AtTime(second.Modified.Add(time.Hour)).Version().Generation == 2)
+}
+
+// shadowSource is a staticSource with shadow entries
+type shadowSource struct {
+	staticSource
+	shadows []*Shadow
+}
+
+func (s *shadowSource) LoadUsers() (*UserSnapshot, error) {
+	return &UserSnapshot{Users: s.users, Shadows: s.shadows}, nil
+}
+
+func TestTimeTravelAccount(t *testing.T) {
+	now := time.Now()
+	today := int(now.Unix() / secondsPerDay)
+	src := &shadowSource{
+		staticSource: staticSource{users: []*User{&User{Name: "root", UID: 0, GID: 0}}},
+		// the account expires tomorrow
+		shadows: []*Shadow{&Shadow{Name: "root", LastChange: ShadowFieldDisabled, MaxDays: ShadowFieldDisabled,
+			Expire: today + 1}},
+	}
+	travelMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	assert(t, !travelMgr.GetAccountByUID(0).AccountExpired)
+	assert(t, !travelMgr.At(1).GetAccountByUID(0).AccountExpired)
+
+	// the accounts are evaluated at the requested time
+	account := travelMgr.AtTime(now.Add(48 * time.Hour)).GetAccountByUID(0)
+	assert(t, account.AccountExpired && *account.DaysUntilExpiry == -1)
+
+	// and at the time a snapshot was replaced, as if the next one was served two days later
+	src.users = append(src.users, &User{Name: "dwoodlins", UID: 1001, GID: 1001})
+	travelMgr.(*manager).handleChange(UserChange)
+	travelMgr.(*manager).history.snapshots[1].version.Modified = now.Add(48 * time.Hour)
+	assert(t, travelMgr.At(1).GetAccountByUID(0).AccountExpired)
+	assert(t, !travelMgr.At(2).GetAccountByUID(0).AccountExpired)
+	assert(t, !travelMgr.GetAccountByUID(0).AccountExpired)
+}
+
+func TestHistoryDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	src := &staticSource{
+		users:  []*User{&User{Name: "root", UID: 0, GID: 0}},
+		groups: []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root"}, Admins: []string{}}},
+	}
+	persistedMgr, err := NewManager([]Source{src}, WithHistory(2, 0), WithHistoryDir(dir))
+	assert(t, err == nil)
+	for i := 0; i < 2; i++ {
+		src.users = append(src.users, &User{Name: fmt.Sprintf("app%d", i), UID: 1000 + i, GID: 1000})
+		persistedMgr.(*manager).handleChange(UserChange)
+	}
+	assert(t, persistedMgr.Version().Generation == 3)
+	// the snapshot of the first generation is dropped along with its file
+	files, err := ioutil.ReadDir(dir)
+	assert(t, err == nil && len(files) == 2)
+
+	// a restart with the same content carries on from the last generation
+	restartedMgr, err := NewManager([]Source{src}, WithHistory(2, 0), WithHistoryDir(dir))
+	assert(t, err == nil)
+	version, persistedVersion := restartedMgr.Version(), persistedMgr.Version()
+	assert(t, version.Generation == 3 && version.Hash == persistedVersion.Hash)
+	assert(t, version.Modified.Equal(persistedVersion.Modified))
+	versions := restartedMgr.History()
+	assert(t, len(versions) == 2 && versions[0].Generation == 2)
+	reader := restartedMgr.At(2)
+	assert(t, len(reader.GetAllUsers()) == 2)
+	assert(t, reader.GetGroupByGID(0).Members[0] == "root")
+	assert(t, len(reader.GetGroupByQuery("", "0", []string{"root"}, nil)) == 1)
+	assert(t, len(restartedMgr.Diff(2, 3).Changes) == 1)
+	// the empty admins are persisted as none, which is the same
+	assert(t, reader.GetGroupByGID(0).Admins == nil)
+	assert(t, sameGroup(reader.GetGroupByGID(0), src.groups[0]))
+
+	// a restart with another content is a new generation
+	src.users = src.users[:1]
+	restartedMgr, err = NewManager([]Source{src}, WithHistory(2, 0), WithHistoryDir(dir))
+	assert(t, err == nil)
+	assert(t, restartedMgr.Version().Generation == 4)
+	assert(t, restartedMgr.At(3) != nil && restartedMgr.At(2) == nil)
+
+	// a corrupted file is skipped
+	assert(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000009.json"), []byte("{"), 0600) == nil)
+	restartedMgr, err = NewManager([]Source{src}, WithHistory(2, 0), WithHistoryDir(dir))
+	assert(t, err == nil)
+	assert(t, restartedMgr.Version().Generation == 4)
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode of the file described by info, 0 if unknown
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,8 @@
+package data
+
+import "os"
+
+// fileInode returns 0 as there is no inode on Windows, PollWatch relies on the modification time and size
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
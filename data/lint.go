@@ -0,0 +1,185 @@
+package data
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Severity tells how serious a LintIssue is
+type Severity string
+
+const (
+	// SeverityError is an inconsistency that makes lookups ambiguous or wrong
+	SeverityError Severity = "error"
+	// SeverityWarning is an entry that is most likely a mistake
+	SeverityWarning Severity = "warning"
+	// SeverityInfo is an entry worth a look
+	SeverityInfo Severity = "info"
+)
+
+// the codes of the issues
+const (
+	lintDuplicateUID       = "duplicate-uid"
+	lintDuplicateUserName  = "duplicate-user-name"
+	lintDuplicateGID       = "duplicate-gid"
+	lintDuplicateGroupName = "duplicate-group-name"
+	lintMissingPrimary     = "missing-primary-group"
+	lintUnknownMember      = "unknown-member"
+	lintEmptyShell         = "empty-shell"
+	lintOddShell           = "odd-shell"
+	lintEmptyHome          = "empty-home"
+	lintRelativeHome       = "relative-home"
+
+	lintKindUser  = "user"
+	lintKindGroup = "group"
+)
+
+// the higher the rank, the more serious
+var severityRankMap = map[Severity]int{
+	SeverityInfo:    0,
+	SeverityWarning: 1,
+	SeverityError:   2,
+}
+
+// ParseSeverity converts the name of a severity to Severity
+func ParseSeverity(name string) (Severity, error) {
+	severity := Severity(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := severityRankMap[severity]; !ok {
+		return "", fmt.Errorf("Unknown severity %s", name)
+	}
+	return severity, nil
+}
+
+// LintIssue is an integrity problem found in the users and groups
+type LintIssue struct {
+	Severity Severity `json:"severity"`
+	// Code identifies the kind of problem, e.g. duplicate-uid
+	Code string `json:"code"`
+	// Kind is either user or group, Name, ID and Source identify the entry with the problem
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	ID      int    `json:"id"`
+	Source  string `json:"source,omitempty"`
+	Message string `json:"message"`
+}
+
+// LintReport is the result of checking the integrity of the users and groups
+type LintReport struct {
+	Errors   int          `json:"errors"`
+	Warnings int          `json:"warnings"`
+	Infos    int          `json:"infos"`
+	Issues   []*LintIssue `json:"issues"`
+}
+
+func (r *LintReport) add(issue *LintIssue) {
+	switch issue.Severity {
+	case SeverityError:
+		r.Errors++
+	case SeverityWarning:
+		r.Warnings++
+	default:
+		r.Infos++
+	}
+	r.Issues = append(r.Issues, issue)
+}
+
+// Filter returns a report of the issues at least as serious as min
+func (r *LintReport) Filter(min Severity) *LintReport {
+	res := &LintReport{Issues: make([]*LintIssue, 0)}
+	for _, issue := range r.Issues {
+		if severityRankMap[issue.Severity] >= severityRankMap[min] {
+			res.add(issue)
+		}
+	}
+	return res
+}
+
+func newUserIssue(severity Severity, code string, user *User, format string, args ...interface{}) *LintIssue {
+	return &LintIssue{
+		Severity: severity,
+		Code:     code,
+		Kind:     lintKindUser,
+		Name:     user.Name,
+		ID:       user.UID,
+		Source:   user.Source,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+func newGroupIssue(severity Severity, code string, group *Group, format string, args ...interface{}) *LintIssue {
+	return &LintIssue{
+		Severity: severity,
+		Code:     code,
+		Kind:     lintKindGroup,
+		Name:     group.Name,
+		ID:       group.GID,
+		Source:   group.Source,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// lint checks the integrity of users and groups. The issues follow the order of the entries, users first.
+func lint(users *userData, groups *groupData) *LintReport {
+	res := &LintReport{Issues: make([]*LintIssue, 0)}
+
+	// the first entry of an ID or a name, to report every later duplicate against it
+	firstUserByID := make(map[int]*User)
+	firstUserByName := make(map[string]*User)
+	for _, u := range users.userSlice {
+		if first, ok := firstUserByID[u.UID]; ok {
+			res.add(newUserIssue(SeverityError, lintDuplicateUID, u, "UID %d is also used by user %s", u.UID,
+				first.Name))
+		} else {
+			firstUserByID[u.UID] = u
+		}
+		if first, ok := firstUserByName[u.Name]; ok {
+			res.add(newUserIssue(SeverityError, lintDuplicateUserName, u, "user name %s is also used by UID %d",
+				u.Name, first.UID))
+		} else {
+			firstUserByName[u.Name] = u
+		}
+
+		if _, ok := groups.groupMapByID[u.GID]; !ok {
+			res.add(newUserIssue(SeverityWarning, lintMissingPrimary, u, "primary GID %d has no group", u.GID))
+		}
+
+		switch {
+		case len(u.Shell) == 0:
+			res.add(newUserIssue(SeverityInfo, lintEmptyShell, u, "shell is empty, /bin/sh is used"))
+		case !path.IsAbs(u.Shell) || strings.ContainsAny(u.Shell, " \t"):
+			res.add(newUserIssue(SeverityWarning, lintOddShell, u, "shell %s is not an absolute path", u.Shell))
+		}
+
+		switch {
+		case len(u.Home) == 0:
+			res.add(newUserIssue(SeverityWarning, lintEmptyHome, u, "home is empty"))
+		case !path.IsAbs(u.Home):
+			res.add(newUserIssue(SeverityWarning, lintRelativeHome, u, "home %s is a relative path", u.Home))
+		}
+	}
+
+	firstGroupByID := make(map[int]*Group)
+	firstGroupByName := make(map[string]*Group)
+	for _, g := range groups.groupSlice {
+		if first, ok := firstGroupByID[g.GID]; ok {
+			res.add(newGroupIssue(SeverityWarning, lintDuplicateGID, g, "GID %d is also used by group %s", g.GID,
+				first.Name))
+		} else {
+			firstGroupByID[g.GID] = g
+		}
+		if first, ok := firstGroupByName[g.Name]; ok {
+			res.add(newGroupIssue(SeverityError, lintDuplicateGroupName, g, "group name %s is also used by GID %d",
+				g.Name, first.GID))
+		} else {
+			firstGroupByName[g.Name] = g
+		}
+
+		for _, m := range g.Members {
+			if _, ok := users.userMapByName[m]; !ok {
+				res.add(newGroupIssue(SeverityWarning, lintUnknownMember, g, "member %s has no passwd entry", m))
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,54 @@
+package data
+
+import (
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	src := &staticSource{
+		users: []*User{
+			&User{Name: "root", UID: 0, GID: 0, Home: "/root", Shell: "/bin/sh"},
+			&User{Name: "toor", UID: 0, GID: 0, Home: "/root", Shell: "/bin/sh"},
+			&User{Name: "root", UID: 1, GID: 0, Home: "root", Shell: "sh"},
+			&User{Name: "app", UID: 1000, GID: 1000, Home: "", Shell: ""},
+		},
+		groups: []*Group{
+			&Group{Name: "wheel", GID: 0, Members: []string{"root", "ghost"}},
+			&Group{Name: "admin", GID: 0},
+			&Group{Name: "wheel", GID: 10},
+		},
+	}
+	lintMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	report := lintMgr.Lint()
+	var codes []string
+	for _, issue := range report.Issues {
+		codes = append(codes, issue.Code)
+	}
+	expected := []string{
+		lintDuplicateUID, lintDuplicateUserName, lintOddShell, lintRelativeHome, lintMissingPrimary,
+		lintEmptyShell, lintEmptyHome, lintUnknownMember, lintDuplicateGID, lintDuplicateGroupName,
+	}
+	assert(t, len(codes) == len(expected))
+	for i := range expected {
+		assert(t, codes[i] == expected[i])
+	}
+	assert(t, report.Errors == 3)
+	assert(t, report.Warnings == 6)
+	assert(t, report.Infos == 1)
+
+	issue := report.Issues[0]
+	assert(t, issue.Kind == lintKindUser && issue.Name == "toor" && issue.ID == 0)
+	issue = report.Issues[7]
+	assert(t, issue.Kind == lintKindGroup && issue.Name == "wheel" && issue.Message == "member ghost has no passwd entry")
+
+	errorsOnly := report.Filter(SeverityError)
+	assert(t, errorsOnly.Errors == 3 && errorsOnly.Warnings == 0 && len(errorsOnly.Issues) == 3)
+	assert(t, len(report.Filter(SeverityInfo).Issues) == 10)
+
+	severity, err := ParseSeverity("Warning")
+	assert(t, err == nil && severity == SeverityWarning)
+	_, err = ParseSeverity("fatal")
+	assert(t, err != nil)
+}
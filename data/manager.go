@@ -1,546 +1,535 @@
 package data
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/howeyc/fsnotify"
-)
-
-// passwd file offset
-const (
-	userNameOffset = 0
-	// skip password offset
-	uidOffset = iota + 1
-	userGidOffset
-	commentOffset
-	homeOffset
-	shellOffset
-)
-
-// group file offset
-const (
-	groupNameOffset = 0
-	// skip password offset
-	groupGidOffset = iota + 1
-	memberOffset
-)
-
-const (
-	fieldDelim  = ":"
-	memberDelim = ","
-
-	numberOfFieldGroupEntry  = 4
-	numberOfFieldPasswdField = 7
-	// There is no async API to check for file creation. A loop with sleep time of 1 second
-	// will be used to watch for file creation once the monitored has been deleted or renamed
-	monitorFileCreationIntervalInSec = 1 * time.Second
 )
 
 // User is the data structure for each entry read from the /etc/passwd file
 type User struct {
 	Name    string `json:"name"`
-	UID     string `json:"uid"`
-	GID     string `json:"gid"`
+	UID     int    `json:"uid"`
+	GID     int    `json:"gid"`
 	Comment string `json:"comment"`
 	Home    string `json:"home"`
 	Shell   string `json:"shell"`
+	// Source is the file the entry is read from
+	Source string `json:"source,omitempty"`
 }
 
 // Group is the data structure for each entry read from the /etc/group file
 type Group struct {
 	Name    string   `json:"name"`
-	GID     string   `json:"gid"`
+	GID     int      `json:"gid"`
 	Members []string `json:"members"`
+	// Admins are the administrators of the group in the gshadow file, omitted when there is none, e.g. when
+	// no gshadow file is read
+	Admins []string `json:"admins,omitempty"`
+	// ShadowMembers are the members listed in the gshadow file but not in the group file
+	ShadowMembers []string `json:"shadowMembers,omitempty"`
+	// Source is the file the entry is read from
+	Source string `json:"source,omitempty"`
 
 	memberSet map[string]struct{}
+	adminSet  map[string]struct{}
 }
 
-// Manager is used to retrieve the User or Group data structure
-// In order for Manager to monitor the changes of the underlying files Start() must be call.
-// And Stop() should be called for a graceful shutdown
-type Manager interface {
-	// Start enable the Manager to monitor the passwd and group files for any change
-	Start() error
-	// Stop will stop  Manager from monitoring the passwd and group files and free up resources
-	Stop()
+// Membership describes how a user belongs to a group
+type Membership string
+
+const (
+	// PrimaryMembership means the group is the user's primary group, i.e. User.GID
+	PrimaryMembership Membership = "primary"
+	// SupplementaryMembership means the user is listed in the member field of the group
+	SupplementaryMembership Membership = "supplementary"
+)
+
+// UserGroup is a group that a user belongs to, along with how the user belongs to it
+type UserGroup struct {
+	*Group
+	Membership Membership `json:"membership"`
+}
 
+// GroupMember is a user that belongs to a group, along with how the user belongs to it
+type GroupMember struct {
+	*User
+	Membership Membership `json:"membership"`
+}
+
+// GroupUsers is the result of resolving the users belonging to a group
+type GroupUsers struct {
+	Users []*GroupMember `json:"users"`
+	// Unresolved lists the names in the member field of the group that have no entry in the passwd file
+	Unresolved []string `json:"unresolved"`
+}
+
+// Reader retrieves the User or Group data structure of the Manager, either the current ones or the ones of
+// a snapshot kept in the history
+type Reader interface {
 	// GetAllUsers returns all the users in the passwd file
 	GetAllUsers() []*User
-	// GetUserByQuery returns all the users that matching all of the specified query fields.
-	// Only exact matches is supported. 204 SuccessNoContent will be returned if no data is found.
+	// GetUserByQuery returns all the users that matching all of the specified query fields, i.e. FindUsers with
+	// exact matches only. uid and gid are compared numerically and never match if they are not integers.
+	// 204 SuccessNoContent will be returned if no data is found.
 	GetUserByQuery(name, uid, gid, comment, home, shell string) []*User
+	// FindUsers returns the users matching all the conditions, see ParseUserCondition, in the order of the
+	// passwd file. An exact match on uid or name is looked up instead of scanning all the users.
+	FindUsers(conds []*Condition) []*User
+	// SearchUsers returns the users making expr true, in the order of the passwd file, along with how they are
+	// found
+	SearchUsers(expr *UserExpression) ([]*User, *SearchPlan)
 	// GetUserByUID returns the user with UID, assuming there will be no duplicated UID
 	// 404 will be returned if no group is found
-	GetUserByUID(uid string) *User
+	GetUserByUID(uid int) *User
+	// GetUsersByName returns the users named name, like getpwnam(3) but with all of them, in the order of the
+	// passwd file. More than one user is returned when the name is duplicated in a passwd file.
+	GetUsersByName(name string) []*User
+	// GetAccountByUID returns the account status of the user with UID derived from the shadow file.
+	// nil will be returned if no shadow file is configured or the user has no shadow entry.
+	GetAccountByUID(uid int) *Account
 	// GetAllGroups returns all the groups in the group file.
 	// 204 SuccessNoContent will be returned if no data is found.
 	GetAllGroups() []*Group
-	// GetGroupsByUID all the groups for a given user with UID.
+	// GetGroupsByUID returns all the groups for a given user with UID, the same way as `id -G` does.
+	// The primary group comes first, followed by the supplementary groups in the order of the group file.
 	// 204 SuccessNoContent will be returned if no data is found.
-	GetGroupsByUID(uid string) []*Group
-	// GetGroupByQuery returns all the groups matching all of the specified query fields.
-	// Any group containing all the specified members wil be returned, i.e. when query members are a subset of
-	// group members.  204 SuccessNoContent will be returned if no data is found.
-	GetGroupByQuery(name, gid string, members []string) []*Group
+	GetGroupsByUID(uid int) []*UserGroup
+	// GetUsersByGID returns all the users belonging to the group with GID, i.e. the users whose primary GID is
+	// GID followed by the users listed in the member field of the group, in the order of the passwd file.
+	// 404 will be returned if there is neither a group nor a user with the GID.
+	GetUsersByGID(gid int) *GroupUsers
+	// GetGroupByQuery returns all the groups matching all of the specified query fields, i.e. FindGroups with
+	// exact matches only. Any group containing all the specified members wil be returned, i.e. when query
+	// members are a subset of group members, and likewise for the specified admins and the group
+	// administrators. The gid is compared numerically and never matches if it is not an integer.
+	// 204 SuccessNoContent will be returned if no data is found.
+	GetGroupByQuery(name, gid string, members, admins []string) []*Group
+	// FindGroups returns the groups matching all the conditions, see ParseGroupCondition, in the order of the
+	// group file. An exact match on gid or name is looked up instead of scanning all the groups.
+	FindGroups(conds []*Condition) []*Group
+	// SearchGroups returns the groups making expr true, in the order of the group file, along with how they
+	// are found
+	SearchGroups(expr *GroupExpression) ([]*Group, *SearchPlan)
 	// GetGroupByGID returns the group with GID. Assuming GID is unique
 	// 404 will be returned if no group is found
-	GetGroupByGID(gid string) *Group
+	GetGroupByGID(gid int) *Group
+	// GetGroupsByName returns the groups named name, like getgrnam(3) but with all of them, in the order of the
+	// group file. More than one group is returned when the name is duplicated in a group file.
+	GetGroupsByName(name string) []*Group
+	// GetParseDiagnostics returns the malformed lines skipped by the lenient parsing of the current users
+	// and groups. 204 SuccessNoContent will be returned if no data is found.
+	GetParseDiagnostics() []*Diagnostic
+	// Lint checks the integrity of the current users and groups, e.g. duplicated UIDs or members without a
+	// passwd entry
+	Lint() *LintReport
+	// Version returns the generation and the content hash of the current users and groups
+	Version() *Version
+}
+
+// Manager is used to retrieve the User or Group data structure
+// In order for Manager to monitor the changes of the underlying sources Start() must be call.
+// And Stop() should be called for a graceful shutdown
+type Manager interface {
+	// Start enable the Manager to monitor the sources, e.g. the passwd and group files, for any change
+	Start() error
+	// Stop will stop  Manager from monitoring the sources and free up resources
+	Stop()
+	// Reload applies the configuration changes, see WithConfigReload, and reads all the sources again. The
+	// reads are served from the previous snapshot until the new one is complete, and from it if a source
+	// fails, like for the reloads notified by the sources. An error is only returned if the configuration
+	// cannot be applied or ctx is done before the sources are read.
+	Reload(ctx context.Context) (*ReloadResult, error)
+
+	// Reader reads the current users and groups. Every call reads the snapshot being served at that time, use
+	// Snapshot to make several reads of the same one.
+	Reader
+	// Snapshot returns the users and groups being served. They are immutable, so that the reads of a snapshot
+	// are consistent with each other, even if a reload happens in between.
+	Snapshot() Reader
+	// Status returns whether the Manager is degraded, i.e. serving the users or groups of before a failed reload
+	Status() *Status
+	// Subscribe returns the events of the users and groups changing from now on, along with the retained
+	// events after lastEventID, if it is not 0. The Subscription must be closed.
+	Subscribe(lastEventID uint64) *Subscription
+	// History returns the versions of the snapshots kept, oldest first. The current one is always kept.
+	History() []*Version
+	// Diff returns the changes of the users and groups from the snapshot of generation from to the one of
+	// generation to. nil will be returned if either is not kept.
+	Diff(from, to uint64) *Diff
+	// At returns the users and groups of the snapshot of generation, nil if it is not kept. The accounts of a
+	// replaced snapshot are evaluated at the time it was replaced.
+	At(generation uint64) Reader
+	// AtTime returns the users and groups served at time t, nil if the snapshot is not kept. The accounts are
+	// evaluated at time t.
+	AtTime(t time.Time) Reader
 }
 
 // Index User by UID and user name. This struct is immutable after construction
 type userData struct {
-	userMapByID   map[string]*User
+	userMapByID map[int]*User
+	// all the users of a UID, as several names might share it, e.g. root and toor
+	usersByID     map[int][]*User
 	userMapByName map[string][]*User
 	userSlice     []*User
+	// empty if no source has password aging information
+	shadowMapByName map[string]*Shadow
+	// the shadow entries in order, to persist them
+	shadows     []*Shadow
+	diagnostics []*Diagnostic
+	// digest of the users, shadows and diagnostics
+	hash string
 }
 
 // index Group by GID and group name. // This struct is immutable after construction
 type groupData struct {
-	groupMapByID   map[string]*Group
+	groupMapByID map[int]*Group
+	// all the groups of a GID
+	groupsByID     map[int][]*Group
 	groupMapByName map[string][]*Group
 	groupSlice     []*Group
+	diagnostics    []*Diagnostic
+	// digest of the groups and diagnostics
+	hash string
 }
 
 type manager struct {
-	passwdFilePath string
-	groupFilePath  string
-
-	exit chan struct{}
-
-	// using a reader/writer lock that favorite writer, assuming write operation is rare compare to read
-	userLock  sync.RWMutex
-	user      *userData
-	groupLock sync.RWMutex
-	group     *groupData
+	// sources and started are guarded by sourceLock, as Reload might replace the sources
+	sourceLock sync.Mutex
+	sources    []Source
+	started    bool
+
+	// serialize the reloads, so that an older snapshot never overrides a newer one
+	reloadLock sync.Mutex
+	// serialize the calls to Reload, a buffered channel so that waiting for it can be canceled
+	manualReload chan struct{}
+	configReload ConfigReload
+
+	// the *snapshot being served, swapped at once by the reloads, so that the reads never wait for a reload
+	// and always see the users and groups of the same generation
+	served atomic.Value
+
+	userReload  reloadTracker
+	groupReload reloadTracker
+	version     versionTracker
+	events      eventLog
+	history     history
 }
 
-type handleFileUpdateFunc func(mgr *manager)
+// ManagerOption customizes the Manager returned by NewManager
+type ManagerOption func(m *manager)
 
-func (m *manager) GetAllUsers() []*User {
-	m.userLock.RLock()
-	defer m.userLock.RUnlock()
-
-	return m.user.userSlice
+// WithHistory keeps the last size snapshots, and only the ones younger than maxAge if it is not 0. The
+// snapshot being served is always kept. DefaultHistorySize snapshots are kept by default.
+func WithHistory(size int, maxAge time.Duration) ManagerOption {
+	return func(m *manager) {
+		m.history.size = size
+		m.history.maxAge = maxAge
+	}
 }
 
-func compareUser(gid, comment, home, shell string, user *User) bool {
-	if len(gid) > 0 && user.GID != gid {
-		return false
+// WithHistoryDir persists the snapshots of the history in dir, so that they are kept across restarts
+func WithHistoryDir(dir string) ManagerOption {
+	return func(m *manager) {
+		m.history.dir = dir
 	}
+}
 
-	if len(comment) > 0 && user.Comment != comment {
-		return false
-	}
+// current returns the snapshot of the users and groups being served
+func (m *manager) current() *snapshot {
+	return m.served.Load().(*snapshot)
+}
 
-	if len(home) > 0 && user.Home != home {
-		return false
-	}
+func (m *manager) Snapshot() Reader {
+	return m.current()
+}
 
-	if len(shell) > 0 && user.Shell != shell {
-		return false
-	}
-	return true
+func (m *manager) GetAllUsers() []*User {
+	return m.current().GetAllUsers()
 }
 
 func (m *manager) GetUserByQuery(name, uid, gid, comment, home, shell string) []*User {
-	m.userLock.RLock()
-	defer m.userLock.RUnlock()
-
-	var res []*User
+	return m.current().GetUserByQuery(name, uid, gid, comment, home, shell)
+}
 
-	// since uid is unique, it is guaranteed at most one user will match
-	if len(uid) != 0 {
-		user := m.GetUserByUID(uid)
-		if user == nil {
-			return res
-		}
-		if len(name) > 0 && user.Name != name {
-			return res
-		}
-		if !compareUser(gid, comment, home, shell, user) {
-			return res
-		}
-		res = append(res, user)
-		return res
-	}
+func (m *manager) FindUsers(conds []*Condition) []*User {
+	return m.current().FindUsers(conds)
+}
 
-	var candidate []*User
-	if len(name) != 0 {
-		if candidate = m.user.userMapByName[name]; len(candidate) == 0 {
-			return res
-		}
-	} else {
-		candidate = m.user.userSlice
-	}
+func (m *manager) SearchUsers(expr *UserExpression) ([]*User, *SearchPlan) {
+	return m.current().SearchUsers(expr)
+}
 
-	for _, u := range candidate {
-		if !compareUser(gid, comment, home, shell, u) {
-			continue
-		}
-		res = append(res, u)
-	}
-	return res
+func (m *manager) GetUserByUID(uid int) *User {
+	return m.current().GetUserByUID(uid)
 }
 
-func (m *manager) GetUserByUID(uid string) *User {
-	m.userLock.RLock()
-	defer m.userLock.RUnlock()
-	return m.user.userMapByID[uid]
+func (m *manager) GetUsersByName(name string) []*User {
+	return m.current().GetUsersByName(name)
 }
 
-func (m *manager) GetGroupsByUID(uid string) []*Group {
-	var res []*Group
+func (m *manager) GetAccountByUID(uid int) *Account {
+	return m.current().GetAccountByUID(uid)
+}
 
-	user := m.GetUserByUID(uid)
-	if user == nil {
-		return res
-	}
+func (m *manager) GetGroupsByUID(uid int) []*UserGroup {
+	return m.current().GetGroupsByUID(uid)
+}
 
-	m.groupLock.RLock()
-	for _, g := range m.group.groupSlice {
-		if _, ok := g.memberSet[user.Name]; ok {
-			res = append(res, g)
-		}
-	}
-	m.groupLock.RUnlock()
-	return res
+func (m *manager) GetUsersByGID(gid int) *GroupUsers {
+	return m.current().GetUsersByGID(gid)
 }
 
 func (m *manager) GetAllGroups() []*Group {
-	m.groupLock.RLock()
-	defer m.groupLock.RUnlock()
-
-	return m.group.groupSlice
+	return m.current().GetAllGroups()
 }
 
-func (m *manager) GetGroupByQuery(name, gid string, members []string) []*Group {
-	m.groupLock.RLock()
-	defer m.groupLock.RUnlock()
-
-	var res []*Group
-	var candidate []*Group
+func (m *manager) GetGroupByQuery(name, gid string, members, admins []string) []*Group {
+	return m.current().GetGroupByQuery(name, gid, members, admins)
+}
 
-	// As GID is unique, there could be at most one Group match a provided GID
-	if len(gid) > 0 {
-		group := m.group.groupMapByID[gid]
-		if group == nil {
-			return res
-		}
+func (m *manager) FindGroups(conds []*Condition) []*Group {
+	return m.current().FindGroups(conds)
+}
 
-		if len(name) > 0 && group.Name != name {
-			return res
-		}
+func (m *manager) SearchGroups(expr *GroupExpression) ([]*Group, *SearchPlan) {
+	return m.current().SearchGroups(expr)
+}
 
-		for _, m := range members {
-			if _, ok := group.memberSet[m]; !ok {
-				return res
-			}
-		}
-		res = append(res, group)
-		return res
-	}
+func (m *manager) GetGroupByGID(gid int) *Group {
+	return m.current().GetGroupByGID(gid)
+}
 
-	if len(name) != 0 {
-		if candidate = m.group.groupMapByName[name]; len(candidate) == 0 {
-			return res
-		}
-	} else {
-		candidate = m.group.groupSlice
-	}
+func (m *manager) GetGroupsByName(name string) []*Group {
+	return m.current().GetGroupsByName(name)
+}
 
-Loop:
-	for _, g := range candidate {
-		for _, memberInQuery := range members {
-			if len(g.Members) == 0 {
-				continue Loop
-			}
-			// (len(g.Members) > 0) guarantees (g.memberSet != nil)
-			if _, ok := g.memberSet[memberInQuery]; !ok {
-				continue Loop
-			}
-		}
-		res = append(res, g)
-	}
-	return res
+func (m *manager) GetParseDiagnostics() []*Diagnostic {
+	return m.current().GetParseDiagnostics()
 }
 
-func (m *manager) GetGroupByGID(gid string) *Group {
-	m.groupLock.RLock()
-	defer m.groupLock.RUnlock()
+func (m *manager) Lint() *LintReport {
+	return m.current().Lint()
+}
 
-	return m.group.groupMapByID[gid]
+// getSources returns the sources being served
+func (m *manager) getSources() []Source {
+	m.sourceLock.Lock()
+	defer m.sourceLock.Unlock()
+	return m.sources
 }
 
-// In case the monitored file is deleted or renamed, it will keep watching for the
-// monitored file to be recreated.
-func (m *manager) waitForFileCreation(watcher *fsnotify.Watcher, path string) {
-	for {
-		// Exit if programming is terminating
-		select {
-		case <-m.exit:
-			return
-		default:
-		}
+func (m *manager) handleChange(change Change) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	m.reload(change)
+}
 
-		if exist, err := pathExists(path); !exist {
-			if err != nil {
-				log.Printf("Test path %s exist, err %s\n", path, err)
-			}
-			time.Sleep(monitorFileCreationIntervalInSec)
-			continue
-		}
-		err := watcher.Watch(path)
+// reload reads the data of change and returns the errors of the users and of the groups, it must be called
+// with reloadLock held
+func (m *manager) reload(change Change) (userErr, groupErr error) {
+	var events []*Event
+	previous := m.current()
+	user, group := previous.user, previous.group
+	// a failed reload keeps serving the previous snapshot, and marks the manager as degraded
+	if change&UserChange != 0 {
+		userDataObj, err := m.loadUsers()
+		userErr = err
 		if err != nil {
-			log.Printf("Fail to watch path %s, err %s\n", path, err)
+			log.Printf("Fail to update the users change due to error: %s\n", err)
+			m.userReload.fail(err, time.Now())
+		} else {
+			user = userDataObj
+			m.userReload.succeed(time.Now())
+			events = append(events, diffUsers(previous.user, userDataObj, time.Now())...)
 		}
-		break
 	}
-}
-
-func (m *manager) watchFile(watcher *fsnotify.Watcher, path string, handler handleFileUpdateFunc) {
-	log.Println("Start monitoring file ", path)
-ForLoop:
-	for {
-		// exit channel has higher priority
-		select {
-		case <-m.exit:
-			break ForLoop
-		default:
-		}
-
-		select {
-		case ev := <-watcher.Event:
-			log.Println("file change event:", ev)
-			if ev.IsDelete() {
-				log.Printf("File %s is deleted\n", ev.Name)
-				m.waitForFileCreation(watcher, path)
-				continue ForLoop
-			}
-			if ev.IsRename() {
-				log.Printf("File %s is moved\n", ev.Name)
-				m.waitForFileCreation(watcher, path)
-				continue ForLoop
-			}
-
-			if ev.IsModify() {
-				handler(m)
-			}
 
-			// ev.IsAttrib() is ignored and ev.IsCreate() only applies to directory
-		case err := <-watcher.Error:
-			log.Printf("error %s for watching file %s\n", err, path)
-			break ForLoop
-		case <-m.exit:
-			break ForLoop
+	if change&GroupChange != 0 {
+		groupDataObj, err := m.loadGroups()
+		groupErr = err
+		if err != nil {
+			log.Printf("Fail to update the groups change due to error: %s\n", err)
+			m.groupReload.fail(err, time.Now())
+		} else {
+			group = groupDataObj
+			m.groupReload.succeed(time.Now())
+			events = append(events, diffGroups(previous.group, groupDataObj, time.Now())...)
 		}
 	}
-	log.Println("Stop monitoring file ", path)
-}
-
-func handlePasswdFileUpdate(mgr *manager) {
-	userDataObj, err := parsePasswdFile(mgr.passwdFilePath)
-	if err != nil {
-		log.Printf("Fail to update passwd file change due to error: %s\n", err)
-		return
-	}
-
-	mgr.userLock.Lock()
-	defer mgr.userLock.Unlock()
-	mgr.user = userDataObj
-}
+	m.publish(user, group, time.Now())
 
-func handleGroupFileUpdate(mgr *manager) {
-	groupDataObj, err := parseGroupFile(mgr.groupFilePath)
-	if err != nil {
-		log.Printf("Fail to update group file change due to error: %s\n", err)
+	generation := m.current().version.Generation
+	for _, e := range events {
+		e.Generation = generation
 	}
-
-	mgr.groupLock.Lock()
-	defer mgr.groupLock.Unlock()
-	mgr.group = groupDataObj
+	m.events.publish(events)
+	return userErr, groupErr
 }
 
 func (m *manager) Start() error {
-	watcherPasswd, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
-	err = watcherPasswd.Watch(m.passwdFilePath)
-	if err != nil {
-		return err
-	}
-
-	watcherGroup, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
-	err = watcherGroup.Watch(m.groupFilePath)
-	if err != nil {
-		return err
+	m.sourceLock.Lock()
+	m.started = true
+	m.sourceLock.Unlock()
+	for _, src := range m.getSources() {
+		log.Println("Start monitoring source ", src.Name())
+		if err := src.Start(m.handleChange); err != nil {
+			return err
+		}
 	}
-
-	go m.watchFile(watcherPasswd, m.passwdFilePath, handlePasswdFileUpdate)
-	go m.watchFile(watcherGroup, m.groupFilePath, handleGroupFileUpdate)
-
 	return nil
-
 }
 
 func (m *manager) Stop() {
 	log.Println("Stopping password manager")
-	close(m.exit)
-}
-
-func pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
-	}
-	if os.IsNotExist(err) {
-		return false, nil
+	m.sourceLock.Lock()
+	m.started = false
+	m.sourceLock.Unlock()
+	for _, src := range m.getSources() {
+		src.Stop()
 	}
-	return false, err
 }
 
-// NewManager instantiate a new data.Manager to retrieve data from provided passwd file and group file, it
-// also monitor any change that happens to those files and update the content accordingly
-func NewManager(passwdPath, groupPath string) (Manager, error) {
-	for _, path := range []string{passwdPath, groupPath} {
-		if res, err := pathExists(path); !res {
-			if err != nil {
-				log.Printf("Fail to find path %s, error:%s", path, err)
-			}
-			return nil, fmt.Errorf("File %s does not exist", path)
-		}
+// NewManager instantiate a new data.Manager to retrieve data from the provided sources, it also monitor any
+// change that happens to those sources and update the content accordingly
+func NewManager(sources []Source, opts ...ManagerOption) (Manager, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("No source is provided")
 	}
 
 	managerObj := &manager{
-		passwdFilePath: passwdPath,
-		groupFilePath:  groupPath,
-		exit:           make(chan struct{}),
+		sources:      sources,
+		manualReload: make(chan struct{}, 1),
+	}
+	managerObj.history.size = DefaultHistorySize
+	for _, opt := range opts {
+		opt(managerObj)
+	}
+	if managerObj.history.size < 1 || managerObj.history.maxAge < 0 {
+		return nil, fmt.Errorf("Invalid history of %d snapshots up to %s", managerObj.history.size,
+			managerObj.history.maxAge)
+	}
+	// the generations carry on from the persisted history
+	last, err := managerObj.history.load()
+	if err != nil {
+		return nil, fmt.Errorf("Fail to load the history from %s: %s", managerObj.history.dir, err)
+	}
+	if last != nil {
+		managerObj.version.version = *last
 	}
 
-	//  managerObj.passwdFile and managerObj.groupFile will be closed in the watchFile()
-	var err error
-	managerObj.user, err = parsePasswdFile(managerObj.passwdFilePath)
+	user, err := managerObj.loadUsers()
 	if err != nil {
 		return nil, err
 	}
 
-	managerObj.group, err = parseGroupFile(managerObj.groupFilePath)
+	group, err := managerObj.loadGroups()
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
+	managerObj.userReload.succeed(now)
+	managerObj.groupReload.succeed(now)
+	managerObj.publish(user, group, now)
+
 	return managerObj, nil
 }
 
-func parseGroup(line string) (*Group, error) {
-	strList := strings.Split(strings.TrimSpace(line), fieldDelim)
-	if len(strList) != numberOfFieldGroupEntry {
-		return nil, fmt.Errorf("Malformed content %s", line)
+// newUserData indexes users, and the shadow entries whose names are unique
+func newUserData(users []*User, shadows []*Shadow, diagnostics []*Diagnostic) *userData {
+	userDataObj := &userData{
+		userMapByID:     make(map[int]*User),
+		usersByID:       make(map[int][]*User),
+		userMapByName:   make(map[string][]*User),
+		userSlice:       make([]*User, 0, len(users)),
+		shadowMapByName: make(map[string]*Shadow),
+		shadows:         shadows,
+		diagnostics:     diagnostics,
+	}
+	for _, user := range users {
+		userDataObj.userSlice = append(userDataObj.userSlice, user)
+		userDataObj.userMapByID[user.UID] = user
+		userDataObj.usersByID[user.UID] = append(userDataObj.usersByID[user.UID], user)
+		userDataObj.userMapByName[user.Name] = append(userDataObj.userMapByName[user.Name], user)
 	}
-	res := &Group{
-		Name:      strings.TrimSpace(strList[groupNameOffset]),
-		GID:       strings.TrimSpace(strList[groupGidOffset]),
-		Members:   make([]string, 0),
-		memberSet: make(map[string]struct{}),
+	for _, entry := range shadows {
+		userDataObj.shadowMapByName[entry.Name] = entry
 	}
+	userDataObj.hash = contentHash(userDataObj.userSlice, shadows, diagnostics)
+	return userDataObj
+}
 
-	members := strList[memberOffset]
-	if len(members) != 0 {
-		memberList := strings.Split(strings.TrimSpace(members), memberDelim)
-		res.Members = append(res.Members, memberList...)
-		for _, m := range res.Members {
-			res.memberSet[m] = struct{}{}
+// loadUsers loads and indexes the users of all the sources
+func (m *manager) loadUsers() (*userData, error) {
+	var users []*User
+	var shadows []*Shadow
+	var diagnostics []*Diagnostic
+	shadowNames := make(map[string]struct{})
+
+	for _, src := range m.getSources() {
+		snapshot, err := src.LoadUsers()
+		if err != nil {
+			return nil, &loadError{source: src, kind: EventKindUser, err: err}
+		}
+		users = append(users, snapshot.Users...)
+		diagnostics = append(diagnostics, snapshot.Diagnostics...)
+		for _, entry := range snapshot.Shadows {
+			// like getspnam(), the first entry of a name wins
+			if _, ok := shadowNames[entry.Name]; !ok {
+				shadowNames[entry.Name] = struct{}{}
+				shadows = append(shadows, entry)
+			}
 		}
 	}
-
-	return res, nil
+	return newUserData(users, shadows, diagnostics), nil
 }
 
-func parseGroupFile(groupFilePath string) (*groupData, error) {
-	buf, err := ioutil.ReadFile(groupFilePath)
-	if err != nil {
-		return nil, err
-	}
-
+// newGroupData indexes groups
+func newGroupData(groups []*Group, diagnostics []*Diagnostic) *groupData {
 	groupDataObj := &groupData{
-		groupMapByID:   make(map[string]*Group),
+		groupMapByID:   make(map[int]*Group),
+		groupsByID:     make(map[int][]*Group),
 		groupMapByName: make(map[string][]*Group),
-		groupSlice:     make([]*Group, 0),
-	}
-
-	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// skip commented or empty lines
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
+		groupSlice:     make([]*Group, 0, len(groups)),
+		diagnostics:    diagnostics,
+	}
+	for _, srcGroup := range groups {
+		// the sets are built on a copy, as the groups of a Source might be shared with an older snapshot
+		group := new(Group)
+		*group = *srcGroup
+		group.memberSet = make(map[string]struct{}, len(group.Members))
+		for _, m := range group.Members {
+			group.memberSet[m] = struct{}{}
 		}
-		// parse the current line
-		group, err := parseGroup(line)
-		if err != nil {
-			return nil, err
+		group.adminSet = make(map[string]struct{}, len(group.Admins))
+		for _, a := range group.Admins {
+			group.adminSet[a] = struct{}{}
 		}
+
 		groupDataObj.groupSlice = append(groupDataObj.groupSlice, group)
 		groupDataObj.groupMapByID[group.GID] = group
+		groupDataObj.groupsByID[group.GID] = append(groupDataObj.groupsByID[group.GID], group)
 		groupDataObj.groupMapByName[group.Name] = append(groupDataObj.groupMapByName[group.Name], group)
 	}
-	return groupDataObj, nil
-}
-
-func parseUser(line string) (*User, error) {
-	strList := strings.Split(strings.TrimSpace(line), fieldDelim)
-	if len(strList) != numberOfFieldPasswdField {
-		return nil, fmt.Errorf("Malformed content %s", line)
-	}
-	res := &User{
-		Name:    strings.TrimSpace(strList[userNameOffset]),
-		UID:     strings.TrimSpace(strList[uidOffset]),
-		GID:     strings.TrimSpace(strList[userGidOffset]),
-		Comment: strings.TrimSpace(strList[commentOffset]),
-		Home:    strings.TrimSpace(strList[homeOffset]),
-		Shell:   strings.TrimSpace(strList[shellOffset]),
-	}
-	return res, nil
+	groupDataObj.hash = contentHash(groupDataObj.groupSlice, diagnostics)
+	return groupDataObj
 }
 
-func parsePasswdFile(passwdFilePath string) (*userData, error) {
-	buf, err := ioutil.ReadFile(passwdFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	userDataObj := &userData{
-		userMapByID:   make(map[string]*User),
-		userMapByName: make(map[string][]*User),
-		userSlice:     make([]*User, 0),
-	}
-
-	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		// skip commented or empty lines
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
-		}
-		// parse the current line
-		user, err := parseUser(line)
+// loadGroups loads and indexes the groups of all the sources
+func (m *manager) loadGroups() (*groupData, error) {
+	var groups []*Group
+	var diagnostics []*Diagnostic
+	for _, src := range m.getSources() {
+		snapshot, err := src.LoadGroups()
 		if err != nil {
-			return nil, err
+			return nil, &loadError{source: src, kind: EventKindGroup, err: err}
 		}
-		userDataObj.userSlice = append(userDataObj.userSlice, user)
-		userDataObj.userMapByID[user.UID] = user
-		userDataObj.userMapByName[user.Name] = append(userDataObj.userMapByName[user.Name], user)
+		groups = append(groups, snapshot.Groups...)
+		diagnostics = append(diagnostics, snapshot.Diagnostics...)
 	}
-	return userDataObj, nil
+	return newGroupData(groups, diagnostics), nil
 }
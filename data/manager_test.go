@@ -1,20 +1,27 @@
 package data
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 )
 
 const (
-	originalPasswdPath = "../testData/passwd"
-	originalGroupPath  = "../testData/group"
+	originalPasswdPath  = "../testData/passwd"
+	originalGroupPath   = "../testData/group"
+	originalShadowPath  = "../testData/shadow"
+	originalGShadowPath = "../testData/gshadow"
 
 	passwdPath = "../testData/passwd_cp"
 	groupPath  = "../testData/group_cp"
 
 	passwdPathRenamed = "../testData/passwd_cp2"
+	passwdPathTemp    = "../testData/.passwd_cp.tmp"
 )
 
 var mgr Manager
@@ -35,7 +42,13 @@ func setup() {
 		panic("Fail to copy the test data of passwd file, err: " + err.Error())
 	}
 
-	if mgr, err = NewManager(passwdPath, groupPath); err != nil {
+	src, err := NewFileSource(passwdPath, groupPath, WithShadowFile(originalShadowPath),
+		WithGShadowFile(originalGShadowPath))
+	if err != nil {
+		panic("Fail to create file source, err: " + err.Error())
+	}
+
+	if mgr, err = NewManager([]Source{src}); err != nil {
 		panic("Fail to create manager, err: " + err.Error())
 	}
 
@@ -70,16 +83,16 @@ func TestMain(m *testing.M) {
 }
 
 func TestGetUsers(t *testing.T) {
-	user := mgr.GetUserByUID("0")
+	user := mgr.GetUserByUID(0)
 	assert(t, user != nil)
 	assert(t, user.Name == "root")
-	assert(t, user.UID == "0")
-	assert(t, user.GID == "0")
+	assert(t, user.UID == 0)
+	assert(t, user.GID == 0)
 	assert(t, user.Comment == "System Administrator")
 	assert(t, user.Home == "/var/root")
 	assert(t, user.Shell == "/bin/sh")
 
-	user = mgr.GetUserByUID("999")
+	user = mgr.GetUserByUID(999)
 	assert(t, user == nil)
 
 	res := mgr.GetUserByQuery("daemon", "1", "1", "System Services", "/var/root", "/usr/bin/false")
@@ -91,24 +104,36 @@ func TestGetUsers(t *testing.T) {
 	res = mgr.GetUserByQuery("daemon", "1", "1", "System Services", "/var/root", "/usr/bin/true")
 	assert(t, len(res) == 0)
 
+	res = mgr.GetUserByQuery("", "", "root", "", "", "")
+	assert(t, len(res) == 0)
+
 	res = mgr.GetAllUsers()
 	assert(t, len(res) == 6)
 }
 
 func TestGetGroups(t *testing.T) {
-	group := mgr.GetGroupByGID("1")
+	group := mgr.GetGroupByGID(1)
 	assert(t, group != nil)
 	assert(t, group.Name == "daemon")
 	assert(t, len(group.Members) == 1)
 	assert(t, group.Members[0] == "root")
 
-	group = mgr.GetGroupByGID("1000")
+	group = mgr.GetGroupByGID(1000)
 	assert(t, group == nil)
 
-	var rootGroup [][]*Group
-	rootGroup = append(rootGroup, mgr.GetGroupsByUID("0"))
-	rootGroup = append(rootGroup, mgr.GetGroupByQuery("", "", []string{"root"}))
-	for _, res := range rootGroup {
+	userGroups := mgr.GetGroupsByUID(0)
+	assert(t, len(userGroups) == 4)
+	// root has no group entry for its primary GID 0, but it is still reported like `id -G` does
+	assert(t, userGroups[0].GID == 0)
+	assert(t, userGroups[0].Name == "")
+	assert(t, userGroups[0].Membership == PrimaryMembership)
+	var rootGroup []*Group
+	for _, g := range userGroups[1:] {
+		assert(t, g.Membership == SupplementaryMembership)
+		rootGroup = append(rootGroup, g.Group)
+	}
+
+	for _, res := range [][]*Group{rootGroup, mgr.GetGroupByQuery("", "", []string{"root"}, nil)} {
 		assert(t, len(res) == 3)
 		resGroupNameMap := map[string]struct{}{}
 		for _, m := range res {
@@ -120,22 +145,147 @@ func TestGetGroups(t *testing.T) {
 		}
 	}
 
-	res := mgr.GetGroupsByUID("1000")
+	// _taskgated is also listed as a member of its primary group, it must only be reported once
+	userGroups = mgr.GetGroupsByUID(13)
+	assert(t, len(userGroups) == 1)
+	assert(t, userGroups[0].Name == "_taskgated")
+	assert(t, userGroups[0].Membership == PrimaryMembership)
+
+	userGroups = mgr.GetGroupsByUID(1000)
+	assert(t, len(userGroups) == 0)
+
+	res := mgr.GetGroupByQuery("", "", []string{"root2"}, nil)
 	assert(t, len(res) == 0)
 
-	res = mgr.GetGroupByQuery("", "", []string{"root2"})
+	res = mgr.GetGroupByQuery("daemon", "1", []string{"root"}, nil)
+	assert(t, len(res) == 1)
+
+	res = mgr.GetGroupByQuery("daemon", "10", []string{"root"}, nil)
 	assert(t, len(res) == 0)
 
-	res = mgr.GetGroupByQuery("daemon", "1", []string{"root"})
+	res = mgr.GetGroupByQuery("", "", nil, []string{"root"})
+	assert(t, len(res) == 2)
+
+	res = mgr.GetGroupByQuery("", "", []string{"root"}, []string{"_taskgated"})
 	assert(t, len(res) == 1)
+	assert(t, res[0].Name == "staff")
+	assert(t, len(res[0].ShadowMembers) == 1 && res[0].ShadowMembers[0] == "_uucp")
 
-	res = mgr.GetGroupByQuery("daemon", "10", []string{"root"})
+	res = mgr.GetGroupByQuery("", "1", nil, []string{"_taskgated"})
 	assert(t, len(res) == 0)
 
+	res = mgr.GetGroupByQuery("", "29", nil, nil)
+	assert(t, len(res) == 1)
+	assert(t, len(res[0].Admins) == 0)
+
+	// groups without gshadow entry have no administrators
+	group = mgr.GetGroupByGID(66)
+	assert(t, group != nil)
+	assert(t, group.Admins == nil)
+
 	res = mgr.GetAllGroups()
 	assert(t, len(res) == 8)
 }
 
+func TestGetUsersByGID(t *testing.T) {
+	res := mgr.GetUsersByGID(29)
+	assert(t, res != nil)
+	// root is the only member of certusers with a passwd entry
+	assert(t, len(res.Users) == 1)
+	assert(t, res.Users[0].Name == "root")
+	assert(t, res.Users[0].Membership == SupplementaryMembership)
+	assert(t, len(res.Unresolved) == 5)
+	assert(t, res.Unresolved[0] == "_jabber")
+
+	// _taskgated is both the primary user and a listed member, it must only be reported once
+	res = mgr.GetUsersByGID(13)
+	assert(t, res != nil)
+	assert(t, len(res.Users) == 1)
+	assert(t, res.Users[0].Name == "_taskgated")
+	assert(t, res.Users[0].Membership == PrimaryMembership)
+	assert(t, len(res.Unresolved) == 0)
+
+	// root's primary GID 0 has no group entry
+	res = mgr.GetUsersByGID(0)
+	assert(t, res != nil)
+	assert(t, len(res.Users) == 1)
+	assert(t, res.Users[0].Name == "root")
+
+	res = mgr.GetUsersByGID(1000)
+	assert(t, res == nil)
+}
+
+func TestGetAccount(t *testing.T) {
+	account := mgr.GetAccountByUID(1)
+	assert(t, account != nil)
+	assert(t, account.Locked)
+	assert(t, account.AccountExpired)
+
+	account = mgr.GetAccountByUID(0)
+	assert(t, account != nil)
+	assert(t, !account.Locked)
+	assert(t, account.LastChange == "2019-04-14")
+
+	// _networkd has no shadow entry
+	assert(t, mgr.GetAccountByUID(24) == nil)
+	assert(t, mgr.GetAccountByUID(999) == nil)
+}
+
+// flakySource fails to load whenever err is set
+type flakySource struct {
+	staticSource
+	err error
+}
+
+func (s *flakySource) LoadUsers() (*UserSnapshot, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.staticSource.LoadUsers()
+}
+
+func (s *flakySource) LoadGroups() (*GroupSnapshot, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.staticSource.LoadGroups()
+}
+
+func TestReloadFailure(t *testing.T) {
+	src := &flakySource{}
+	src.users = []*User{&User{Name: "root", UID: 0, GID: 0}}
+	src.groups = []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root"}}}
+	flakyMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	assert(t, !flakyMgr.Status().Degraded)
+
+	// the previous snapshot is kept when the reload fails
+	src.err = errors.New("broken")
+	flakyMgr.(*manager).handleChange(UserChange | GroupChange)
+	assert(t, len(flakyMgr.GetAllUsers()) == 1)
+	assert(t, len(flakyMgr.GetAllGroups()) == 1)
+	assert(t, flakyMgr.GetGroupByGID(0) != nil)
+	status := flakyMgr.Status()
+	assert(t, status.Degraded)
+	assert(t, status.Users.Degraded && status.Groups.Degraded)
+	assert(t, strings.Contains(status.Groups.LastError, "broken"))
+	assert(t, status.Groups.LastErrorTime != nil)
+
+	src.err = nil
+	src.groups = append(src.groups, &Group{Name: "staff", GID: 20, Members: []string{"root"}})
+	flakyMgr.(*manager).handleChange(GroupChange)
+	assert(t, len(flakyMgr.GetAllGroups()) == 2)
+	status = flakyMgr.Status()
+	assert(t, status.Degraded)
+	assert(t, !status.Groups.Degraded)
+	// the last error is kept for the record
+	assert(t, status.Groups.LastErrorTime != nil)
+	assert(t, status.Groups.LastSuccess.After(*status.Groups.LastErrorTime))
+
+	flakyMgr.(*manager).handleChange(UserChange)
+	assert(t, !flakyMgr.Status().Degraded)
+}
+
 func testMonitorFile(t *testing.T) {
 	f, err := os.OpenFile(passwdPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	assert(t, err == nil)
@@ -149,7 +299,7 @@ func testMonitorFile(t *testing.T) {
 	assert(t, err == nil)
 
 	time.Sleep(1 * time.Second)
-	user := mgr.GetUserByUID("99")
+	user := mgr.GetUserByUID(99)
 	assert(t, user != nil)
 
 	// test deleting entries
@@ -160,12 +310,12 @@ func testMonitorFile(t *testing.T) {
 	assert(t, err == nil)
 
 	time.Sleep(1 * time.Second)
-	user = mgr.GetUserByUID("99")
+	user = mgr.GetUserByUID(99)
 	assert(t, user == nil)
 }
 
 func TestMonitorFile(t *testing.T) {
-	user := mgr.GetUserByUID("99")
+	user := mgr.GetUserByUID(99)
 	assert(t, user == nil)
 	// test the file is still watched after rename
 	err := os.Rename(passwdPath, passwdPathRenamed)
@@ -186,4 +336,16 @@ func TestMonitorFile(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 	testMonitorFile(t)
+
+	// test the file is reloaded when replaced by a rename, twice to check it is still watched afterward
+	for _, uid := range []int{3000, 3001} {
+		line := fmt.Sprintf("app:*:%d:%d:App:/srv/app:/bin/sh\n", uid, uid)
+		err = ioutil.WriteFile(passwdPathTemp, []byte(line), 0644)
+		assert(t, err == nil)
+		err = os.Rename(passwdPathTemp, passwdPath)
+		assert(t, err == nil)
+		time.Sleep(500 * time.Millisecond)
+		user = mgr.GetUserByUID(uid)
+		assert(t, user != nil)
+	}
 }
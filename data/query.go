@@ -0,0 +1,344 @@
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Operator compares a field of the users or groups with the value of a Condition
+type Operator string
+
+const (
+	// OpEqual is the exact match, the default when no operator is given
+	OpEqual Operator = "eq"
+	// OpPrefix and OpSuffix match the fields starting or ending with the value
+	OpPrefix Operator = "prefix"
+	OpSuffix Operator = "suffix"
+	// OpGlob matches the whole field against a shell pattern, i.e. *, ? and [...]
+	OpGlob Operator = "glob"
+	// OpRegex matches the fields containing the RE2 regular expression, use ^ and $ to anchor it
+	OpRegex Operator = "regex"
+	// OpGreater, OpGreaterOrEqual, OpLess and OpLessOrEqual compare the UID or GID numerically
+	OpGreater        Operator = "gt"
+	OpGreaterOrEqual Operator = "gte"
+	OpLess           Operator = "lt"
+	OpLessOrEqual    Operator = "lte"
+
+	// the operators can be prefixed by the modifiers, e.g. notiprefix, ne is short for noteq and ine for
+	// notieq
+	negatedPrefix         = "not"
+	caseInsensitivePrefix = "i"
+	opNotEqual            = "ne"
+	opNotEqualFold        = "ine"
+
+	// the separator of the operator and the value, no field of the passwd or group files contains it
+	operatorSeparator = ":"
+)
+
+// the kinds of fields
+const (
+	textField = iota
+	idField
+	// the fields listing names, they match when any of the names matches
+	listField
+)
+
+var userFieldMap = map[string]int{
+	"name":    textField,
+	"uid":     idField,
+	"gid":     idField,
+	"comment": textField,
+	"home":    textField,
+	"shell":   textField,
+}
+
+var groupFieldMap = map[string]int{
+	"name":   textField,
+	"gid":    idField,
+	"member": listField,
+	"admin":  listField,
+}
+
+var textOperators = []Operator{OpEqual, OpPrefix, OpSuffix, OpGlob, OpRegex}
+var idOperators = []Operator{OpEqual, OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual}
+
+// Condition is a filter on a field of the users or groups, written as [operator:]value in a query
+type Condition struct {
+	Field    string   `json:"field"`
+	Operator Operator `json:"operator"`
+	// Negated inverts the match, for a list of names it means none of them matches
+	Negated bool `json:"negated,omitempty"`
+	// CaseInsensitive is only supported by the text fields
+	CaseInsensitive bool   `json:"caseInsensitive,omitempty"`
+	Value           string `json:"value"`
+
+	id int
+	// text is Value in lower case if the match is case insensitive
+	text    string
+	pattern *regexp.Regexp
+}
+
+// ParseUserCondition parses the condition on the field of the users, i.e. name, uid, gid, comment, home or
+// shell. expr is either a value to match exactly or operator:value, e.g. gte:1000 or notiprefix:/usr/.
+func ParseUserCondition(field, expr string) (*Condition, error) {
+	return parseCondition(userFieldMap, field, expr)
+}
+
+// ParseGroupCondition parses the condition on the field of the groups, i.e. name, gid, member or admin, see
+// ParseUserCondition
+func ParseGroupCondition(field, expr string) (*Condition, error) {
+	return parseCondition(groupFieldMap, field, expr)
+}
+
+// parseOperator splits the modifiers of the operator op
+func parseOperator(op string) (Operator, bool, bool) {
+	switch op {
+	case opNotEqual:
+		return OpEqual, true, false
+	case opNotEqualFold:
+		return OpEqual, true, true
+	}
+	negated := strings.HasPrefix(op, negatedPrefix)
+	op = strings.TrimPrefix(op, negatedPrefix)
+	// none of the operators starts with i
+	caseInsensitive := strings.HasPrefix(op, caseInsensitivePrefix)
+	op = strings.TrimPrefix(op, caseInsensitivePrefix)
+	return Operator(op), negated, caseInsensitive
+}
+
+// hasOperator tells whether op is one of operators
+func hasOperator(operators []Operator, op Operator) bool {
+	for _, candidate := range operators {
+		if candidate == op {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCondition(fieldMap map[string]int, field, expr string) (*Condition, error) {
+	kind, ok := fieldMap[field]
+	if !ok {
+		return nil, fmt.Errorf("Unknown field %s", field)
+	}
+	res := &Condition{Field: field, Operator: OpEqual, Value: expr}
+	if i := strings.Index(expr, operatorSeparator); i >= 0 {
+		res.Operator, res.Negated, res.CaseInsensitive = parseOperator(expr[:i])
+		res.Value = expr[i+1:]
+	}
+
+	operators := textOperators
+	if kind == idField {
+		operators = idOperators
+	}
+	if !hasOperator(operators, res.Operator) {
+		return nil, fmt.Errorf("Invalid operator in %s=%s, the operators of %s are %v, optionally prefixed by "+
+			"%s to negate them", field, expr, field, operators, negatedPrefix)
+	}
+
+	if kind == idField {
+		if res.CaseInsensitive {
+			return nil, fmt.Errorf("Invalid operator in %s=%s, %s is not a text field", field, expr, field)
+		}
+		id, err := parseID(res.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %s, expecting an integer", field, res.Value)
+		}
+		res.id = id
+		return res, nil
+	}
+
+	var pattern string
+	switch res.Operator {
+	case OpGlob:
+		var err error
+		if pattern, err = globToRegexp(res.Value); err != nil {
+			return nil, fmt.Errorf("Invalid glob %s of %s: %s", res.Value, field, err)
+		}
+	case OpRegex:
+		pattern = res.Value
+	default:
+		res.text = res.Value
+		if res.CaseInsensitive {
+			res.text = strings.ToLower(res.Value)
+		}
+		return res, nil
+	}
+	if res.CaseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	var err error
+	if res.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("Invalid regex %s of %s: %s", res.Value, field, err)
+	}
+	return res, nil
+}
+
+// globToRegexp converts the shell pattern glob to an anchored regular expression. Unlike path.Match, * also
+// matches /, so that */nologin matches any path of nologin.
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i++; i == len(glob) {
+				return "", fmt.Errorf("trailing \\")
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			// the first character of the class is never its end, e.g. []] matches ]
+			end := -1
+			if i+2 < len(glob) {
+				end = strings.IndexByte(glob[i+2:], ']')
+			}
+			if end < 0 {
+				return "", fmt.Errorf("unterminated [")
+			}
+			class := glob[i+1 : i+2+end]
+			i += 2 + end
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// matchText tells whether s matches c, regardless of the negation
+func (c *Condition) matchText(s string) bool {
+	if c.pattern != nil {
+		return c.pattern.MatchString(s)
+	}
+	if c.CaseInsensitive {
+		s = strings.ToLower(s)
+	}
+	switch c.Operator {
+	case OpPrefix:
+		return strings.HasPrefix(s, c.text)
+	case OpSuffix:
+		return strings.HasSuffix(s, c.text)
+	}
+	return s == c.text
+}
+
+// matchID tells whether id matches c, regardless of the negation
+func (c *Condition) matchID(id int) bool {
+	switch c.Operator {
+	case OpGreater:
+		return id > c.id
+	case OpGreaterOrEqual:
+		return id >= c.id
+	case OpLess:
+		return id < c.id
+	case OpLessOrEqual:
+		return id <= c.id
+	}
+	return id == c.id
+}
+
+// matchList tells whether any of names matches c, regardless of the negation
+func (c *Condition) matchList(names []string) bool {
+	for _, name := range names {
+		if c.matchText(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Condition) matchUser(u *User) bool {
+	var res bool
+	switch c.Field {
+	case "name":
+		res = c.matchText(u.Name)
+	case "uid":
+		res = c.matchID(u.UID)
+	case "gid":
+		res = c.matchID(u.GID)
+	case "comment":
+		res = c.matchText(u.Comment)
+	case "home":
+		res = c.matchText(u.Home)
+	case "shell":
+		res = c.matchText(u.Shell)
+	}
+	return res != c.Negated
+}
+
+func (c *Condition) matchGroup(g *Group) bool {
+	var res bool
+	switch c.Field {
+	case "name":
+		res = c.matchText(g.Name)
+	case "gid":
+		res = c.matchID(g.GID)
+	case "member":
+		res = c.matchList(g.Members)
+	case "admin":
+		res = c.matchList(g.Admins)
+	}
+	return res != c.Negated
+}
+
+// exactMatch returns the condition requiring field to be exactly a value, so that the candidates are looked
+// up by it instead of scanning all the entries
+func exactMatch(conds []*Condition, field string) *Condition {
+	for _, c := range conds {
+		if c.Field == field && c.Operator == OpEqual && !c.Negated && !c.CaseInsensitive {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) FindUsers(conds []*Condition) []*User {
+	candidate := s.user.userSlice
+	if c := exactMatch(conds, "uid"); c != nil {
+		candidate = s.user.usersByID[c.id]
+	} else if c = exactMatch(conds, "name"); c != nil {
+		candidate = s.user.userMapByName[c.Value]
+	}
+
+	var res []*User
+Loop:
+	for _, u := range candidate {
+		for _, c := range conds {
+			if !c.matchUser(u) {
+				continue Loop
+			}
+		}
+		res = append(res, u)
+	}
+	return res
+}
+
+func (s *snapshot) FindGroups(conds []*Condition) []*Group {
+	candidate := s.group.groupSlice
+	if c := exactMatch(conds, "gid"); c != nil {
+		candidate = s.group.groupsByID[c.id]
+	} else if c = exactMatch(conds, "name"); c != nil {
+		candidate = s.group.groupMapByName[c.Value]
+	}
+
+	var res []*Group
+Loop:
+	for _, g := range candidate {
+		for _, c := range conds {
+			if !c.matchGroup(g) {
+				continue Loop
+			}
+		}
+		res = append(res, g)
+	}
+	return res
+}
@@ -0,0 +1,174 @@
+package data
+
+import (
+	"testing"
+)
+
+func newQueryManager(t *testing.T) Manager {
+	src := &staticSource{
+		users: []*User{
+			&User{Name: "root", UID: 0, GID: 0, Home: "/root", Shell: "/bin/bash"},
+			&User{Name: "daemon", UID: 1, GID: 1, Home: "/usr/sbin", Shell: "/usr/sbin/nologin"},
+			&User{Name: "alice", UID: 1000, GID: 1000, Comment: "Alice", Home: "/home/alice", Shell: "/bin/zsh"},
+			&User{Name: "bob", UID: 1001, GID: 1001, Comment: "Bob", Home: "/home/bob", Shell: "/usr/bin/false"},
+			&User{Name: "nobody", UID: 65534, GID: 65534, Home: "/nonexistent", Shell: "/usr/sbin/nologin"},
+		},
+		groups: []*Group{
+			&Group{Name: "root", GID: 0, Members: []string{}},
+			&Group{Name: "docker", GID: 998, Members: []string{"alice", "bob"}, Admins: []string{"alice"}},
+			&Group{Name: "alice", GID: 1000, Members: []string{}},
+		},
+	}
+	res, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	return res
+}
+
+// findUsers returns the names of the users matching the conditions of the fields and expressions in pairs
+func findUsers(t *testing.T, m Manager, pairs ...string) []string {
+	var conds []*Condition
+	for i := 0; i < len(pairs); i += 2 {
+		cond, err := ParseUserCondition(pairs[i], pairs[i+1])
+		assert(t, err == nil)
+		conds = append(conds, cond)
+	}
+	var res []string
+	for _, u := range m.FindUsers(conds) {
+		res = append(res, u.Name)
+	}
+	return res
+}
+
+func equalNames(names []string, expected ...string) bool {
+	if len(names) != len(expected) {
+		return false
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseCondition(t *testing.T) {
+	cond, err := ParseUserCondition("shell", "/bin/sh")
+	assert(t, err == nil && cond.Operator == OpEqual && !cond.Negated && cond.Value == "/bin/sh")
+	cond, err = ParseUserCondition("shell", "ne:/usr/bin/false")
+	assert(t, err == nil && cond.Operator == OpEqual && cond.Negated && cond.Value == "/usr/bin/false")
+	cond, err = ParseUserCondition("home", "notiprefix:/HOME/")
+	assert(t, err == nil && cond.Operator == OpPrefix && cond.Negated && cond.CaseInsensitive)
+	cond, err = ParseGroupCondition("gid", "gte:1000")
+	assert(t, err == nil && cond.Operator == OpGreaterOrEqual && cond.id == 1000)
+
+	for _, pair := range [][]string{
+		{"shell", "like:/bin/sh"},
+		{"shell", "gte:/bin/sh"},
+		{"uid", "prefix:10"},
+		{"uid", "gte:abc"},
+		{"uid", "abc"},
+		{"gid", "ieq:1"},
+		{"shell", "regex:("},
+		{"shell", "glob:/bin/[a"},
+		{"member", "gt:1"},
+		{"password", "*"},
+	} {
+		_, err = ParseUserCondition(pair[0], pair[1])
+		_, groupErr := ParseGroupCondition(pair[0], pair[1])
+		assert(t, err != nil && groupErr != nil)
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	for glob, expected := range map[string]string{
+		"*/nologin":  `^.*/nologin$`,
+		"/bin/?sh":   `^/bin/.sh$`,
+		"[!a-c]*.d":  `^[^a-c].*\.d$`,
+		`\*[]]`:      `^\*[]]$`,
+		"/home/user": `^/home/user$`,
+	} {
+		res, err := globToRegexp(glob)
+		assert(t, err == nil && res == expected)
+	}
+	_, err := globToRegexp(`abc\`)
+	assert(t, err != nil)
+}
+
+func TestFindUsers(t *testing.T) {
+	queryMgr := newQueryManager(t)
+
+	// no condition matches everyone
+	assert(t, len(findUsers(t, queryMgr)) == 5)
+	assert(t, equalNames(findUsers(t, queryMgr, "uid", "gte:1000", "uid", "lt:60000"), "alice", "bob"))
+	assert(t, equalNames(findUsers(t, queryMgr, "uid", "1000"), "alice"))
+	assert(t, len(findUsers(t, queryMgr, "uid", "1000", "name", "bob")) == 0)
+	assert(t, equalNames(findUsers(t, queryMgr, "gid", "ne:0", "gid", "notgt:1000"), "daemon", "alice"))
+
+	assert(t, equalNames(findUsers(t, queryMgr, "home", "prefix:/home/"), "alice", "bob"))
+	assert(t, equalNames(findUsers(t, queryMgr, "shell", "suffix:sh"), "root", "alice"))
+	assert(t, equalNames(findUsers(t, queryMgr, "shell", "glob:*/nologin"), "daemon", "nobody"))
+	assert(t, equalNames(findUsers(t, queryMgr, "shell", "notglob:*/nologin", "shell", "ne:/usr/bin/false"),
+		"root", "alice"))
+	assert(t, equalNames(findUsers(t, queryMgr, "name", "regex:^(root|bob)$"), "root", "bob"))
+	assert(t, equalNames(findUsers(t, queryMgr, "comment", "ieq:ALICE"), "alice"))
+	assert(t, equalNames(findUsers(t, queryMgr, "comment", "iregex:^b"), "bob"))
+	assert(t, equalNames(findUsers(t, queryMgr, "home", "iprefix:/HOME"), "alice", "bob"))
+	assert(t, equalNames(findUsers(t, queryMgr, "comment", "eq:"), "root", "daemon", "nobody"))
+}
+
+func TestFindGroups(t *testing.T) {
+	queryMgr := newQueryManager(t)
+	find := func(pairs ...string) []string {
+		var conds []*Condition
+		for i := 0; i < len(pairs); i += 2 {
+			cond, err := ParseGroupCondition(pairs[i], pairs[i+1])
+			assert(t, err == nil)
+			conds = append(conds, cond)
+		}
+		var res []string
+		for _, g := range queryMgr.FindGroups(conds) {
+			res = append(res, g.Name)
+		}
+		return res
+	}
+
+	assert(t, equalNames(find("member", "alice", "member", "bob"), "docker"))
+	assert(t, equalNames(find("member", "ne:alice"), "root", "alice"))
+	assert(t, equalNames(find("member", "prefix:b", "admin", "alice"), "docker"))
+	assert(t, equalNames(find("gid", "gt:0", "name", "iglob:A*"), "alice"))
+	assert(t, equalNames(find("gid", "998", "name", "docker"), "docker"))
+	assert(t, len(find("gid", "999")) == 0)
+}
+
+func TestFindDuplicateIDs(t *testing.T) {
+	src := &staticSource{
+		users: []*User{
+			&User{Name: "root", UID: 0, GID: 0, Shell: "/bin/bash"},
+			&User{Name: "toor", UID: 0, GID: 0, Shell: "/bin/sh"},
+			&User{Name: "alice", UID: 1000, GID: 1000},
+		},
+		groups: []*Group{
+			&Group{Name: "wheel", GID: 0, Members: []string{}},
+			&Group{Name: "root", GID: 0, Members: []string{"alice"}},
+		},
+	}
+	queryMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	// the lookup of a UID finds the same users as a scan
+	assert(t, equalNames(findUsers(t, queryMgr, "uid", "0"), "root", "toor"))
+	assert(t, equalNames(findUsers(t, queryMgr, "uid", "gte:0", "uid", "lte:0"), "root", "toor"))
+	assert(t, equalNames(findUsers(t, queryMgr, "uid", "0", "shell", "/bin/sh"), "toor"))
+
+	cond, err := ParseGroupCondition("gid", "0")
+	assert(t, err == nil)
+	groups := queryMgr.FindGroups([]*Condition{cond})
+	assert(t, len(groups) == 2 && groups[0].Name == "wheel" && groups[1].Name == "root")
+
+	// the exact queries too
+	assert(t, len(queryMgr.GetUserByQuery("", "0", "", "", "", "")) == 2)
+	assert(t, len(queryMgr.GetUserByQuery("toor", " 0", "", "", "", "")) == 1)
+	assert(t, len(queryMgr.GetUserByQuery("", "root", "", "", "", "")) == 0)
+	assert(t, len(queryMgr.GetGroupByQuery("", "0", nil, nil)) == 2)
+	assert(t, len(queryMgr.GetGroupByQuery("", "0", []string{"alice"}, nil)) == 1)
+}
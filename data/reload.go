@@ -0,0 +1,216 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ReloadState is the outcome of the reload of a file
+type ReloadState string
+
+const (
+	// ReloadOK means the file is read
+	ReloadOK ReloadState = "ok"
+	// ReloadFailed means the file could not be read, the previous users or groups keep being served
+	ReloadFailed ReloadState = "failed"
+	// ReloadSkipped means the file is not read, as an earlier file of the same kind has failed
+	ReloadSkipped ReloadState = "skipped"
+)
+
+// FileReload is the outcome of the reload of a file, or of a Source that is not made of files
+type FileReload struct {
+	// Path is the path of the file, or the name of the Source
+	Path string `json:"path"`
+	// Kind is either EventKindUser or EventKindGroup
+	Kind  string      `json:"kind"`
+	State ReloadState `json:"state"`
+	Error string      `json:"error,omitempty"`
+}
+
+// ReloadResult is the outcome of Reload
+type ReloadResult struct {
+	// OK is true when every file is read
+	OK bool `json:"ok"`
+	// Changed is true when the users or groups have changed, i.e. the generation has been incremented
+	Changed bool `json:"changed"`
+	// Version is the content served after the reload
+	Version *Version      `json:"version"`
+	Files   []*FileReload `json:"files"`
+}
+
+// ConfigReload is called by Reload to apply the configuration changes. It returns the sources to serve from
+// now on, or nil to keep the current ones. applied, if not nil, is called once the sources are served, so that
+// the settings of sources failing to start are tried again by the next Reload.
+type ConfigReload func() (sources []Source, applied func(), err error)
+
+// WithConfigReload makes Reload call reload before reading the sources
+func WithConfigReload(reload ConfigReload) ManagerOption {
+	return func(m *manager) {
+		m.configReload = reload
+	}
+}
+
+// fileError is the failure of a Source to read a file
+type fileError struct {
+	path string
+	err  error
+}
+
+func (e *fileError) Error() string {
+	return e.err.Error()
+}
+
+// loadError is the failure of a Source to load either its users or its groups
+type loadError struct {
+	source Source
+	kind   string
+	err    error
+}
+
+func (e *loadError) Error() string {
+	return fmt.Sprintf("Fail to load %ss from %s: %s", e.kind, e.source.Name(), e.err)
+}
+
+func (e *loadError) Unwrap() error {
+	return e.err
+}
+
+// fileLister is implemented by the sources reading files, so that Reload reports the outcome of every file
+type fileLister interface {
+	// files returns the files of the users or groups, depending on kind, in reading order
+	files(kind string) ([]string, error)
+}
+
+func (s *fileSource) files(kind string) ([]string, error) {
+	if kind == EventKindUser {
+		res, err := listFiles(s.passwdFilePath, s.extraPasswdFilePaths, s.passwdDropInDir)
+		if err == nil && len(s.shadowFilePath) > 0 {
+			res = append(res, s.shadowFilePath)
+		}
+		return res, err
+	}
+	res, err := listFiles(s.groupFilePath, s.extraGroupFilePaths, s.groupDropInDir)
+	if err == nil && len(s.gshadowFilePath) > 0 {
+		res = append(res, s.gshadowFilePath)
+	}
+	return res, err
+}
+
+func (m *manager) Reload(ctx context.Context) (*ReloadResult, error) {
+	// the manual reloads are serialized, but the reloads notified by the sources carry on meanwhile
+	select {
+	case m.manualReload <- struct{}{}:
+		defer func() { <-m.manualReload }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if m.configReload != nil {
+		sources, applied, err := m.configReload()
+		if err != nil {
+			return nil, fmt.Errorf("Fail to reload the configuration: %s", err)
+		}
+		if sources != nil {
+			if err = m.replaceSources(sources); err != nil {
+				return nil, err
+			}
+		}
+		if applied != nil {
+			applied()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	previous := m.current().version.Generation
+	userErr, groupErr := m.reload(UserChange | GroupChange)
+
+	sources := m.getSources()
+	res := &ReloadResult{
+		OK:      userErr == nil && groupErr == nil,
+		Version: m.current().Version(),
+		Files:   reloadReport(sources, EventKindUser, userErr),
+	}
+	res.Changed = res.Version.Generation != previous
+	res.Files = append(res.Files, reloadReport(sources, EventKindGroup, groupErr)...)
+	log.Printf("Reloaded generation %d, ok: %t, changed: %t\n", res.Version.Generation, res.OK, res.Changed)
+	return res, nil
+}
+
+// replaceSources serves the users and groups of sources from the next reload on. If the Manager is started,
+// the new sources are started first and the replaced ones are only stopped once all of them are, otherwise
+// the new ones are stopped and the current ones keep being served.
+func (m *manager) replaceSources(sources []Source) error {
+	m.sourceLock.Lock()
+	started := m.started
+	m.sourceLock.Unlock()
+
+	if started {
+		for i, src := range sources {
+			log.Println("Start monitoring source ", src.Name())
+			if err := src.Start(m.handleChange); err != nil {
+				for _, startedSrc := range sources[:i] {
+					log.Println("Stop monitoring source ", startedSrc.Name())
+					startedSrc.Stop()
+				}
+				return fmt.Errorf("Fail to start the source %s: %s", src.Name(), err)
+			}
+		}
+	}
+
+	m.sourceLock.Lock()
+	previous := m.sources
+	m.sources = sources
+	m.sourceLock.Unlock()
+
+	if started {
+		for _, src := range previous {
+			log.Println("Stop monitoring source ", src.Name())
+			src.Stop()
+		}
+	}
+	return nil
+}
+
+// reloadReport returns the outcome of the files of the sources of kind, given the error of their reload
+func reloadReport(sources []Source, kind string, err error) []*FileReload {
+	var failed *loadError
+	errors.As(err, &failed)
+
+	var res []*FileReload
+	state := ReloadOK
+	for _, src := range sources {
+		paths := []string{src.Name()}
+		if lister, ok := src.(fileLister); ok {
+			if files, listErr := lister.files(kind); listErr == nil {
+				paths = files
+			}
+		}
+
+		sourceFailed := failed != nil && failed.source == src
+		// the files before the failed one are read, the ones after are skipped. When no file is at fault,
+		// e.g. a name in conflict, all the files of the Source are failed.
+		var failedFile *fileError
+		fileFailed := sourceFailed && errors.As(failed.err, &failedFile)
+		for _, path := range paths {
+			entry := &FileReload{Path: path, Kind: kind, State: state}
+			if sourceFailed && (!fileFailed || failedFile.path == path) {
+				entry.State = ReloadFailed
+				entry.Error = failed.err.Error()
+			}
+			res = append(res, entry)
+			if entry.State == ReloadFailed && fileFailed {
+				state = ReloadSkipped
+			}
+		}
+		if sourceFailed {
+			state = ReloadSkipped
+		}
+	}
+	return res
+}
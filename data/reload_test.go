@@ -0,0 +1,154 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManualReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	for _, path := range []string{originalPasswdPath, originalGroupPath} {
+		b, err := ioutil.ReadFile(path)
+		assert(t, err == nil)
+		assert(t, ioutil.WriteFile(filepath.Join(dir, filepath.Base(path)), b, 0644) == nil)
+	}
+	passwdPath, groupPath := filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	extraPaths := []string{filepath.Join(dir, "passwd.1"), filepath.Join(dir, "passwd.2")}
+	for _, path := range extraPaths {
+		assert(t, ioutil.WriteFile(path, []byte("app:*:2000:2000::/srv/app:/bin/sh\n"), 0644) == nil)
+	}
+	src, err := NewFileSource(passwdPath, groupPath, WithExtraPasswdFiles(extraPaths...))
+	assert(t, err == nil)
+
+	var configSources []Source
+	var configErr error
+	reloadMgr, err := NewManager([]Source{src}, WithConfigReload(func() ([]Source, func(), error) {
+		return configSources, nil, configErr
+	}))
+	assert(t, err == nil)
+
+	res, err := reloadMgr.Reload(context.Background())
+	assert(t, err == nil)
+	assert(t, res.OK && !res.Changed && res.Version.Generation == 1)
+	assert(t, len(res.Files) == 4)
+	assert(t, res.Files[0].Path == passwdPath && res.Files[0].Kind == EventKindUser)
+	assert(t, res.Files[3].Path == groupPath && res.Files[3].Kind == EventKindGroup)
+	for _, f := range res.Files {
+		assert(t, f.State == ReloadOK && len(f.Error) == 0)
+	}
+
+	// the files after the failed one are skipped, and the previous users keep being served
+	assert(t, ioutil.WriteFile(extraPaths[0], []byte("broken\n"), 0644) == nil)
+	res, err = reloadMgr.Reload(context.Background())
+	assert(t, err == nil)
+	assert(t, !res.OK && !res.Changed)
+	assert(t, res.Files[0].State == ReloadOK)
+	assert(t, res.Files[1].State == ReloadFailed && strings.Contains(res.Files[1].Error, extraPaths[0]))
+	assert(t, res.Files[2].State == ReloadSkipped)
+	assert(t, res.Files[3].State == ReloadOK)
+	assert(t, reloadMgr.Status().Users.Degraded && !reloadMgr.Status().Groups.Degraded)
+	assert(t, reloadMgr.GetUserByUID(2000) != nil)
+
+	// the sources returned by the configuration are served from now on
+	assert(t, ioutil.WriteFile(extraPaths[0], []byte("app:*:2001:2000::/srv/app:/bin/sh\n"), 0644) == nil)
+	src, err = NewFileSource(passwdPath, groupPath, WithExtraPasswdFiles(extraPaths[0]))
+	assert(t, err == nil)
+	configSources = []Source{src}
+	res, err = reloadMgr.Reload(context.Background())
+	assert(t, err == nil)
+	assert(t, res.OK && res.Changed && res.Version.Generation == 2)
+	assert(t, len(res.Files) == 3)
+	assert(t, reloadMgr.GetUserByUID(2000) == nil && reloadMgr.GetUserByUID(2001) != nil)
+	assert(t, !reloadMgr.Status().Degraded)
+
+	// nothing is read when the configuration fails
+	configSources, configErr = nil, errors.New("invalid configuration")
+	_, err = reloadMgr.Reload(context.Background())
+	assert(t, err != nil && strings.Contains(err.Error(), "invalid configuration"))
+
+	configErr = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = reloadMgr.Reload(ctx)
+	assert(t, err == context.Canceled)
+}
+
+// startSource is a staticSource that might fail to start
+type startSource struct {
+	staticSource
+	startErr error
+	running  bool
+}
+
+func (s *startSource) Start(notify func(change Change)) error {
+	if s.startErr != nil {
+		return s.startErr
+	}
+	s.running = true
+	return nil
+}
+
+func (s *startSource) Stop() {
+	s.running = false
+}
+
+func TestReplaceSources(t *testing.T) {
+	previous := &startSource{staticSource: staticSource{users: []*User{&User{Name: "root", UID: 0, GID: 0}}}}
+	good := &startSource{staticSource: staticSource{users: []*User{&User{Name: "alice", UID: 1000, GID: 1000}}}}
+	bad := &startSource{startErr: errors.New("unreachable")}
+	applied := 0
+	replaceMgr, err := NewManager([]Source{previous}, WithConfigReload(func() ([]Source, func(), error) {
+		return []Source{good, bad}, func() { applied++ }, nil
+	}))
+	assert(t, err == nil)
+	assert(t, replaceMgr.Start() == nil)
+	defer replaceMgr.Stop()
+	assert(t, previous.running)
+
+	// the new sources are stopped and the previous one keeps being served
+	_, err = replaceMgr.Reload(context.Background())
+	assert(t, err != nil && strings.Contains(err.Error(), "unreachable"))
+	assert(t, previous.running && !good.running && !bad.running)
+	assert(t, applied == 0)
+	assert(t, replaceMgr.GetUserByUID(0) != nil && replaceMgr.GetUserByUID(1000) == nil)
+
+	// the next reload tries again
+	bad.startErr = nil
+	res, err := replaceMgr.Reload(context.Background())
+	assert(t, err == nil && res.Changed)
+	assert(t, !previous.running && good.running && bad.running)
+	assert(t, applied == 1)
+	assert(t, replaceMgr.GetUserByUID(0) == nil && replaceMgr.GetUserByUID(1000) != nil)
+}
+
+func TestReloadReport(t *testing.T) {
+	src := &flakySource{}
+	src.users = []*User{&User{Name: "root", UID: 0, GID: 0}}
+	flakyMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	// a Source without files is reported by its name
+	src.err = errors.New("broken")
+	res, err := flakyMgr.Reload(context.Background())
+	assert(t, err == nil)
+	assert(t, !res.OK && len(res.Files) == 2)
+	assert(t, res.Files[0].Path == src.Name() && res.Files[0].State == ReloadFailed)
+	assert(t, strings.Contains(res.Files[0].Error, "broken"))
+	assert(t, res.Files[1].Kind == EventKindGroup && res.Files[1].State == ReloadFailed)
+
+	// the sources after the failed one are skipped
+	other := &staticSource{}
+	report := reloadReport([]Source{src, other}, EventKindUser,
+		&loadError{source: src, kind: EventKindUser, err: src.err})
+	assert(t, len(report) == 2 && report[1].State == ReloadSkipped && len(report[1].Error) == 0)
+	report = reloadReport([]Source{other, src}, EventKindUser,
+		&loadError{source: src, kind: EventKindUser, err: src.err})
+	assert(t, report[0].State == ReloadOK && report[1].State == ReloadFailed)
+}
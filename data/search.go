@@ -0,0 +1,172 @@
+package data
+
+import (
+	"strings"
+)
+
+// scanIndex is the index of the searches evaluating every entry
+const scanIndex = "scan"
+
+// SearchPlan explains how a search is evaluated
+type SearchPlan struct {
+	// Expression is the expression as parsed, fully parenthesized
+	Expression string `json:"expression"`
+	// Index is the field looked up to find the candidates, e.g. uid, or scan if every entry is evaluated. A
+	// field is only looked up when the expression requires it to be equal to a value.
+	Index string `json:"index"`
+	// Key is the value looked up, omitted for a scan
+	Key string `json:"key,omitempty"`
+	// Candidates is the number of entries evaluated, Matches the number of them matching the expression
+	Candidates int `json:"candidates"`
+	Matches    int `json:"matches"`
+}
+
+// lookup returns the comparison requiring field to be equal to a value for root to be true, i.e. one of the
+// conditions joined by and at the top of root
+func lookup(root node, field string) *compareNode {
+	switch n := root.(type) {
+	case *logicalNode:
+		if !n.and {
+			return nil
+		}
+		if res := lookup(n.left, field); res != nil {
+			return res
+		}
+		return lookup(n.right, field)
+	case *compareNode:
+		if n.field == field && n.op == "==" {
+			return n
+		}
+	}
+	return nil
+}
+
+// eval tells whether entry, a user or a group of s, makes n true
+func eval(n node, s *snapshot, entry interface{}) bool {
+	switch n := n.(type) {
+	case *logicalNode:
+		if n.and {
+			return eval(n.left, s, entry) && eval(n.right, s, entry)
+		}
+		return eval(n.left, s, entry) || eval(n.right, s, entry)
+	case *notNode:
+		return !eval(n.operand, s, entry)
+	case *compareNode:
+		return n.eval(entry)
+	case *callNode:
+		return n.eval(s, entry)
+	}
+	return false
+}
+
+func (n *compareNode) eval(entry interface{}) bool {
+	if n.def.typ == typeInt {
+		id := n.def.number(entry)
+		switch n.op {
+		case "==":
+			return id == n.value.number
+		case "!=":
+			return id != n.value.number
+		case "<":
+			return id < n.value.number
+		case "<=":
+			return id <= n.value.number
+		case ">":
+			return id > n.value.number
+		}
+		return id >= n.value.number
+	}
+
+	text := n.def.text(entry)
+	switch n.op {
+	case "==":
+		return text == n.value.text
+	case "!=":
+		return text != n.value.text
+	case "=~":
+		return n.pattern.MatchString(text)
+	}
+	return !n.pattern.MatchString(text)
+}
+
+func (n *callNode) eval(s *snapshot, entry interface{}) bool {
+	switch n.name {
+	case funcStartsWith:
+		return strings.HasPrefix(n.args[0].def.text(entry), n.args[1].value.text)
+	case funcEndsWith:
+		return strings.HasSuffix(n.args[0].def.text(entry), n.args[1].value.text)
+	case funcGlob:
+		return n.pattern.MatchString(n.args[0].def.text(entry))
+	case funcMemberOf:
+		return s.memberOf(entry.(*User), n.args[0].value)
+	case funcHasMember:
+		_, ok := entry.(*Group).memberSet[n.args[0].value.text]
+		return ok
+	case funcHasAdmin:
+		_, ok := entry.(*Group).adminSet[n.args[0].value.text]
+		return ok
+	}
+	return false
+}
+
+// memberOf tells whether user belongs to the group, given by its GID or name, either as the primary group or
+// as a member of any of the groups sharing the GID or name. A GID without a group entry is only the primary
+// group of its users.
+func (s *snapshot) memberOf(user *User, group *literal) bool {
+	groups := s.group.groupMapByName[group.text]
+	if group.typ == typeInt {
+		if user.GID == group.number {
+			return true
+		}
+		groups = s.group.groupsByID[group.number]
+	}
+
+	for _, g := range groups {
+		if _, ok := g.memberSet[user.Name]; ok || user.GID == g.GID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *snapshot) SearchUsers(expr *UserExpression) ([]*User, *SearchPlan) {
+	plan := &SearchPlan{Expression: expr.String(), Index: scanIndex}
+	candidate := s.user.userSlice
+	if n := lookup(expr.root, "uid"); n != nil {
+		plan.Index, plan.Key = n.field, n.value.text
+		candidate = s.user.usersByID[n.value.number]
+	} else if n = lookup(expr.root, "name"); n != nil {
+		plan.Index, plan.Key = n.field, n.value.text
+		candidate = s.user.userMapByName[n.value.text]
+	}
+
+	var res []*User
+	for _, u := range candidate {
+		if eval(expr.root, s, u) {
+			res = append(res, u)
+		}
+	}
+	plan.Candidates, plan.Matches = len(candidate), len(res)
+	return res, plan
+}
+
+func (s *snapshot) SearchGroups(expr *GroupExpression) ([]*Group, *SearchPlan) {
+	plan := &SearchPlan{Expression: expr.String(), Index: scanIndex}
+	candidate := s.group.groupSlice
+	if n := lookup(expr.root, "gid"); n != nil {
+		plan.Index, plan.Key = n.field, n.value.text
+		candidate = s.group.groupsByID[n.value.number]
+	} else if n = lookup(expr.root, "name"); n != nil {
+		plan.Index, plan.Key = n.field, n.value.text
+		candidate = s.group.groupMapByName[n.value.text]
+	}
+
+	var res []*Group
+	for _, g := range candidate {
+		if eval(expr.root, s, g) {
+			res = append(res, g)
+		}
+	}
+	plan.Candidates, plan.Matches = len(candidate), len(res)
+	return res, plan
+}
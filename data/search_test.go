@@ -0,0 +1,117 @@
+package data
+
+import (
+	"testing"
+)
+
+func TestSearchUsers(t *testing.T) {
+	searchMgr := newQueryManager(t)
+	search := func(src string) ([]string, *SearchPlan) {
+		expr, err := ParseUserExpression(src)
+		assert(t, err == nil)
+		users, plan := searchMgr.SearchUsers(expr)
+		var res []string
+		for _, u := range users {
+			res = append(res, u.Name)
+		}
+		return res, plan
+	}
+
+	names, plan := search(`uid >= 1000 and shell != "/usr/sbin/nologin" and memberOf("docker")`)
+	assert(t, equalNames(names, "alice", "bob"))
+	assert(t, plan.Index == scanIndex && len(plan.Key) == 0 && plan.Candidates == 5 && plan.Matches == 2)
+
+	// memberOf covers the primary group, by name or GID
+	names, _ = search(`memberOf("alice") or memberOf(0)`)
+	assert(t, equalNames(names, "root", "alice"))
+	names, _ = search(`memberOf(1001)`)
+	assert(t, equalNames(names, "bob"))
+
+	names, _ = search(`not (shell =~ "nologin$" or glob(shell, "*/false")) and !startsWith(home, "/root")`)
+	assert(t, equalNames(names, "alice"))
+	names, _ = search(`endsWith(home, "bob") || comment !~ "."`)
+	assert(t, equalNames(names, "root", "daemon", "bob", "nobody"))
+
+	// an exact match on uid or name is looked up
+	names, plan = search(`shell == "/bin/zsh" and uid == 1000`)
+	assert(t, equalNames(names, "alice"))
+	assert(t, plan.Index == "uid" && plan.Key == "1000" && plan.Candidates == 1 && plan.Matches == 1)
+	names, plan = search(`name == "bob" and uid > 0`)
+	assert(t, equalNames(names, "bob") && plan.Index == "name" && plan.Key == "bob")
+	_, plan = search(`name == "bob" or uid == 0`)
+	assert(t, plan.Index == scanIndex)
+	names, plan = search(`uid == 4242`)
+	assert(t, len(names) == 0 && plan.Candidates == 0)
+}
+
+func TestSearchGroups(t *testing.T) {
+	searchMgr := newQueryManager(t)
+	search := func(src string) ([]string, *SearchPlan) {
+		expr, err := ParseGroupExpression(src)
+		assert(t, err == nil)
+		groups, plan := searchMgr.SearchGroups(expr)
+		var res []string
+		for _, g := range groups {
+			res = append(res, g.Name)
+		}
+		return res, plan
+	}
+
+	names, plan := search(`hasMember("bob") and hasAdmin("alice")`)
+	assert(t, equalNames(names, "docker") && plan.Index == scanIndex)
+	names, _ = search(`not hasMember("bob") and gid < 1000`)
+	assert(t, equalNames(names, "root"))
+	names, plan = search(`gid == 1000 and name =~ "^a"`)
+	assert(t, equalNames(names, "alice") && plan.Index == "gid" && plan.Key == "1000")
+}
+
+func TestSearchDuplicateIDs(t *testing.T) {
+	src := &staticSource{
+		users: []*User{
+			&User{Name: "root", UID: 0, GID: 0},
+			&User{Name: "toor", UID: 0, GID: 0},
+			&User{Name: "alice", UID: 1000, GID: 1000},
+		},
+		groups: []*Group{
+			&Group{Name: "staff", GID: 50, Members: []string{}},
+			&Group{Name: "admin", GID: 50, Members: []string{"alice"}},
+			&Group{Name: "alice", GID: 1000, Members: []string{}},
+		},
+	}
+	searchMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	searchUsers := func(src string) ([]string, *SearchPlan) {
+		expr, err := ParseUserExpression(src)
+		assert(t, err == nil)
+		users, plan := searchMgr.SearchUsers(expr)
+		var res []string
+		for _, u := range users {
+			res = append(res, u.Name)
+		}
+		return res, plan
+	}
+	searchGroups := func(src string) ([]string, *SearchPlan) {
+		expr, err := ParseGroupExpression(src)
+		assert(t, err == nil)
+		groups, plan := searchMgr.SearchGroups(expr)
+		var res []string
+		for _, g := range groups {
+			res = append(res, g.Name)
+		}
+		return res, plan
+	}
+
+	// the lookup of an ID finds the same entries as a scan
+	names, plan := searchUsers(`uid == 0`)
+	assert(t, equalNames(names, "root", "toor") && plan.Index == "uid" && plan.Candidates == 2)
+	names, plan = searchUsers(`uid <= 0 and uid >= 0`)
+	assert(t, equalNames(names, "root", "toor") && plan.Index == scanIndex)
+	names, plan = searchGroups(`gid == 50`)
+	assert(t, equalNames(names, "staff", "admin") && plan.Index == "gid" && plan.Candidates == 2)
+	names, plan = searchGroups(`gid <= 50 and gid >= 50`)
+	assert(t, equalNames(names, "staff", "admin") && plan.Index == scanIndex)
+
+	// a member of any of the groups of a GID is a member of the GID
+	names, _ = searchUsers(`memberOf(50)`)
+	assert(t, equalNames(names, "alice"))
+}
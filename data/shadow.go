@@ -0,0 +1,152 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shadow file offset
+const (
+	shadowNameOffset = iota
+	shadowPasswordOffset
+	lastChangeOffset
+	minDaysOffset
+	maxDaysOffset
+	warnDaysOffset
+	inactiveDaysOffset
+	expireOffset
+)
+
+const (
+	numberOfFieldShadowEntry = 9
+	// ShadowFieldDisabled is the value of a numeric field of Shadow which is empty in the shadow file, meaning
+	// the feature is disabled
+	ShadowFieldDisabled = -1
+
+	secondsPerDay    = 24 * 60 * 60
+	lastChangeLayout = "2006-01-02"
+)
+
+// Account is the status of a user account derived from the shadow file
+type Account struct {
+	// Locked is true when the password starts with "!" or "*", i.e. no password can be used to login
+	Locked bool `json:"locked"`
+	// PasswordExpired is true when the maximum password age has passed, or when the password must be changed
+	// at the next login
+	PasswordExpired bool `json:"passwordExpired"`
+	// AccountExpired is true when the expiration date of the account has passed
+	AccountExpired bool `json:"accountExpired"`
+	// DaysUntilExpiry is the number of days before either the password or the account expires, whichever
+	// comes first. It is negative once expired and omitted when neither ever expires
+	DaysUntilExpiry *int `json:"daysUntilExpiry,omitempty"`
+	// LastChange is the date of the last password change in the format of YYYY-MM-DD. It is omitted when
+	// password aging is disabled or the password must be changed at the next login
+	LastChange string `json:"lastChange,omitempty"`
+}
+
+// Shadow is the password aging information of a user, as read from the /etc/shadow file, along with whether
+// the password is locked. The file is redacted, see parseLines.
+type Shadow struct {
+	Name   string
+	Locked bool
+	// LastChange is the date of the last password change in days since Jan 1, 1970, or ShadowFieldDisabled.
+	// 0 means the password must be changed at the next login
+	LastChange int
+	// MaxDays is the maximum password age in days, or ShadowFieldDisabled
+	MaxDays int
+	// Expire is the expiration date of the account in days since Jan 1, 1970, or ShadowFieldDisabled. Like
+	// login, 0 is ignored as shadow(5) tells it is ambiguous.
+	Expire int
+}
+
+func parseShadowDays(field string) (int, error) {
+	field = strings.TrimSpace(field)
+	if len(field) == 0 {
+		return ShadowFieldDisabled, nil
+	}
+	return strconv.Atoi(field)
+}
+
+func parseShadow(line string) (*Shadow, error) {
+	strList := strings.Split(strings.TrimSpace(line), fieldDelim)
+	if len(strList) != numberOfFieldShadowEntry {
+		// the file is redacted, see parseLines
+		return nil, fmt.Errorf("Malformed shadow entry with %d fields", len(strList))
+	}
+
+	name := strings.TrimSpace(strList[shadowNameOffset])
+	password := strings.TrimSpace(strList[shadowPasswordOffset])
+	res := &Shadow{
+		Name:   name,
+		Locked: strings.HasPrefix(password, "!") || strings.HasPrefix(password, "*"),
+	}
+
+	var err error
+	for _, field := range []struct {
+		offset int
+		value  *int
+	}{
+		{lastChangeOffset, &res.LastChange},
+		{maxDaysOffset, &res.MaxDays},
+		{expireOffset, &res.Expire},
+	} {
+		if *field.value, err = parseShadowDays(strList[field.offset]); err != nil {
+			return nil, fmt.Errorf("Invalid number %s in the shadow entry of %s", strList[field.offset], name)
+		}
+	}
+	return res, nil
+}
+
+func parseShadowFile(shadowFilePath string, lenient bool) ([]*Shadow, []*Diagnostic, error) {
+	res := make([]*Shadow, 0)
+	diagnostics, err := parseLines(shadowFilePath, lenient, true, func(line string) error {
+		entry, err := parseShadow(line)
+		if err != nil {
+			return err
+		}
+		res = append(res, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, diagnostics, nil
+}
+
+// newAccount derives the status of the account of entry at time now
+func newAccount(entry *Shadow, now time.Time) *Account {
+	today := int(now.Unix() / secondsPerDay)
+	res := &Account{
+		Locked: entry.Locked,
+	}
+
+	expiry := ShadowFieldDisabled
+	switch {
+	case entry.LastChange == 0:
+		// the password must be changed at the next login
+		res.PasswordExpired = true
+		expiry = today
+	case entry.LastChange > 0:
+		res.LastChange = time.Unix(int64(entry.LastChange)*secondsPerDay, 0).UTC().Format(lastChangeLayout)
+		if entry.MaxDays >= 0 {
+			expiry = entry.LastChange + entry.MaxDays
+			res.PasswordExpired = today >= expiry
+		}
+	}
+
+	// like isexpired() of shadow-utils
+	if entry.Expire > 0 {
+		res.AccountExpired = today >= entry.Expire
+		if expiry == ShadowFieldDisabled || entry.Expire < expiry {
+			expiry = entry.Expire
+		}
+	}
+
+	if expiry != ShadowFieldDisabled {
+		days := expiry - today
+		res.DaysUntilExpiry = &days
+	}
+	return res
+}
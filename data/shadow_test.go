@@ -0,0 +1,76 @@
+package data
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseShadow(t *testing.T) {
+	entry, err := parseShadow("root:$6$salt$hash:18000:0:99999:7:::")
+	assert(t, err == nil)
+	assert(t, entry.Name == "root")
+	assert(t, !entry.Locked)
+	assert(t, entry.LastChange == 18000)
+	assert(t, entry.MaxDays == 99999)
+	assert(t, entry.Expire == ShadowFieldDisabled)
+
+	entry, err = parseShadow("daemon:!$6$salt$hash:18000:0:30:7::18100:")
+	assert(t, err == nil)
+	assert(t, entry.Locked)
+	assert(t, entry.Expire == 18100)
+
+	entry, err = parseShadow("nobody:*:::::::")
+	assert(t, err == nil)
+	assert(t, entry.Locked)
+	assert(t, entry.LastChange == ShadowFieldDisabled)
+
+	_, err = parseShadow("root:$6$salt$hash:18000:0:99999:7::")
+	assert(t, err != nil)
+	// the password hash must never end up in the error
+	_, err = parseShadow("root:$6$salt$hash:abc:0:99999:7:::")
+	assert(t, err != nil)
+	assert(t, !strings.Contains(err.Error(), "$6$salt$hash"))
+}
+
+func TestNewAccount(t *testing.T) {
+	day := func(days int) time.Time {
+		return time.Unix(int64(days)*secondsPerDay+3600, 0)
+	}
+
+	entry := &Shadow{Name: "daemon", Locked: true, LastChange: 18000, MaxDays: 30, Expire: 18100}
+	account := newAccount(entry, day(18010))
+	assert(t, account.Locked)
+	assert(t, !account.PasswordExpired)
+	assert(t, !account.AccountExpired)
+	assert(t, *account.DaysUntilExpiry == 20)
+	assert(t, account.LastChange == "2019-04-14")
+
+	account = newAccount(entry, day(18030))
+	assert(t, account.PasswordExpired)
+	assert(t, !account.AccountExpired)
+	assert(t, *account.DaysUntilExpiry == 0)
+
+	// the account expires before the password
+	entry.MaxDays = 200
+	account = newAccount(entry, day(18100))
+	assert(t, !account.PasswordExpired)
+	assert(t, account.AccountExpired)
+	assert(t, *account.DaysUntilExpiry == 0)
+
+	entry = &Shadow{Name: "_uucp", LastChange: 0, MaxDays: ShadowFieldDisabled, Expire: ShadowFieldDisabled}
+	account = newAccount(entry, day(18010))
+	assert(t, account.PasswordExpired)
+	assert(t, len(account.LastChange) == 0)
+
+	entry = &Shadow{Name: "_taskgated", LastChange: ShadowFieldDisabled, MaxDays: ShadowFieldDisabled,
+		Expire: ShadowFieldDisabled}
+	account = newAccount(entry, day(18010))
+	assert(t, !account.Locked && !account.PasswordExpired && !account.AccountExpired)
+	assert(t, account.DaysUntilExpiry == nil)
+
+	// an expiration date of 0 is ignored, as by login
+	entry.Expire = 0
+	account = newAccount(entry, day(18010))
+	assert(t, !account.AccountExpired && account.DaysUntilExpiry == nil)
+}
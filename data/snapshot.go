@@ -0,0 +1,190 @@
+package data
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshot is the content served by the Manager at a version. It is immutable, so that it is read
+// without any lock.
+type snapshot struct {
+	version Version
+	user    *userData
+	group   *groupData
+	// at is the time the accounts are evaluated at, the current time if zero
+	at time.Time
+}
+
+// atTime returns a copy of s evaluating the accounts at t
+func (s *snapshot) atTime(t time.Time) *snapshot {
+	res := *s
+	res.at = t
+	return &res
+}
+
+func (s *snapshot) GetAllUsers() []*User {
+	return s.user.userSlice
+}
+
+// parseID converts the textual form of a UID or GID into its numeric value
+func parseID(id string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(id))
+}
+
+// exactConditions parses the conditions requiring the fields of pairs, each field followed by its value, to be
+// equal to the values. The empty values are ignored. It returns false if a value can never match, e.g. a uid
+// which is not an integer.
+func exactConditions(parse func(field, expr string) (*Condition, error), pairs ...string) ([]*Condition, bool) {
+	var res []*Condition
+	for i := 0; i < len(pairs); i += 2 {
+		if len(pairs[i+1]) == 0 {
+			continue
+		}
+		// the explicit operator keeps a value with a separator as it is
+		cond, err := parse(pairs[i], string(OpEqual)+operatorSeparator+pairs[i+1])
+		if err != nil {
+			return nil, false
+		}
+		res = append(res, cond)
+	}
+	return res, true
+}
+
+// GetUserByQuery is FindUsers with exact matches only
+func (s *snapshot) GetUserByQuery(name, uid, gid, comment, home, shell string) []*User {
+	conds, ok := exactConditions(ParseUserCondition, "name", name, "uid", uid, "gid", gid, "comment", comment,
+		"home", home, "shell", shell)
+	if !ok {
+		return nil
+	}
+	return s.FindUsers(conds)
+}
+
+func (s *snapshot) GetUserByUID(uid int) *User {
+	return s.user.userMapByID[uid]
+}
+
+func (s *snapshot) GetUsersByName(name string) []*User {
+	return s.user.userMapByName[name]
+}
+
+func (s *snapshot) GetAccountByUID(uid int) *Account {
+	user := s.user.userMapByID[uid]
+	if user == nil {
+		return nil
+	}
+	entry := s.user.shadowMapByName[user.Name]
+	if entry == nil {
+		return nil
+	}
+	now := s.at
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return newAccount(entry, now)
+}
+
+func (s *snapshot) GetGroupsByUID(uid int) []*UserGroup {
+	var res []*UserGroup
+
+	user := s.GetUserByUID(uid)
+	if user == nil {
+		return res
+	}
+
+	// Like `id -G`, the primary GID is reported even if there is no entry for it in the group file
+	primary := s.group.groupMapByID[user.GID]
+	if primary == nil {
+		primary = &Group{GID: user.GID, Members: make([]string, 0)}
+	}
+	res = append(res, &UserGroup{Group: primary, Membership: PrimaryMembership})
+
+	for _, g := range s.group.groupSlice {
+		if g.GID == user.GID {
+			continue
+		}
+		if _, ok := g.memberSet[user.Name]; ok {
+			res = append(res, &UserGroup{Group: g, Membership: SupplementaryMembership})
+		}
+	}
+	return res
+}
+
+func (s *snapshot) GetUsersByGID(gid int) *GroupUsers {
+	group := s.group.groupMapByID[gid]
+	res := &GroupUsers{
+		Users:      make([]*GroupMember, 0),
+		Unresolved: make([]string, 0),
+	}
+
+	var primary, supplementary []*GroupMember
+	for _, u := range s.user.userSlice {
+		if u.GID == gid {
+			primary = append(primary, &GroupMember{User: u, Membership: PrimaryMembership})
+			continue
+		}
+		if group == nil {
+			continue
+		}
+		if _, ok := group.memberSet[u.Name]; ok {
+			supplementary = append(supplementary, &GroupMember{User: u, Membership: SupplementaryMembership})
+		}
+	}
+	res.Users = append(append(res.Users, primary...), supplementary...)
+
+	if group != nil {
+		for _, name := range group.Members {
+			if len(s.user.userMapByName[name]) == 0 {
+				res.Unresolved = append(res.Unresolved, name)
+			}
+		}
+	}
+
+	if group == nil && len(res.Users) == 0 {
+		return nil
+	}
+	return res
+}
+
+func (s *snapshot) GetAllGroups() []*Group {
+	return s.group.groupSlice
+}
+
+// GetGroupByQuery is FindGroups with exact matches only
+func (s *snapshot) GetGroupByQuery(name, gid string, members, admins []string) []*Group {
+	pairs := []string{"name", name, "gid", gid}
+	for _, m := range members {
+		pairs = append(pairs, "member", m)
+	}
+	for _, a := range admins {
+		pairs = append(pairs, "admin", a)
+	}
+	conds, ok := exactConditions(ParseGroupCondition, pairs...)
+	if !ok {
+		return nil
+	}
+	return s.FindGroups(conds)
+}
+
+func (s *snapshot) GetGroupByGID(gid int) *Group {
+	return s.group.groupMapByID[gid]
+}
+
+func (s *snapshot) GetGroupsByName(name string) []*Group {
+	return s.group.groupMapByName[name]
+}
+
+func (s *snapshot) GetParseDiagnostics() []*Diagnostic {
+	res := append([]*Diagnostic{}, s.user.diagnostics...)
+	return append(res, s.group.diagnostics...)
+}
+
+func (s *snapshot) Lint() *LintReport {
+	return lint(s.user, s.group)
+}
+
+func (s *snapshot) Version() *Version {
+	res := s.version
+	return &res
+}
@@ -0,0 +1,157 @@
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// togglingSource switches between two generations where the primary group of dwoodlins has another GID, so
+// that mixing the users of one with the groups of the other shows up as a primary group without a name
+type togglingSource struct {
+	staticSource
+	second bool
+}
+
+func newTogglingSource() *togglingSource {
+	src := &togglingSource{}
+	src.toggle()
+	return src
+}
+
+// toggle must not be called concurrently with the loads
+func (s *togglingSource) toggle() {
+	gid := 1001
+	if s.second {
+		gid = 2000
+	}
+	s.second = !s.second
+	s.users = []*User{
+		&User{Name: "root", UID: 0, GID: 0},
+		&User{Name: "dwoodlins", UID: 1001, GID: gid},
+	}
+	s.groups = []*Group{
+		&Group{Name: "wheel", GID: 0, Members: []string{"root", "dwoodlins"}},
+		&Group{Name: "dwoodlins", GID: gid, Members: []string{}},
+	}
+}
+
+// reloadContinuously toggles src and reloads m until stop is closed, the loads of src only happen in it
+func reloadContinuously(m *manager, src *togglingSource, stop chan struct{}, done *sync.WaitGroup) {
+	defer done.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		src.toggle()
+		m.handleChange(UserChange | GroupChange)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	src := newTogglingSource()
+	snapshotMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	reader := snapshotMgr.Snapshot()
+	assert(t, reader.Version().Generation == 1)
+	src.toggle()
+	snapshotMgr.(*manager).handleChange(UserChange | GroupChange)
+	// the snapshot is not affected by the reload
+	assert(t, reader.Version().Generation == 1 && reader.GetUserByUID(1001).GID == 1001)
+	assert(t, reader.GetGroupByGID(2000) == nil)
+	assert(t, snapshotMgr.Version().Generation == 2 && snapshotMgr.GetUserByUID(1001).GID == 2000)
+	assert(t, snapshotMgr.Snapshot().GetGroupByGID(2000) != nil)
+}
+
+func TestSnapshotConsistency(t *testing.T) {
+	src := newTogglingSource()
+	snapshotMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	stop := make(chan struct{})
+	var done sync.WaitGroup
+	done.Add(1)
+	go reloadContinuously(snapshotMgr.(*manager), src, stop, &done)
+
+	var inconsistent int32
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for j := 0; j < 2000; j++ {
+				groups := snapshotMgr.GetGroupsByUID(1001)
+				if len(groups) != 2 || len(groups[0].Name) == 0 {
+					atomic.AddInt32(&inconsistent, 1)
+				}
+				// the reads of a snapshot are of the same generation
+				reader := snapshotMgr.Snapshot()
+				if reader.GetGroupByGID(reader.GetUserByUID(1001).GID) == nil {
+					atomic.AddInt32(&inconsistent, 1)
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(stop)
+	done.Wait()
+	assert(t, inconsistent == 0)
+	assert(t, snapshotMgr.Version().Generation > 1)
+}
+
+func benchmarkRead(b *testing.B, reload bool) {
+	src := newTogglingSource()
+	benchMgr, err := NewManager([]Source{src})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if reload {
+		stop := make(chan struct{})
+		var done sync.WaitGroup
+		done.Add(1)
+		go reloadContinuously(benchMgr.(*manager), src, stop, &done)
+		defer func() {
+			close(stop)
+			done.Wait()
+		}()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			benchMgr.GetUserByUID(1001)
+			benchMgr.GetGroupsByUID(1001)
+		}
+	})
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+func BenchmarkReadUnderReload(b *testing.B) {
+	benchmarkRead(b, true)
+}
+
+func TestGetByName(t *testing.T) {
+	src := &staticSource{
+		users: []*User{
+			&User{Name: "root", UID: 0, GID: 0},
+			&User{Name: "toor", UID: 0, GID: 0},
+			&User{Name: "root", UID: 1000, GID: 0},
+		},
+		groups: []*Group{
+			&Group{Name: "wheel", GID: 0, Members: []string{"root"}},
+		},
+	}
+	nameMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	users := nameMgr.GetUsersByName("root")
+	assert(t, len(users) == 2 && users[0].UID == 0 && users[1].UID == 1000)
+	assert(t, len(nameMgr.GetUsersByName("toor")) == 1 && len(nameMgr.GetUsersByName("admin")) == 0)
+	assert(t, len(nameMgr.GetGroupsByName("wheel")) == 1 && len(nameMgr.GetGroupsByName("root")) == 0)
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"fmt"
+
+	"github.com/chaowang101/paas/config"
+)
+
+// Change tells which data of a Source has changed
+type Change int
+
+const (
+	// UserChange means the users or their shadow entries have changed
+	UserChange Change = 1 << iota
+	// GroupChange means the groups have changed
+	GroupChange
+)
+
+// UserSnapshot is the users of a Source at one point in time
+type UserSnapshot struct {
+	Users []*User
+	// Shadows is empty if the Source has no password aging information
+	Shadows []*Shadow
+	// Diagnostics reports the entries skipped because they are malformed
+	Diagnostics []*Diagnostic
+}
+
+// GroupSnapshot is the groups of a Source at one point in time
+type GroupSnapshot struct {
+	Groups []*Group
+	// Diagnostics reports the entries skipped because they are malformed
+	Diagnostics []*Diagnostic
+}
+
+// Source provides the users and groups served by the Manager. The Manager loads the snapshots of all its
+// sources and merges them, in the order of the sources. It reloads them whenever a Source notifies a change.
+type Source interface {
+	// Name identifies the Source in logs
+	Name() string
+	// LoadUsers returns the current users of the Source. The returned data must not be modified afterward.
+	LoadUsers() (*UserSnapshot, error)
+	// LoadGroups returns the current groups of the Source. The returned data must not be modified afterward.
+	LoadGroups() (*GroupSnapshot, error)
+	// Start enables the Source to call notify whenever its users or groups change. notify might be called
+	// concurrently.
+	Start(notify func(change Change)) error
+	// Stop will stop the Source from notifying changes and free up resources. It might be called more than
+	// once, e.g. when a Reload replaces the sources before the Manager is stopped.
+	Stop()
+}
+
+// SourceFactory instantiates a Source from its configuration
+type SourceFactory func(setting *config.SourceConfig) (Source, error)
+
+// every Source type must register in this map
+var sourceFactoryMap = map[string]SourceFactory{
+	FileSourceType: newFileSourceFromConfig,
+}
+
+// RegisterSourceType makes the Source of type typ available to NewSources. It is not thread safe and should
+// be called from an init() function.
+func RegisterSourceType(typ string, factory SourceFactory) {
+	sourceFactoryMap[typ] = factory
+}
+
+// NewSources instantiates the sources declared in settings, in the same order
+func NewSources(settings []config.SourceConfig) ([]Source, error) {
+	res := make([]Source, 0, len(settings))
+	for i := range settings {
+		typ := settings[i].Type
+		if len(typ) == 0 {
+			typ = FileSourceType
+		}
+		factory, ok := sourceFactoryMap[typ]
+		if !ok {
+			return nil, fmt.Errorf("Unknown source type %s", typ)
+		}
+		src, err := factory(&settings[i])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, src)
+	}
+	return res, nil
+}
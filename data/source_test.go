@@ -0,0 +1,84 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/chaowang101/paas/config"
+)
+
+const staticSourceType = "static"
+
+// staticSource serves fixed users and groups and never changes
+type staticSource struct {
+	users  []*User
+	groups []*Group
+}
+
+func (s *staticSource) Name() string {
+	return staticSourceType
+}
+
+func (s *staticSource) LoadUsers() (*UserSnapshot, error) {
+	return &UserSnapshot{Users: s.users}, nil
+}
+
+func (s *staticSource) LoadGroups() (*GroupSnapshot, error) {
+	return &GroupSnapshot{Groups: s.groups}, nil
+}
+
+func (s *staticSource) Start(notify func(change Change)) error {
+	return nil
+}
+
+func (s *staticSource) Stop() {
+}
+
+func newStaticSource(setting *config.SourceConfig) (Source, error) {
+	return &staticSource{
+		users: []*User{
+			&User{Name: setting.Settings["user"], UID: 1000, GID: 1000},
+		},
+		groups: []*Group{
+			&Group{Name: "docker", GID: 1000, Members: []string{setting.Settings["user"], "root"}},
+		},
+	}, nil
+}
+
+func TestNewSources(t *testing.T) {
+	_, err := NewSources([]config.SourceConfig{{Type: staticSourceType}})
+	assert(t, err != nil)
+
+	RegisterSourceType(staticSourceType, newStaticSource)
+	defer delete(sourceFactoryMap, staticSourceType)
+
+	sources, err := NewSources([]config.SourceConfig{
+		{PasswdFilePath: originalPasswdPath, GroupFilePath: originalGroupPath},
+		{Type: staticSourceType, Settings: map[string]string{"user": "dwoodlins"}},
+	})
+	assert(t, err == nil)
+	assert(t, len(sources) == 2)
+	assert(t, sources[1].Name() == staticSourceType)
+
+	multiMgr, err := NewManager(sources)
+	assert(t, err == nil)
+	assert(t, multiMgr.Start() == nil)
+	defer multiMgr.Stop()
+
+	assert(t, len(multiMgr.GetAllUsers()) == 7)
+	assert(t, len(multiMgr.GetAllGroups()) == 9)
+
+	user := multiMgr.GetUserByUID(1000)
+	assert(t, user != nil && user.Name == "dwoodlins")
+
+	// the groups of a source apply to the users of another one
+	userGroups := multiMgr.GetGroupsByUID(0)
+	assert(t, len(userGroups) == 5)
+	assert(t, userGroups[4].Name == "docker")
+
+	groupUsers := multiMgr.GetUsersByGID(1000)
+	assert(t, len(groupUsers.Users) == 2)
+	assert(t, len(groupUsers.Unresolved) == 0)
+
+	_, err = NewManager(nil)
+	assert(t, err != nil)
+}
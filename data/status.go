@@ -0,0 +1,73 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// ReloadStatus is the outcome of the reloads of either the users or the groups
+type ReloadStatus struct {
+	// Degraded is true when the last reload failed, the previous snapshot is served until a reload succeeds
+	Degraded bool `json:"degraded"`
+	// LastSuccess is when the snapshot being served is loaded
+	LastSuccess time.Time `json:"lastSuccess"`
+	// LastError and LastErrorTime are the last reload failure, they are kept after a later reload succeeds
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Status is the health of the Manager
+type Status struct {
+	// Degraded is true when the users or the groups are degraded
+	Degraded bool          `json:"degraded"`
+	Users    *ReloadStatus `json:"users"`
+	Groups   *ReloadStatus `json:"groups"`
+	// Version is the content being served
+	Version *Version `json:"version"`
+	// Watches tells how the sources detect their changes, for the sources implementing WatchReporter
+	Watches []*WatchStatus `json:"watches,omitempty"`
+}
+
+// reloadTracker records the outcome of the reloads of either the users or the groups
+type reloadTracker struct {
+	lock   sync.Mutex
+	status ReloadStatus
+}
+
+func (r *reloadTracker) succeed(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status.Degraded = false
+	r.status.LastSuccess = now
+}
+
+func (r *reloadTracker) fail(err error, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status.Degraded = true
+	r.status.LastError = err.Error()
+	r.status.LastErrorTime = &now
+}
+
+// get returns a copy of the current status
+func (r *reloadTracker) get() *ReloadStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := r.status
+	return &res
+}
+
+func (m *manager) Status() *Status {
+	res := &Status{
+		Users:   m.userReload.get(),
+		Groups:  m.groupReload.get(),
+		Version: m.current().Version(),
+	}
+	res.Degraded = res.Users.Degraded || res.Groups.Degraded
+	for _, src := range m.getSources() {
+		if reporter, ok := src.(WatchReporter); ok {
+			res.Watches = append(res.Watches, reporter.WatchStatus())
+		}
+	}
+	return res
+}
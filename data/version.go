@@ -0,0 +1,77 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Version identifies the content served by the Manager. It only changes when a reload changes the content,
+// so that clients polling for changes can rely on it.
+type Version struct {
+	// Generation is incremented every time a reload changes the content, starting at 1
+	Generation uint64 `json:"generation"`
+	// Hash is the hex encoded SHA-256 digest of the content
+	Hash string `json:"hash"`
+	// Modified is when the content has changed for the last time
+	Modified time.Time `json:"modified"`
+}
+
+// contentHash returns the hex encoded SHA-256 digest of the JSON encoding of values
+func contentHash(values ...interface{}) string {
+	h := sha256.New()
+	encoder := json.NewEncoder(h)
+	for _, v := range values {
+		if err := encoder.Encode(v); err != nil {
+			// never happens as the data only has plain fields
+			log.Printf("Fail to hash the content due to error: %s\n", err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// versionTracker records the Version of the content served by the Manager
+type versionTracker struct {
+	lock    sync.Mutex
+	version Version
+}
+
+// update bumps the generation if hash differs from the current one. It returns whether it has changed.
+func (v *versionTracker) update(hash string, now time.Time) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.version.Hash == hash {
+		return false
+	}
+	v.version.Generation++
+	v.version.Hash = hash
+	v.version.Modified = now
+	return true
+}
+
+// get returns a copy of the current version
+func (v *versionTracker) get() *Version {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	res := v.version
+	return &res
+}
+
+func (m *manager) Version() *Version {
+	return m.current().Version()
+}
+
+// publish serves user and group as a new snapshot, it must be called with reloadLock held. The generation is
+// only incremented, and the snapshot kept in the history, when the content has changed.
+func (m *manager) publish(user *userData, group *groupData, now time.Time) {
+	changed := m.version.update(contentHash(user.hash, group.hash), now)
+	res := &snapshot{version: *m.version.get(), user: user, group: group}
+	m.served.Store(res)
+	if changed {
+		log.Printf("Content changed to generation %d\n", res.version.Generation)
+		m.history.add(res)
+	}
+}
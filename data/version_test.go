@@ -0,0 +1,37 @@
+package data
+
+import (
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	src := &staticSource{
+		users:  []*User{&User{Name: "root", UID: 0, GID: 0}},
+		groups: []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root"}}},
+	}
+	versionMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+
+	version := versionMgr.Version()
+	assert(t, version.Generation == 1)
+	assert(t, len(version.Hash) == 64)
+	assert(t, !version.Modified.IsZero())
+	assert(t, versionMgr.Status().Version.Generation == 1)
+
+	// a reload without any change keeps the version
+	versionMgr.(*manager).handleChange(UserChange | GroupChange)
+	assert(t, *versionMgr.Version() == *version)
+
+	src.groups = []*Group{&Group{Name: "wheel", GID: 0, Members: []string{"root", "admin"}}}
+	versionMgr.(*manager).handleChange(GroupChange)
+	changed := versionMgr.Version()
+	assert(t, changed.Generation == 2)
+	assert(t, changed.Hash != version.Hash)
+	assert(t, !changed.Modified.Before(version.Modified))
+
+	// the same content as another manager has the same hash
+	otherMgr, err := NewManager([]Source{src})
+	assert(t, err == nil)
+	assert(t, otherMgr.Version().Hash == changed.Hash)
+	assert(t, otherMgr.Version().Generation == 1)
+}
@@ -0,0 +1,436 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+// WatchStrategy tells how a file Source detects the changes of its files
+type WatchStrategy string
+
+const (
+	// InotifyWatch is notified of the changes by the kernel through fsnotify, it is the default
+	InotifyWatch WatchStrategy = "inotify"
+	// PollWatch compares the modification time, size and inode of the files at an interval, for the file
+	// systems whose notifications are unreliable, e.g. NFS, FUSE or overlay mounts
+	PollWatch WatchStrategy = "poll"
+	// ChecksumWatch compares the content hash of the files at an interval, it also skips the reload when a
+	// file is rewritten with the same content
+	ChecksumWatch WatchStrategy = "checksum"
+
+	// DefaultWatchInterval is the interval of PollWatch and ChecksumWatch by default
+	DefaultWatchInterval = 5 * time.Second
+)
+
+// WatchStatus tells how a Source detects its changes
+type WatchStatus struct {
+	Source   string        `json:"source"`
+	Strategy WatchStrategy `json:"strategy"`
+	// IntervalInSec is the interval of the checks, 0 for InotifyWatch
+	IntervalInSec float64 `json:"intervalInSec,omitempty"`
+	// LastCheck is when the files are compared for the last time, or for InotifyWatch, when a watched file
+	// has changed for the last time. It is not set until then.
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	// Watchers are the states of the watchers of InotifyWatch, one per watched directory
+	Watchers []*WatcherStatus `json:"watchers,omitempty"`
+}
+
+// WatcherState is the state of a watcher of a Source
+type WatcherState string
+
+const (
+	// WatcherRunning means the watcher detects the changes
+	WatcherRunning WatcherState = "running"
+	// WatcherRetrying means the watcher has failed and is being re-created, no change is detected meanwhile
+	WatcherRetrying WatcherState = "retrying"
+	// WatcherDead means the watcher could not be re-created, no change is detected until a restart
+	WatcherDead WatcherState = "dead"
+)
+
+// WatcherStatus is the state of the watcher of a directory
+type WatcherStatus struct {
+	Path  string       `json:"path"`
+	State WatcherState `json:"state"`
+	// Restarts is the number of times the watcher has been re-created after a failure
+	Restarts int `json:"restarts"`
+	// LastError and LastErrorTime are the last failure, they are kept after the watcher is re-created
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// WatchReporter is implemented by the sources able to report how they detect their changes, see Status
+type WatchReporter interface {
+	WatchStatus() *WatchStatus
+}
+
+const (
+	// the events within watchDebounceDelay of each other are merged into a single reload, but a reload is
+	// never delayed by more than watchMaxDelay after the first event
+	watchDebounceDelay = 100 * time.Millisecond
+	watchMaxDelay      = 1 * time.Second
+
+	// a failed watcher is given up after watchMaxRetries attempts in a row to re-create it
+	watchMaxRetries    = 8
+	watchMaxRetryDelay = 1 * time.Minute
+)
+
+// the delay before re-creating a failed watcher, doubled after every failed attempt
+var watchRetryBaseDelay = time.Second
+
+// watchedDir is a directory watched by a fileSource. The files are watched through their directory, so that
+// they are still watched after being replaced by a rename, like vipw, useradd or an editor do.
+type watchedDir struct {
+	path string
+	// the data that change with each watched file of the directory, by path
+	files map[string]Change
+	// the data that change with any file of the directory if it is a drop-in directory, 0 otherwise
+	dropIn Change
+	// watcher and status are guarded by the watchLock of the Source
+	watcher *fsnotify.Watcher
+	status  WatcherStatus
+}
+
+// changes returns the data that change with any file of the directory
+func (d *watchedDir) changes() Change {
+	res := d.dropIn
+	for _, change := range d.files {
+		res |= change
+	}
+	return res
+}
+
+// change returns the data that change with ev, 0 if none
+func (d *watchedDir) change(ev *fsnotify.FileEvent) Change {
+	name := filepath.Clean(ev.Name)
+	if change, ok := d.files[name]; ok {
+		// the file is written, or created, possibly by a rename over it. A file deleted or moved away is
+		// reloaded once created again.
+		if ev.IsCreate() || ev.IsModify() {
+			return change
+		}
+		return 0
+	}
+	if d.dropIn != 0 && filepath.Dir(name) == d.path && !ev.IsAttrib() {
+		return d.dropIn
+	}
+	return 0
+}
+
+// watchedDirs returns the directories to watch for the files and drop-in directories read by the Source
+func (s *fileSource) watchedDirs() []*watchedDir {
+	dirMap := make(map[string]*watchedDir)
+	var res []*watchedDir
+	dir := func(path string) *watchedDir {
+		path = filepath.Clean(path)
+		if d, ok := dirMap[path]; ok {
+			return d
+		}
+		d := &watchedDir{path: path, files: make(map[string]Change), status: WatcherStatus{Path: path}}
+		dirMap[path] = d
+		res = append(res, d)
+		return d
+	}
+
+	for path, change := range s.watchedPaths() {
+		if path == s.passwdDropInDir || path == s.groupDropInDir {
+			dir(path).dropIn |= change
+		} else {
+			dir(filepath.Dir(path)).files[filepath.Clean(path)] |= change
+		}
+	}
+	return res
+}
+
+// watchDir watches dir with watcher until the Source is stopped. A failed watcher is re-created after a delay
+// doubled after every failed attempt, and then the files of dir are reloaded since their events might have been
+// missed. It is given up after watchMaxRetries attempts in a row.
+func (s *fileSource) watchDir(watcher *fsnotify.Watcher, dir *watchedDir) {
+	defer s.wg.Done()
+	log.Println("Start monitoring directory ", dir.path)
+	for watcher != nil {
+		err := s.watchEvents(watcher, dir)
+		watcher.Close()
+		if err == nil {
+			break
+		}
+		log.Printf("error %s for watching directory %s\n", err, dir.path)
+		if watcher = s.recreateWatcher(dir, err); watcher != nil {
+			s.debouncer.add(dir.changes())
+		}
+	}
+	log.Println("Stop monitoring directory ", dir.path)
+}
+
+// watchEvents handles the events of watcher until the Source is stopped, or watcher fails
+func (s *fileSource) watchEvents(watcher *fsnotify.Watcher, dir *watchedDir) error {
+	for {
+		// exit channel has higher priority
+		select {
+		case <-s.exit:
+			return nil
+		default:
+		}
+
+		select {
+		case ev, ok := <-watcher.Event:
+			if !ok {
+				return errors.New("Watcher closed unexpectedly")
+			}
+			if change := dir.change(ev); change != 0 {
+				log.Println("file change event:", ev)
+				s.checked(time.Now())
+				s.debouncer.add(change)
+			}
+		case err := <-watcher.Error:
+			return err
+		case <-s.exit:
+			return nil
+		}
+	}
+}
+
+// recreateWatcher re-creates the watcher of dir after it failed with err. It returns nil if the Source is
+// stopped meanwhile, or the watcher is given up.
+func (s *fileSource) recreateWatcher(dir *watchedDir, err error) *fsnotify.Watcher {
+	for attempts := 1; attempts <= watchMaxRetries; attempts++ {
+		s.setWatcherState(dir, WatcherRetrying, err)
+		select {
+		case <-s.exit:
+			return nil
+		case <-time.After(watchRetryDelay(attempts)):
+		}
+
+		var watcher *fsnotify.Watcher
+		if watcher, err = fsnotify.NewWatcher(); err == nil {
+			if err = watcher.Watch(dir.path); err == nil {
+				s.watchLock.Lock()
+				dir.watcher = watcher
+				dir.status.State = WatcherRunning
+				dir.status.Restarts++
+				s.watchLock.Unlock()
+				log.Printf("Watch directory %s again\n", dir.path)
+				return watcher
+			}
+			watcher.Close()
+		}
+		log.Printf("Fail to watch directory %s again due to error: %s\n", dir.path, err)
+	}
+	s.setWatcherState(dir, WatcherDead, err)
+	log.Printf("Give up watching directory %s, its changes are no longer detected\n", dir.path)
+	return nil
+}
+
+func (s *fileSource) setWatcherState(dir *watchedDir, state WatcherState, err error) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	now := time.Now()
+	dir.status.State = state
+	dir.status.LastError = err.Error()
+	dir.status.LastErrorTime = &now
+}
+
+// watchRetryDelay returns the delay before re-creating a watcher after the attempts have failed
+func watchRetryDelay(attempts int) time.Duration {
+	delay := watchRetryBaseDelay
+	for i := 1; i < attempts && delay < watchMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > watchMaxRetryDelay {
+		delay = watchMaxRetryDelay
+	}
+	return delay
+}
+
+// fingerprints returns the current fingerprints of the files and drop-in directories, the missing ones are
+// left out
+func (s *fileSource) fingerprints() map[string]string {
+	res := make(map[string]string)
+	for path := range s.watchedPaths() {
+		if fingerprint, err := s.fingerprint(path); err == nil {
+			res[path] = fingerprint
+		}
+	}
+	s.checked(time.Now())
+	return res
+}
+
+// pollFiles compares the fingerprints of the files and drop-in directories at every interval, and notifies
+// the data that change with the ones that differ
+func (s *fileSource) pollFiles(fingerprints map[string]string, notify func(change Change)) {
+	defer s.wg.Done()
+	log.Printf("Start checking the files of %s every %s with %s\n", s.Name(), s.watchInterval, s.watchStrategy)
+	paths := s.watchedPaths()
+	ticker := time.NewTicker(s.watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.exit:
+			log.Println("Stop checking the files of ", s.Name())
+			return
+		case <-ticker.C:
+		}
+
+		var change Change
+		for path, pathChange := range paths {
+			fingerprint, err := s.fingerprint(path)
+			if err != nil {
+				// most likely a file being replaced, it is checked again at the next interval
+				continue
+			}
+			if previous, ok := fingerprints[path]; !ok || previous != fingerprint {
+				log.Printf("File %s has changed\n", path)
+				fingerprints[path] = fingerprint
+				change |= pathChange
+			}
+		}
+		s.checked(time.Now())
+		if change != 0 {
+			notify(change)
+		}
+	}
+}
+
+// fingerprint returns a value that changes with the file at path, or with the files of the drop-in directory
+// at path
+func (s *fileSource) fingerprint(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return s.fileFingerprint(path, info)
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, info := range infos {
+		if !isDropInFile(info) {
+			continue
+		}
+		fingerprint, err := s.fileFingerprint(filepath.Join(path, info.Name()), info)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s=%s\n", info.Name(), fingerprint)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *fileSource) fileFingerprint(path string, info os.FileInfo) (string, error) {
+	if s.watchStrategy != ChecksumWatch {
+		return fmt.Sprintf("%d:%d:%d", info.ModTime().UnixNano(), info.Size(), fileInode(info)), nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *fileSource) checked(now time.Time) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	s.lastCheck = now
+}
+
+func (s *fileSource) WatchStatus() *WatchStatus {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	res := &WatchStatus{Source: s.Name(), Strategy: s.watchStrategy}
+	if s.watchStrategy != InotifyWatch {
+		res.IntervalInSec = s.watchInterval.Seconds()
+	}
+	if !s.lastCheck.IsZero() {
+		lastCheck := s.lastCheck
+		res.LastCheck = &lastCheck
+	}
+	for _, dir := range s.dirs {
+		status := dir.status
+		res.Watchers = append(res.Watchers, &status)
+	}
+	return res
+}
+
+// debouncer merges the changes added in a burst, and notifies them once the burst is over
+type debouncer struct {
+	lock     sync.Mutex
+	delay    time.Duration
+	maxDelay time.Duration
+	notify   func(change Change)
+	pending  Change
+	// when the first pending change is added
+	first   time.Time
+	timer   *time.Timer
+	stopped bool
+	// the notifications in progress, waited for by stop
+	notifying sync.WaitGroup
+}
+
+func newDebouncer(delay, maxDelay time.Duration, notify func(change Change)) *debouncer {
+	return &debouncer{delay: delay, maxDelay: maxDelay, notify: notify}
+}
+
+func (d *debouncer) add(change Change) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		return
+	}
+
+	now := time.Now()
+	if d.pending == 0 {
+		d.first = now
+	}
+	d.pending |= change
+	wait := d.delay
+	if left := d.maxDelay - now.Sub(d.first); left < wait {
+		wait = left
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(wait, d.fire)
+}
+
+func (d *debouncer) fire() {
+	d.lock.Lock()
+	change := d.pending
+	d.pending = 0
+	// a timer stopped too late fires with nothing pending
+	if change == 0 || d.stopped {
+		d.lock.Unlock()
+		return
+	}
+	d.notifying.Add(1)
+	d.lock.Unlock()
+
+	defer d.notifying.Done()
+	d.notify(change)
+}
+
+// stop drops the pending changes and waits for the notification in progress, if any. Nothing is notified
+// afterward.
+func (d *debouncer) stop() {
+	d.lock.Lock()
+	d.stopped = true
+	d.pending = 0
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.lock.Unlock()
+	d.notifying.Wait()
+}
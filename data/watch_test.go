@@ -0,0 +1,212 @@
+package data
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	var lock sync.Mutex
+	var changes []Change
+	d := newDebouncer(50*time.Millisecond, 200*time.Millisecond, func(change Change) {
+		lock.Lock()
+		defer lock.Unlock()
+		changes = append(changes, change)
+	})
+	notified := func() []Change {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]Change{}, changes...)
+	}
+
+	// a burst is a single notification of all its changes
+	d.add(UserChange)
+	d.add(UserChange)
+	d.add(GroupChange)
+	assert(t, len(notified()) == 0)
+	time.Sleep(150 * time.Millisecond)
+	assert(t, len(notified()) == 1 && notified()[0] == UserChange|GroupChange)
+
+	// a long burst is notified after the max delay
+	for i := 0; i < 10; i++ {
+		d.add(UserChange)
+		time.Sleep(30 * time.Millisecond)
+	}
+	assert(t, len(notified()) >= 2)
+
+	// nothing is notified after stop
+	time.Sleep(150 * time.Millisecond)
+	count := len(notified())
+	d.add(GroupChange)
+	d.stop()
+	d.add(GroupChange)
+	time.Sleep(150 * time.Millisecond)
+	assert(t, len(notified()) == count)
+}
+
+func TestWatchedDirs(t *testing.T) {
+	src, err := NewFileSource(originalPasswdPath, originalGroupPath, WithShadowFile(originalShadowPath),
+		WithPasswdDropInDir("../testData/passwd.d"))
+	assert(t, err == nil)
+	dirs := src.(*fileSource).watchedDirs()
+	assert(t, len(dirs) == 2)
+	dirMap := make(map[string]*watchedDir)
+	for _, d := range dirs {
+		dirMap[d.path] = d
+	}
+
+	testData, dropIn := dirMap["../testData"], dirMap["../testData/passwd.d"]
+	assert(t, testData != nil && dropIn != nil)
+	assert(t, len(testData.files) == 3 && testData.dropIn == 0)
+	assert(t, testData.files["../testData/shadow"] == UserChange)
+	assert(t, len(dropIn.files) == 0 && dropIn.dropIn == UserChange)
+}
+
+// startWatching starts src on a copy of the test passwd and group files in a temporary directory, it returns
+// the directory and the channel of the notified changes
+func startWatching(t *testing.T, opts ...Option) (string, Source, chan Change) {
+	dir, err := ioutil.TempDir("", "watch")
+	assert(t, err == nil)
+	for _, path := range []string{originalPasswdPath, originalGroupPath} {
+		b, err := ioutil.ReadFile(path)
+		assert(t, err == nil)
+		assert(t, ioutil.WriteFile(filepath.Join(dir, filepath.Base(path)), b, 0644) == nil)
+	}
+	src, err := NewFileSource(filepath.Join(dir, "passwd"), filepath.Join(dir, "group"), opts...)
+	assert(t, err == nil)
+	changes := make(chan Change, 10)
+	assert(t, src.Start(func(change Change) { changes <- change }) == nil)
+	return dir, src, changes
+}
+
+func TestPollWatch(t *testing.T) {
+	_, err := NewFileSource(originalPasswdPath, originalGroupPath, WithWatchStrategy("random", 0))
+	assert(t, err != nil)
+	_, err = NewFileSource(originalPasswdPath, originalGroupPath, WithWatchStrategy(PollWatch, -time.Second))
+	assert(t, err != nil)
+
+	dir, src, changes := startWatching(t, WithWatchStrategy(PollWatch, 50*time.Millisecond))
+	defer os.RemoveAll(dir)
+	defer src.Stop()
+	status := src.(WatchReporter).WatchStatus()
+	assert(t, status.Strategy == PollWatch && status.IntervalInSec == 0.05)
+	assert(t, status.LastCheck != nil)
+
+	// a file replaced by a rename is a new inode
+	tmp := filepath.Join(dir, ".group.tmp")
+	assert(t, ioutil.WriteFile(tmp, []byte("wheel:*:0:root\n"), 0644) == nil)
+	assert(t, os.Rename(tmp, filepath.Join(dir, "group")) == nil)
+	select {
+	case change := <-changes:
+		assert(t, change == GroupChange)
+	case <-time.After(time.Second):
+		t.Fatal()
+	}
+	assert(t, src.(WatchReporter).WatchStatus().LastCheck.After(*status.LastCheck))
+}
+
+func TestChecksumWatch(t *testing.T) {
+	dir, src, changes := startWatching(t, WithWatchStrategy(ChecksumWatch, 50*time.Millisecond))
+	defer os.RemoveAll(dir)
+	defer src.Stop()
+
+	// the same content is not a change, even with another modification time
+	passwdPath := filepath.Join(dir, "passwd")
+	b, err := ioutil.ReadFile(passwdPath)
+	assert(t, err == nil)
+	later := time.Now().Add(time.Hour)
+	assert(t, os.Chtimes(passwdPath, later, later) == nil)
+	select {
+	case <-changes:
+		t.Fatal()
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	assert(t, ioutil.WriteFile(passwdPath, append(b, "app:*:2000:2000::/srv/app:/bin/sh\n"...), 0644) == nil)
+	select {
+	case change := <-changes:
+		assert(t, change == UserChange)
+	case <-time.After(time.Second):
+		t.Fatal()
+	}
+}
+
+func TestWatchStatus(t *testing.T) {
+	// the global manager watches with inotify
+	status := mgr.Status()
+	assert(t, len(status.Watches) == 1)
+	assert(t, status.Watches[0].Strategy == InotifyWatch && status.Watches[0].IntervalInSec == 0)
+	assert(t, status.Watches[0].Source == mgr.(*manager).sources[0].Name())
+
+	// the other sources are not reported
+	staticMgr, err := NewManager([]Source{&staticSource{}})
+	assert(t, err == nil)
+	assert(t, len(staticMgr.Status().Watches) == 0)
+}
+
+func TestWatcherRecovery(t *testing.T) {
+	defer func(delay time.Duration) { watchRetryBaseDelay = delay }(watchRetryBaseDelay)
+	watchRetryBaseDelay = time.Millisecond
+
+	dir, src, changes := startWatching(t)
+	defer os.RemoveAll(dir)
+	fileSrc := src.(*fileSource)
+	watcher := func() *WatcherStatus {
+		watchers := fileSrc.WatchStatus().Watchers
+		assert(t, len(watchers) == 1)
+		return watchers[0]
+	}
+	fail := func(err error) {
+		fileSrc.watchLock.Lock()
+		w := fileSrc.dirs[0].watcher
+		fileSrc.watchLock.Unlock()
+		w.Error <- err
+	}
+	assert(t, watcher().State == WatcherRunning && watcher().Path == dir)
+
+	// the files are reloaded once the watcher is re-created, as their changes might have been missed
+	fail(errors.New("queue overflow"))
+	select {
+	case change := <-changes:
+		assert(t, change == UserChange|GroupChange)
+	case <-time.After(time.Second):
+		t.Fatal()
+	}
+	status := watcher()
+	assert(t, status.State == WatcherRunning && status.Restarts == 1)
+	assert(t, status.LastError == "queue overflow" && status.LastErrorTime != nil)
+
+	// the new watcher detects the changes
+	assert(t, ioutil.WriteFile(filepath.Join(dir, "group"), []byte("wheel:*:0:root\n"), 0644) == nil)
+	select {
+	case change := <-changes:
+		assert(t, change == GroupChange)
+	case <-time.After(time.Second):
+		t.Fatal()
+	}
+
+	// the watcher is given up when the directory can no longer be watched
+	assert(t, os.RemoveAll(dir) == nil)
+	fail(errors.New("queue overflow"))
+	for i := 0; i < 100 && watcher().State != WatcherDead; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status = watcher()
+	assert(t, status.State == WatcherDead && status.Restarts == 1)
+	assert(t, status.LastError != "queue overflow")
+
+	// Stop waits for the goroutines, nothing is notified afterward
+	src.Stop()
+	select {
+	case <-changes:
+		t.Fatal()
+	default:
+	}
+	// stopping again, e.g. by the shutdown after a Reload has replaced the source, is harmless
+	src.Stop()
+}
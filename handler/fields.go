@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// the fields of the response to keep, separated by commas, e.g. fields=name,uid. A nested field is a path
+	// separated by dots, e.g. fields=users.name.
+	qryFields      = "fields"
+	fieldSeparator = ","
+	pathSeparator  = "."
+)
+
+// selection is the tree of the fields to keep by name, a nil subtree keeps the whole value of the field
+type selection map[string]selection
+
+// add adds the field at path to s
+func (s selection) add(path []string) {
+	sub, ok := s[path[0]]
+	if len(path) == 1 {
+		s[path[0]] = nil
+		return
+	}
+	if ok && sub == nil {
+		// the whole field is already kept
+		return
+	}
+	if sub == nil {
+		sub = make(selection)
+		s[path[0]] = sub
+	}
+	sub.add(path[1:])
+}
+
+// parseFields returns the selection of the fields query of r, or nil if it is not set
+func parseFields(r *http.Request) (selection, error) {
+	values := r.URL.Query()[qryFields]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	res := make(selection)
+	for _, value := range values {
+		for _, field := range strings.Split(value, fieldSeparator) {
+			path := strings.Split(strings.TrimSpace(field), pathSeparator)
+			for _, name := range path {
+				if len(name) == 0 {
+					return nil, fmt.Errorf("Invalid fields %s, expecting names separated by %s, and by %s for the "+
+						"nested ones", value, fieldSeparator, pathSeparator)
+				}
+			}
+			res.add(path)
+		}
+	}
+	return res, nil
+}
+
+// projectJSON keeps the fields of sel in the JSON document b, in the order of b. Every element of an array is
+// projected, and the fields missing from an object are omitted, like the nested fields of a scalar.
+func projectJSON(b []byte, sel selection) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// the numbers are copied as they are
+	dec.UseNumber()
+	var buf bytes.Buffer
+	kept, err := project(dec, sel, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if !kept {
+		return b, nil
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// project writes the next value of dec, keeping the fields of sel, to out. It returns false without writing
+// anything if the value is a scalar and sel selects its nested fields.
+func project(dec *json.Decoder, sel selection, out *bytes.Buffer) (bool, error) {
+	if sel == nil {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return false, err
+		}
+		out.Write(raw)
+		return true, nil
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return false, err
+	}
+	switch tok {
+	case json.Delim('['):
+		out.WriteByte('[')
+		first := true
+		for dec.More() {
+			var value bytes.Buffer
+			kept, err := project(dec, sel, &value)
+			if err != nil {
+				return false, err
+			}
+			if !kept {
+				continue
+			}
+			if !first {
+				out.WriteByte(',')
+			}
+			first = false
+			out.Write(value.Bytes())
+		}
+		out.WriteByte(']')
+	case json.Delim('{'):
+		out.WriteByte('{')
+		first := true
+		for dec.More() {
+			if tok, err = dec.Token(); err != nil {
+				return false, err
+			}
+			key, _ := tok.(string)
+			sub, ok := sel[key]
+			var value bytes.Buffer
+			kept := false
+			if ok {
+				kept, err = project(dec, sub, &value)
+			} else {
+				var skipped json.RawMessage
+				err = dec.Decode(&skipped)
+			}
+			if err != nil {
+				return false, err
+			}
+			if !kept {
+				continue
+			}
+			if !first {
+				out.WriteByte(',')
+			}
+			first = false
+			keyJSON, _ := json.Marshal(key)
+			out.Write(keyJSON)
+			out.WriteByte(':')
+			out.Write(value.Bytes())
+		}
+		out.WriteByte('}')
+	default:
+		return false, nil
+	}
+	// the closing delimiter
+	_, err = dec.Token()
+	return true, err
+}
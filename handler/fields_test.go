@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestProjectJSON(t *testing.T) {
+	parse := func(fields string) selection {
+		r, err := http.NewRequest("GET", "/users?fields="+url.QueryEscape(fields), nil)
+		assert(t, err == nil)
+		sel, err := parseFields(r)
+		assert(t, err == nil)
+		return sel
+	}
+
+	doc := []byte(`[{"name":"root","uid":0,"account":{"locked":true,"lastChange":"2019-04-14"}},` +
+		`{"name":"daemon","uid":1}]` + "\n")
+	for fields, expected := range map[string]string{
+		"name,uid":                   `[{"name":"root","uid":0},{"name":"daemon","uid":1}]`,
+		"uid, name":                  `[{"name":"root","uid":0},{"name":"daemon","uid":1}]`,
+		"account.locked":             `[{"account":{"locked":true}},{}]`,
+		"account.locked,account":     `[{"account":{"locked":true,"lastChange":"2019-04-14"}},{}]`,
+		"account,account.lastChange": `[{"account":{"locked":true,"lastChange":"2019-04-14"}},{}]`,
+		"name.first,shell":           `[{},{}]`,
+	} {
+		res, err := projectJSON(doc, parse(fields))
+		assert(t, err == nil)
+		assert(t, string(res) == expected+"\n")
+	}
+
+	// the nested arrays are projected element by element
+	res, err := projectJSON([]byte(`{"users":[{"name":"root","uid":0,"membership":"primary"}],"unresolved":["x"]}`),
+		parse("users.name,unresolved"))
+	assert(t, err == nil && string(res) == `{"users":[{"name":"root"}],"unresolved":["x"]}`+"\n")
+
+	for _, fields := range []string{"", "name,", "account..locked", ".uid"} {
+		r, err := http.NewRequest("GET", "/users?fields="+url.QueryEscape(fields), nil)
+		assert(t, err == nil)
+		_, err = parseFields(r)
+		assert(t, err != nil)
+	}
+}
+
+func TestHandlerFields(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+	buf := verifyResponseCode(handler, "/v1/users?fields=name,uid", http.StatusOK, t)
+	assert(t, buf.String() == `[{"name":"root","uid":-1}]`+"\n")
+	// the legacy mode still applies
+	buf = verifyResponseCode(New("", new(dummyPasswdMgr), LegacyStringIDs()), "/users/0?fields=uid,account.locked",
+		http.StatusOK, t)
+	assert(t, buf.String() == `{"uid":"-1","account":{"locked":true}}`+"\n")
+	buf = verifyResponseCode(handler, "/groups/0/users?fields=users.name,users.membership", http.StatusOK, t)
+	assert(t, buf.String() == `{"users":[{"name":"root","membership":"supplementary"}]}`+"\n")
+	buf = verifyResponseCode(handler, "/users/0/groups?fields=gid&fields=membership", http.StatusOK, t)
+	assert(t, buf.String() == `[{"gid":0,"membership":"primary"}]`+"\n")
+
+	_ = verifyResponseCode(handler, "/groups?fields=name,,gid", http.StatusBadRequest, t)
+	_ = verifyResponseCode(handler, "/groups/query?name=wheel&fields=", http.StatusBadRequest, t)
+}
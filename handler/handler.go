@@ -1,12 +1,21 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/chaowang101/paas/data"
+	"github.com/chaowang101/paas/webhook"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -16,145 +25,858 @@ const (
 	qryUID  = "uid"
 
 	groupQryMember = "member"
+	groupQryAdmin  = "admin"
 	userQryComment = "comment"
 	userQryHome    = "home"
 	userQryShell   = "shell"
 
-	userPath  = "/users"
-	queryPath = "/query"
-	groupPath = "/groups"
+	// every route is served both unversioned and under the version prefix. The versioned routes always
+	// encode uid and gid as JSON numbers, whereas the unversioned ones might be in legacy mode.
+	apiVersionPath = "/v1"
+
+	userPath   = "/users"
+	queryPath  = "/query"
+	searchPath = "/search"
+	groupPath  = "/groups"
+
+	// the expression of a search, and whether to respond with how it is evaluated instead of its result
+	searchQryExpr    = "q"
+	searchQryExplain = "explain"
+
+	parseDiagnosticsPath = "/diagnostics/parse"
+	statusPath           = "/status"
+	healthPath           = "/health"
+	lintPath             = "/lint"
+
+	lintQrySeverity = "severity"
+
+	// every read of the users and groups can be answered from a snapshot of the history, either the one of a
+	// generation, or the one served at a time in the RFC 3339 format
+	qryGeneration = "generation"
+	qryAt         = "at"
+
+	eventsPath = "/events"
+	// the kind and the UID or GID of the entries to stream the events of
+	eventsQryKind = "kind"
+	eventsQryID   = "id"
+	// browsers resume with the Last-Event-ID header, lastEventId is for the clients unable to set it
+	eventsQryLastEventID  = "lastEventId"
+	lastEventIDHeader     = "Last-Event-ID"
+	eventsHeartbeatPeriod = 15 * time.Second
+
+	webhookDeliveriesPath = "/webhooks/deliveries"
+
+	historyPath = "/history"
+	diffPath    = "/diff"
+	// the generations to compare, to is the current one by default
+	diffQryFrom = "from"
+	diffQryTo   = "to"
+
+	// the admin routes are only served when an admin token is set, to the requests bearing it
+	adminReloadPath = "/admin/reload"
+	bearerPrefix    = "Bearer "
+
+	healthOK       = "ok"
+	healthDegraded = "degraded"
 
 	// -? means one or zero occurrences of "-" to handle negative number
 	userIDPath     = userPath + "/{uid:-?[0-9]+}"
 	groupIDPath    = groupPath + "/{gid:-?[0-9]+}"
+	userNamePath   = userPath + "/name/{name}"
+	groupNamePath  = groupPath + "/name/{name}"
 	groupByUIDPath = userPath + "/{uid:-?[0-9]+}" + groupPath
+	userByGIDPath  = groupPath + "/{gid:-?[0-9]+}" + userPath
 )
 
 type handlerFunc func(dataMgr data.Manager, writer http.ResponseWriter, request *http.Request)
 
+// readerFunc reads the users and groups, either the current ones or the ones of a snapshot of the history
+type readerFunc func(reader data.Reader, writer http.ResponseWriter, request *http.Request)
+
+// either handler or read is set
 type handlerObj struct {
 	handler handlerFunc
-	query   bool
+	read    readerFunc
+	// GET if empty
+	method string
+	query  bool
+	// the response only depends on the version of the data, so it carries an ETag and a Last-Modified
+	// header and conditional requests are answered with 304 Not Modified
+	versioned bool
 }
 
+// the query fields of the users and groups, every value is a condition that must be met
+var userQryFields = []string{qryName, qryUID, qryGID, userQryComment, userQryHome, userQryShell}
+var groupQryFields = []string{qryName, qryGID, groupQryMember, groupQryAdmin}
+
 // every handler must register in this map
 var getHandlerMap = map[string]*handlerObj{
-	userPath:              &handlerObj{handler: usersAll},
-	userPath + queryPath:  &handlerObj{handler: usersByQuery, query: true},
-	userIDPath:            &handlerObj{handler: usersByUID},
-	groupByUIDPath:        &handlerObj{handler: groupsByUID},
-	groupPath:             &handlerObj{handler: groupsAll},
-	groupPath + queryPath: &handlerObj{handler: groupsByQuery, query: true},
-	groupIDPath:           &handlerObj{handler: groupsByGID},
+	userPath:             &handlerObj{read: usersAll, versioned: true},
+	userPath + queryPath: &handlerObj{read: usersByQuery, query: true, versioned: true},
+	// the account status depends on the current date
+	userIDPath:             &handlerObj{read: usersByUID},
+	groupByUIDPath:         &handlerObj{read: groupsByUID, versioned: true},
+	groupPath:              &handlerObj{read: groupsAll, versioned: true},
+	groupPath + queryPath:  &handlerObj{read: groupsByQuery, query: true, versioned: true},
+	userPath + searchPath:  &handlerObj{read: usersBySearch, query: true, versioned: true},
+	groupPath + searchPath: &handlerObj{read: groupsBySearch, query: true, versioned: true},
+	groupIDPath:            &handlerObj{read: groupsByGID, versioned: true},
+	userNamePath:           &handlerObj{read: usersByName, versioned: true},
+	groupNamePath:          &handlerObj{read: groupsByName, versioned: true},
+	userByGIDPath:          &handlerObj{read: usersByGID, versioned: true},
+	parseDiagnosticsPath:   &handlerObj{read: parseDiagnostics, versioned: true},
+	statusPath:             &handlerObj{handler: status},
+	healthPath:             &handlerObj{handler: health},
+	lintPath:               &handlerObj{read: lintReport, query: true, versioned: true},
+	historyPath:            &handlerObj{handler: history},
+	diffPath:               &handlerObj{handler: diff, query: true},
+}
+
+// userWithAccount is a single user along with the status of its account, if there is a shadow file
+type userWithAccount struct {
+	*data.User
+	Account *data.Account `json:"account,omitempty"`
+}
+
+// healthStatus is the response of the health check
+type healthStatus struct {
+	Status string `json:"status"`
+}
+
+type contextKey int
+
+// legacyStringIDsKey marks a request whose response should encode uid and gid as JSON strings
+const legacyStringIDsKey contextKey = iota
+
+type options struct {
+	legacyStringIDs bool
+	webhooks        *webhook.Dispatcher
+	adminToken      string
+	stopEvents      <-chan struct{}
+}
+
+// Option customizes the http.Handler returned by New
+type Option func(opts *options)
+
+// LegacyStringIDs makes the unversioned routes encode uid and gid as JSON strings, e.g. "uid":"0", which is
+// what paas returned before the IDs became numeric. The routes under /v1 always encode them as numbers.
+func LegacyStringIDs() Option {
+	return func(opts *options) {
+		opts.legacyStringIDs = true
+	}
+}
+
+// WebhookDeliveries serves the deliveries of dispatcher at /webhooks/deliveries
+func WebhookDeliveries(dispatcher *webhook.Dispatcher) Option {
+	return func(opts *options) {
+		opts.webhooks = dispatcher
+	}
+}
+
+// AdminToken serves the admin routes, e.g. POST /admin/reload, to the requests with the header
+// "Authorization: Bearer <token>". They are not served without a token.
+func AdminToken(token string) Option {
+	return func(opts *options) {
+		opts.adminToken = token
+	}
+}
+
+// StopEvents ends the event streams of /events once stop is closed. http.Server.Shutdown does not cancel the
+// requests in progress, it would wait for the streams forever otherwise, see http.Server.RegisterOnShutdown.
+func StopEvents(stop <-chan struct{}) Option {
+	return func(opts *options) {
+		opts.stopEvents = stop
+	}
 }
 
 // New returns a http.Handler that server the data from dataMgr
-func New(domain string, dataMgr data.Manager) http.Handler {
+func New(domain string, dataMgr data.Manager, opts ...Option) http.Handler {
 	handler := mux.NewRouter()
 
+	setting := &options{}
+	for _, opt := range opts {
+		opt(setting)
+	}
+
+	// the handlers depending on the options
+	handlerMap := map[string]*handlerObj{
+		webhookDeliveriesPath: &handlerObj{handler: func(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
+			webhookDeliveries(setting.webhooks, w, r)
+		}},
+		eventsPath: &handlerObj{query: true, handler: func(dataMgr data.Manager, w http.ResponseWriter,
+			r *http.Request) {
+			events(dataMgr, setting.stopEvents, w, r)
+		}},
+	}
+	if len(setting.adminToken) > 0 {
+		handlerMap[adminReloadPath] = &handlerObj{method: http.MethodPost, handler: func(dataMgr data.Manager,
+			w http.ResponseWriter, r *http.Request) {
+			if !authorized(setting.adminToken, r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Invalid or missing admin token", http.StatusUnauthorized)
+				return
+			}
+			reload(dataMgr, w, r)
+		}}
+	}
 	for path, obj := range getHandlerMap {
-		curObj := obj
-		route := handler.HandleFunc(path, func(writer http.ResponseWriter, request *http.Request) {
-			// NOTE: more middleware should be called here
-			// TODO: Those logs might be too verbose.
-			log.Printf("Request %s from %v starts", request.RequestURI, request.RemoteAddr)
-			curObj.handler(dataMgr, writer, request)
-			log.Printf("Request %s from %v ends", request.RequestURI, request.RemoteAddr)
-		}).Methods("GET").Queries()
-		if obj.query {
-			route = route.Queries()
-		}
-		if len(domain) > 0 {
-			route.Host(domain)
+		handlerMap[path] = obj
+	}
+
+	for _, prefix := range []string{"", apiVersionPath} {
+		legacy := setting.legacyStringIDs && len(prefix) == 0
+		for path, obj := range handlerMap {
+			curObj := obj
+			method := obj.method
+			if len(method) == 0 {
+				method = http.MethodGet
+			}
+			route := handler.HandleFunc(prefix+path, func(writer http.ResponseWriter, request *http.Request) {
+				// NOTE: more middleware should be called here
+				// TODO: Those logs might be too verbose.
+				log.Printf("Request %s from %v starts", request.RequestURI, request.RemoteAddr)
+				if legacy {
+					request = request.WithContext(context.WithValue(request.Context(), legacyStringIDsKey, true))
+				}
+				if _, err := parseFields(request); err != nil {
+					http.Error(writer, err.Error(), http.StatusBadRequest)
+					log.Printf("Request %s from %v ends, %s", request.RequestURI, request.RemoteAddr, err)
+					return
+				}
+				var reader data.Reader = dataMgr
+				if curObj.read != nil {
+					var status int
+					var err error
+					if reader, status, err = readerAt(dataMgr, request); err != nil {
+						http.Error(writer, err.Error(), status)
+						log.Printf("Request %s from %v ends, %s", request.RequestURI, request.RemoteAddr, err)
+						return
+					}
+				}
+				if curObj.versioned && notModified(reader.Version(), writer, request) {
+					log.Printf("Request %s from %v ends, not modified", request.RequestURI, request.RemoteAddr)
+					return
+				}
+				if curObj.read != nil {
+					curObj.read(reader, writer, request)
+				} else {
+					curObj.handler(dataMgr, writer, request)
+				}
+				log.Printf("Request %s from %v ends", request.RequestURI, request.RemoteAddr)
+			}).Methods(method).Queries()
+			if obj.query {
+				route = route.Queries()
+			}
+			if len(domain) > 0 {
+				route.Host(domain)
+			}
 		}
 	}
 
 	return handler
 }
 
-func encodeJSON(w http.ResponseWriter, v interface{}, errMsg string) {
-	encoder := json.NewEncoder(w)
+// marshalJSON encodes v followed by a newline, with only the fields requested by r if any, and with the IDs of
+// its users and groups as strings if r is in legacy mode
+func marshalJSON(r *http.Request, v interface{}) ([]byte, error) {
+	if legacy, _ := r.Context().Value(legacyStringIDsKey).(bool); legacy {
+		v = legacyView(v)
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
 	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	res := buf.Bytes()
+	// the fields query is checked before the handlers are called
+	if sel, _ := parseFields(r); sel != nil {
+		var err error
+		if res, err = projectJSON(res, sel); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func encodeJSON(w http.ResponseWriter, r *http.Request, v interface{}, errMsg string) {
+	encodeJSONStatus(w, r, http.StatusOK, v, errMsg)
+}
+
+// encodeJSONStatus responds status along with v, or 500 if v fails to be encoded
+func encodeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}, errMsg string) {
+	res, err := marshalJSON(r, v)
+	if err != nil {
 		log.Printf("%s with err: %s\n", errMsg, err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(res); err != nil {
+		log.Printf("%s with err: %s\n", errMsg, err.Error())
 	}
 }
 
-func usersAll(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
-	users := dataMgr.GetAllUsers()
+// notModified sets the ETag and Last-Modified headers of version. It returns true after responding 304 Not
+// Modified if the conditional headers of r show that the client already has this version. As specified by
+// RFC 7232, If-Modified-Since is ignored when If-None-Match is present.
+func notModified(version *data.Version, w http.ResponseWriter, r *http.Request) bool {
+	etag := `"` + version.Hash + `"`
+	w.Header().Set("ETag", etag)
+	// HTTP dates have a precision of a second
+	modified := version.Modified.Truncate(time.Second)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	match := false
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		for _, tag := range strings.Split(inm, ",") {
+			// the weak comparison is used for GET
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				match = true
+				break
+			}
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); len(ims) > 0 {
+		if since, err := http.ParseTime(ims); err == nil && !modified.After(since) {
+			match = true
+		}
+	}
+
+	if match {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return match
+}
+
+// readerAt returns the reader of the snapshot requested by the generation, at or cursor query of r, or the one
+// being served. On error, it also returns the status to respond with.
+func readerAt(dataMgr data.Manager, r *http.Request) (data.Reader, int, error) {
+	v := r.URL.Query()
+	generationStr, atStr, cursorStr := v.Get(qryGeneration), v.Get(qryAt), v.Get(pageQryCursor)
+	var res data.Reader
+	switch {
+	case len(generationStr) > 0 && len(atStr) > 0:
+		return nil, http.StatusBadRequest, fmt.Errorf("Only one of generation and at can be set")
+	case len(cursorStr) > 0 && (len(generationStr) > 0 || len(atStr) > 0):
+		return nil, http.StatusBadRequest, fmt.Errorf("The cursor already sets the snapshot")
+	case len(cursorStr) > 0:
+		c, err := decodeCursor(cursorStr)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		// the pages of a cursor are the ones of the same snapshot, as long as it is kept in the history
+		if res = dataMgr.At(c.Generation); res == nil {
+			return nil, http.StatusGone, fmt.Errorf("The cursor has expired, its snapshot is not kept in the history")
+		}
+		return res, http.StatusOK, nil
+	case len(generationStr) > 0:
+		generation, err := strconv.ParseUint(generationStr, 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Invalid generation %s", generationStr)
+		}
+		res = dataMgr.At(generation)
+	case len(atStr) > 0:
+		at, err := time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Invalid time %s, expecting RFC 3339", atStr)
+		}
+		res = dataMgr.AtTime(at)
+	default:
+		// a single snapshot, so that the ETag is the one of the content of the response
+		return dataMgr.Snapshot(), http.StatusOK, nil
+	}
+	if res == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("The snapshot is not kept in the history")
+	}
+	return res, http.StatusOK, nil
+}
+
+// idVar returns the numeric UID or GID in the path of r. The routes only match digits, so an error only
+// happens when the ID overflows.
+func idVar(r *http.Request, key string) (int, error) {
+	return strconv.Atoi(mux.Vars(r)[key])
+}
+
+func usersAll(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	users, ok := pageUsers(reader, reader.GetAllUsers(), w, r)
+	if !ok {
+		return
+	}
+	if len(users) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	encodeJSON(w, r, users, "Fail to encode the result of all users")
+}
+
+// queryConditions parses the values of fields in the query of r, an entry must match all of them. The keys of
+// the query must be fields or pagination keys, as a mistyped operator like uid>=1000 would otherwise be a
+// key silently ignored.
+func queryConditions(r *http.Request, fields []string,
+	parse func(field, expr string) (*data.Condition, error)) ([]*data.Condition, error) {
+	v := r.URL.Query()
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+Keys:
+	for _, key := range keys {
+		if pageQryKeys[key] || key == pageQrySort {
+			continue
+		}
+		for _, field := range fields {
+			if key == field {
+				continue Keys
+			}
+		}
+		return nil, fmt.Errorf("Invalid query key %s, expecting one of %s, the operator goes in the value, "+
+			"e.g. uid=gte:1000", key, strings.Join(fields, ", "))
+	}
+
+	var res []*data.Condition
+	for _, field := range fields {
+		for _, expr := range v[field] {
+			// an empty value is ignored, eq: matches an empty field
+			if len(expr) == 0 {
+				continue
+			}
+			cond, err := parse(field, expr)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, cond)
+		}
+	}
+	return res, nil
+}
+
+func usersByQuery(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	conds, err := queryConditions(r, userQryFields, data.ParseUserCondition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	users, ok := pageUsers(reader, reader.FindUsers(conds), w, r)
+	if !ok {
+		return
+	}
 	if len(users) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	encodeJSON(w, users, "Fail to encode the result of all users")
+	encodeJSON(w, r, users, "Fail to encode the result of user query")
 }
 
-func usersByQuery(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
+// searchQuery returns the expression of the search of r, and whether the search must be explained
+func searchQuery(r *http.Request) (string, bool, error) {
 	v := r.URL.Query()
-	name := v.Get(qryName)
-	uid := v.Get(qryUID)
-	gid := v.Get(qryGID)
-	comment := v.Get(userQryComment)
-	home := v.Get(userQryHome)
-	shell := v.Get(userQryShell)
-	users := dataMgr.GetUserByQuery(name, uid, gid, comment, home, shell)
+	expr := v.Get(searchQryExpr)
+	if len(strings.TrimSpace(expr)) == 0 {
+		return "", false, fmt.Errorf("%s is required", searchQryExpr)
+	}
+	explain := false
+	if value := v.Get(searchQryExplain); len(value) > 0 {
+		var err error
+		if explain, err = strconv.ParseBool(value); err != nil {
+			return "", false, fmt.Errorf("Invalid %s %s, expecting true or false", searchQryExplain, value)
+		}
+	}
+	return expr, explain, nil
+}
+
+func usersBySearch(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	src, explain, err := searchQuery(r)
+	var expr *data.UserExpression
+	if err == nil {
+		expr, err = data.ParseUserExpression(src)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	users, plan := reader.SearchUsers(expr)
+	if explain {
+		encodeJSON(w, r, plan, "Fail to encode the plan of user search")
+		return
+	}
 	if len(users) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	encodeJSON(w, users, "Fail to encode the result of user query")
+	encodeJSON(w, r, users, "Fail to encode the result of user search")
 }
 
-func usersByUID(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
-	uid := mux.Vars(r)[qryUID]
-	user := dataMgr.GetUserByUID(uid)
+func usersByUID(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	uid, err := idVar(r, qryUID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := reader.GetUserByUID(uid)
 	if user == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	encodeJSON(w, user, fmt.Sprintf("Fail to encode the result of user with UID %s", uid))
+	res := &userWithAccount{User: user, Account: reader.GetAccountByUID(uid)}
+	encodeJSON(w, r, res, fmt.Sprintf("Fail to encode the result of user with UID %d", uid))
 }
 
-func groupsAll(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
-	groups := dataMgr.GetAllGroups()
+func groupsAll(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	groups, ok := pageGroups(reader, reader.GetAllGroups(), w, r)
+	if !ok {
+		return
+	}
 	if len(groups) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	encodeJSON(w, groups, "Fail to encode the result of all groups")
+	encodeJSON(w, r, groups, "Fail to encode the result of all groups")
 }
 
-func groupsByUID(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
-	uid := mux.Vars(r)[qryUID]
-	groups := dataMgr.GetGroupsByUID(uid)
+// usersByName responds the user named like in the path, or 409 along with all of them if the name is
+// duplicated, as getpwnam(3) would return either of them
+func usersByName(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)[qryName]
+	users := reader.GetUsersByName(name)
+	switch len(users) {
+	case 0:
+		w.WriteHeader(http.StatusNotFound)
+	case 1:
+		encodeJSON(w, r, users[0], fmt.Sprintf("Fail to encode the result of user named %s", name))
+	default:
+		encodeJSONStatus(w, r, http.StatusConflict, users, fmt.Sprintf("Fail to encode the users named %s", name))
+	}
+}
+
+func groupsByUID(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	uid, err := idVar(r, qryUID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	groups := reader.GetGroupsByUID(uid)
 	if len(groups) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	encodeJSON(w, groups, fmt.Sprintf("Fail to encode the result of group with UID %s", uid))
+	encodeJSON(w, r, groups, fmt.Sprintf("Fail to encode the result of group with UID %d", uid))
 }
 
-func groupsByQuery(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
-	v := r.URL.Query()
-	name := v.Get(qryName)
-	gid := v.Get(qryGID)
-	members := v[groupQryMember]
-	groups := dataMgr.GetGroupByQuery(name, gid, members)
+func groupsByQuery(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	conds, err := queryConditions(r, groupQryFields, data.ParseGroupCondition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groups, ok := pageGroups(reader, reader.FindGroups(conds), w, r)
+	if !ok {
+		return
+	}
 	if len(groups) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	encodeJSON(w, groups, "Fail to encode the result of group query")
+	encodeJSON(w, r, groups, "Fail to encode the result of group query")
 }
 
-func groupsByGID(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
-	gid := mux.Vars(r)[qryGID]
-	group := dataMgr.GetGroupByGID(gid)
+func groupsBySearch(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	src, explain, err := searchQuery(r)
+	var expr *data.GroupExpression
+	if err == nil {
+		expr, err = data.ParseGroupExpression(src)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groups, plan := reader.SearchGroups(expr)
+	if explain {
+		encodeJSON(w, r, plan, "Fail to encode the plan of group search")
+		return
+	}
+	if len(groups) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	encodeJSON(w, r, groups, "Fail to encode the result of group search")
+}
+
+func groupsByGID(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	gid, err := idVar(r, qryGID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	group := reader.GetGroupByGID(gid)
 
 	if group == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	encodeJSON(w, group, fmt.Sprintf("Fail to encode the result of group with GID %s", gid))
+	encodeJSON(w, r, group, fmt.Sprintf("Fail to encode the result of group with GID %d", gid))
+}
+
+// groupsByName responds the group named like in the path, or 409 along with all of them if the name is
+// duplicated, see usersByName
+func groupsByName(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)[qryName]
+	groups := reader.GetGroupsByName(name)
+	switch len(groups) {
+	case 0:
+		w.WriteHeader(http.StatusNotFound)
+	case 1:
+		encodeJSON(w, r, groups[0], fmt.Sprintf("Fail to encode the result of group named %s", name))
+	default:
+		encodeJSONStatus(w, r, http.StatusConflict, groups, fmt.Sprintf("Fail to encode the groups named %s", name))
+	}
+}
+
+func usersByGID(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	gid, err := idVar(r, qryGID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	users := reader.GetUsersByGID(gid)
+
+	if users == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	encodeJSON(w, r, users, fmt.Sprintf("Fail to encode the result of users with GID %d", gid))
+}
+
+func parseDiagnostics(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	diagnostics := reader.GetParseDiagnostics()
+	if len(diagnostics) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	encodeJSON(w, r, diagnostics, "Fail to encode the parse diagnostics")
+}
+
+func status(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
+	encodeJSON(w, r, dataMgr.Status(), "Fail to encode the status")
+}
+
+// health responds 503 when the manager is degraded, so that load balancers and monitors can act on it
+func health(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
+	res := &healthStatus{Status: healthOK}
+	if dataMgr.Status().Degraded {
+		res.Status = healthDegraded
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encodeJSON(w, r, res, "Fail to encode the health")
+}
+
+// lintReport always responds 200 with the issue counts, so that a compliance job can gate on them
+func lintReport(reader data.Reader, w http.ResponseWriter, r *http.Request) {
+	report := reader.Lint()
+	if severity := r.URL.Query().Get(lintQrySeverity); len(severity) > 0 {
+		min, err := data.ParseSeverity(severity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report = report.Filter(min)
+	}
+	encodeJSON(w, r, report, "Fail to encode the lint report")
+}
+
+// eventFilter selects the events of a kind of entries, and of an entry with a UID or GID
+type eventFilter struct {
+	kind string
+	id   *int
+}
+
+func (f *eventFilter) match(e *data.Event) bool {
+	if len(f.kind) > 0 && e.Kind != f.kind {
+		return false
+	}
+	return f.id == nil || e.EntryID() == *f.id
+}
+
+// writeEvent writes e in the format of the server-sent events, the name of the event is e.g. user-added
+func writeEvent(w http.ResponseWriter, r *http.Request, e *data.Event) error {
+	buf, err := marshalJSON(r, e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s-%s\ndata: %s\n", e.ID, e.Kind, e.Action, buf)
+	return err
+}
+
+// events streams the changes of the users and groups as server-sent events, until the client goes away or stop
+// is closed. The write deadline of the server is lifted for the stream. The client resumes from the last event
+// it has received by sending its ID.
+func events(dataMgr data.Manager, stop <-chan struct{}, w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	filter := &eventFilter{kind: v.Get(eventsQryKind)}
+	if len(filter.kind) > 0 && filter.kind != data.EventKindUser && filter.kind != data.EventKindGroup {
+		http.Error(w, fmt.Sprintf("Unknown kind %s", filter.kind), http.StatusBadRequest)
+		return
+	}
+	if idStr := v.Get(eventsQryID); len(idStr) > 0 {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid id %s", idStr), http.StatusBadRequest)
+			return
+		}
+		filter.id = &id
+	}
+
+	lastEventIDStr := r.Header.Get(lastEventIDHeader)
+	if len(lastEventIDStr) == 0 {
+		lastEventIDStr = v.Get(eventsQryLastEventID)
+	}
+	var lastEventID uint64
+	if len(lastEventIDStr) > 0 {
+		var err error
+		if lastEventID, err = strconv.ParseUint(lastEventIDStr, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid last event ID %s", lastEventIDStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Fail to stream the events as the response cannot be flushed")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the write timeout of the server would cut the stream
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Fail to lift the write deadline of the events with err: %s\n", err)
+	}
+
+	sub := dataMgr.Subscribe(lastEventID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if sub.Missed {
+		// some events are lost, the client should fetch everything again
+		fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+	}
+
+	send := func(e *data.Event) bool {
+		if !filter.match(e) {
+			return true
+		}
+		if err := writeEvent(w, r, e); err != nil {
+			log.Printf("Fail to send event %d with err: %s\n", e.ID, err)
+			return false
+		}
+		return true
+	}
+	for _, e := range sub.Backlog {
+		if !send(e) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatPeriod)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stop:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				// dropped for being too slow, the client reconnects and resumes from its last event
+				return
+			}
+			if !send(e) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// webhookDeliveries returns 204 when no webhook is configured
+func webhookDeliveries(dispatcher *webhook.Dispatcher, w http.ResponseWriter, r *http.Request) {
+	if dispatcher == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	deliveries := dispatcher.Deliveries()
+	if len(deliveries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	encodeJSON(w, r, deliveries, "Fail to encode the webhook deliveries")
+}
+
+func history(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
+	encodeJSON(w, r, dataMgr.History(), "Fail to encode the history")
+}
+
+// generationVar returns the generation in the query key of r, or def if it is not set
+func generationVar(r *http.Request, key string, def uint64) (uint64, error) {
+	value := r.URL.Query().Get(key)
+	if len(value) == 0 {
+		return def, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func diff(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
+	if len(r.URL.Query().Get(diffQryFrom)) == 0 {
+		http.Error(w, "from is required", http.StatusBadRequest)
+		return
+	}
+	from, err := generationVar(r, diffQryFrom, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid generation %s", r.URL.Query().Get(diffQryFrom)), http.StatusBadRequest)
+		return
+	}
+	to, err := generationVar(r, diffQryTo, dataMgr.Version().Generation)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid generation %s", r.URL.Query().Get(diffQryTo)), http.StatusBadRequest)
+		return
+	}
+
+	res := dataMgr.Diff(from, to)
+	if res == nil {
+		http.Error(w, "The generation is not kept in the history", http.StatusNotFound)
+		return
+	}
+	encodeJSON(w, r, res, "Fail to encode the diff")
+}
+
+// authorized tells whether r bears token, compared in constant time
+func authorized(token string, r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearerPrefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, bearerPrefix)), []byte(token)) == 1
+}
+
+// reload responds 200 when every file is read, or 422 along with the failed files, in which case the previous
+// users or groups keep being served
+func reload(dataMgr data.Manager, w http.ResponseWriter, r *http.Request) {
+	res, err := dataMgr.Reload(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !res.OK {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	encodeJSON(w, r, res, "Fail to encode the reload result")
 }
@@ -2,13 +2,22 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/chaowang101/paas/config"
 	"github.com/chaowang101/paas/data"
+	"github.com/chaowang101/paas/webhook"
 )
 
 type emptyPasswdMgr int
@@ -29,7 +38,27 @@ func (emptyPasswdMgr) GetUserByQuery(name, uid, gid, comment, home, shell string
 	return nil
 }
 
-func (emptyPasswdMgr) GetUserByUID(uid string) *data.User {
+func (emptyPasswdMgr) FindUsers(conds []*data.Condition) []*data.User {
+	return nil
+}
+
+func (emptyPasswdMgr) SearchUsers(expr *data.UserExpression) ([]*data.User, *data.SearchPlan) {
+	return nil, &data.SearchPlan{Expression: expr.String(), Index: "scan"}
+}
+
+func (emptyPasswdMgr) GetUserByUID(uid int) *data.User {
+	return nil
+}
+
+func (emptyPasswdMgr) GetUsersByGID(gid int) *data.GroupUsers {
+	return nil
+}
+
+func (emptyPasswdMgr) GetUsersByName(name string) []*data.User {
+	return nil
+}
+
+func (emptyPasswdMgr) GetAccountByUID(uid int) *data.Account {
 	return nil
 }
 
@@ -37,18 +66,79 @@ func (emptyPasswdMgr) GetAllGroups() []*data.Group {
 	return nil
 }
 
-func (emptyPasswdMgr) GetGroupsByUID(uid string) []*data.Group {
+func (emptyPasswdMgr) GetGroupsByUID(uid int) []*data.UserGroup {
 	return nil
 }
 
-func (emptyPasswdMgr) GetGroupByQuery(name, gid string, members []string) []*data.Group {
+func (emptyPasswdMgr) GetGroupByQuery(name, gid string, members, admins []string) []*data.Group {
 	return nil
 }
 
-func (emptyPasswdMgr) GetGroupByGID(gid string) *data.Group {
+func (emptyPasswdMgr) FindGroups(conds []*data.Condition) []*data.Group {
 	return nil
 }
 
+func (emptyPasswdMgr) SearchGroups(expr *data.GroupExpression) ([]*data.Group, *data.SearchPlan) {
+	return nil, &data.SearchPlan{Expression: expr.String(), Index: "scan"}
+}
+
+func (emptyPasswdMgr) GetGroupByGID(gid int) *data.Group {
+	return nil
+}
+
+func (emptyPasswdMgr) GetGroupsByName(name string) []*data.Group {
+	return nil
+}
+
+func (emptyPasswdMgr) GetParseDiagnostics() []*data.Diagnostic {
+	return nil
+}
+
+func (emptyPasswdMgr) Status() *data.Status {
+	return &data.Status{Users: &data.ReloadStatus{}, Groups: &data.ReloadStatus{}}
+}
+
+func (emptyPasswdMgr) Lint() *data.LintReport {
+	return &data.LintReport{Issues: []*data.LintIssue{}}
+}
+
+func (emptyPasswdMgr) Version() *data.Version {
+	return &data.Version{Generation: 1, Hash: "empty"}
+}
+
+func (emptyPasswdMgr) Subscribe(lastEventID uint64) *data.Subscription {
+	ch := make(chan *data.Event)
+	close(ch)
+	return &data.Subscription{C: ch}
+}
+
+func (emptyPasswdMgr) History() []*data.Version {
+	return []*data.Version{&data.Version{Generation: 1, Hash: "empty"}}
+}
+
+func (emptyPasswdMgr) Diff(from, to uint64) *data.Diff {
+	return nil
+}
+
+func (e emptyPasswdMgr) At(generation uint64) data.Reader {
+	if generation == 1 {
+		return e
+	}
+	return nil
+}
+
+func (e emptyPasswdMgr) AtTime(t time.Time) data.Reader {
+	return e
+}
+
+func (e emptyPasswdMgr) Snapshot() data.Reader {
+	return e
+}
+
+func (e emptyPasswdMgr) Reload(ctx context.Context) (*data.ReloadResult, error) {
+	return &data.ReloadResult{OK: true, Version: e.Version(), Files: []*data.FileReload{}}, nil
+}
+
 type dummyPasswdMgr int
 
 func (dummyPasswdMgr) Start() error {
@@ -62,8 +152,8 @@ func (dummyPasswdMgr) Stop() {
 var dummyUser []*data.User = []*data.User{
 	&data.User{
 		Name:    "root",
-		UID:     "-1",
-		GID:     "0",
+		UID:     -1,
+		GID:     0,
 		Comment: "System Administrator",
 		Home:    "/var/root",
 		Shell:   "/bin/sh",
@@ -73,8 +163,9 @@ var dummyUser []*data.User = []*data.User{
 var dummyGroup []*data.Group = []*data.Group{
 	&data.Group{
 		Name:    "wheel",
-		GID:     "0",
+		GID:     0,
 		Members: []string{"root", "root2"},
+		Admins:  []string{"root"},
 	},
 }
 
@@ -86,26 +177,205 @@ func (dummyPasswdMgr) GetUserByQuery(name, uid, gid, comment, home, shell string
 	return dummyUser
 }
 
-func (dummyPasswdMgr) GetUserByUID(uid string) *data.User {
+func (dummyPasswdMgr) FindUsers(conds []*data.Condition) []*data.User {
+	return dummyUser
+}
+
+func (dummyPasswdMgr) SearchUsers(expr *data.UserExpression) ([]*data.User, *data.SearchPlan) {
+	plan := &data.SearchPlan{Expression: expr.String(), Index: "uid", Key: "0", Candidates: 1, Matches: 1}
+	return dummyUser, plan
+}
+
+func (dummyPasswdMgr) GetUserByUID(uid int) *data.User {
 	return dummyUser[0]
 }
 
+var dummyAccount *data.Account = &data.Account{
+	Locked:     true,
+	LastChange: "2019-04-14",
+}
+
+func (dummyPasswdMgr) GetUsersByName(name string) []*data.User {
+	return dummyUser
+}
+
+func (dummyPasswdMgr) GetAccountByUID(uid int) *data.Account {
+	return dummyAccount
+}
+
+var dummyGroupUsers *data.GroupUsers = &data.GroupUsers{
+	Users: []*data.GroupMember{
+		&data.GroupMember{
+			User:       dummyUser[0],
+			Membership: data.SupplementaryMembership,
+		},
+	},
+	Unresolved: []string{"root2"},
+}
+
+func (dummyPasswdMgr) GetUsersByGID(gid int) *data.GroupUsers {
+	return dummyGroupUsers
+}
+
 func (dummyPasswdMgr) GetAllGroups() []*data.Group {
 	return dummyGroup
 }
 
-func (dummyPasswdMgr) GetGroupsByUID(uid string) []*data.Group {
+var dummyUserGroup []*data.UserGroup = []*data.UserGroup{
+	&data.UserGroup{
+		Group:      dummyGroup[0],
+		Membership: data.PrimaryMembership,
+	},
+}
+
+func (dummyPasswdMgr) GetGroupsByUID(uid int) []*data.UserGroup {
+	return dummyUserGroup
+}
+
+func (dummyPasswdMgr) GetGroupByQuery(name, gid string, members, admins []string) []*data.Group {
 	return dummyGroup
 }
 
-func (dummyPasswdMgr) GetGroupByQuery(name, gid string, members []string) []*data.Group {
+func (dummyPasswdMgr) FindGroups(conds []*data.Condition) []*data.Group {
 	return dummyGroup
 }
 
-func (dummyPasswdMgr) GetGroupByGID(gid string) *data.Group {
+func (dummyPasswdMgr) SearchGroups(expr *data.GroupExpression) ([]*data.Group, *data.SearchPlan) {
+	plan := &data.SearchPlan{Expression: expr.String(), Index: "scan", Candidates: 1, Matches: 1}
+	return dummyGroup, plan
+}
+
+func (dummyPasswdMgr) GetGroupByGID(gid int) *data.Group {
 	return dummyGroup[0]
 }
 
+var dummyDiagnostics []*data.Diagnostic = []*data.Diagnostic{
+	&data.Diagnostic{
+		File:    "/etc/passwd",
+		Line:    3,
+		Content: "root:*:root:0:System Administrator:/var/root:/bin/sh",
+		Reason:  "Invalid UID root",
+	},
+}
+
+func (dummyPasswdMgr) GetGroupsByName(name string) []*data.Group {
+	return dummyGroup
+}
+
+func (dummyPasswdMgr) GetParseDiagnostics() []*data.Diagnostic {
+	return dummyDiagnostics
+}
+
+var dummyStatus *data.Status = &data.Status{
+	Degraded: true,
+	Users:    &data.ReloadStatus{},
+	Groups: &data.ReloadStatus{
+		Degraded:  true,
+		LastError: "/etc/group:3: Malformed content broken",
+	},
+}
+
+func (dummyPasswdMgr) Status() *data.Status {
+	return dummyStatus
+}
+
+func (dummyPasswdMgr) Lint() *data.LintReport {
+	report := &data.LintReport{Errors: 1, Warnings: 1, Issues: []*data.LintIssue{
+		&data.LintIssue{Severity: data.SeverityError, Code: "duplicate-uid", Kind: "user", Name: "root2"},
+		&data.LintIssue{Severity: data.SeverityWarning, Code: "unknown-member", Kind: "group", Name: "wheel"},
+	}}
+	return report
+}
+
+var dummyModified = time.Date(2019, time.April, 14, 10, 30, 0, 0, time.UTC)
+
+func (dummyPasswdMgr) Version() *data.Version {
+	return &data.Version{Generation: 3, Hash: "0123abcd", Modified: dummyModified}
+}
+
+// Subscribe returns the events after lastEventID among a user added and a group modified, the stream ends
+// right away
+func (dummyPasswdMgr) Subscribe(lastEventID uint64) *data.Subscription {
+	ch := make(chan *data.Event)
+	close(ch)
+	res := &data.Subscription{C: ch, Missed: lastEventID > 3}
+	if lastEventID == 0 {
+		return res
+	}
+	for _, e := range []*data.Event{
+		&data.Event{ID: 2, Generation: 2, Time: dummyModified, Kind: data.EventKindUser, Action: data.EventAdded,
+			User: &data.User{Name: "dwoodlins", UID: 1001, GID: 1001}},
+		&data.Event{ID: 3, Generation: 3, Time: dummyModified, Kind: data.EventKindGroup,
+			Action: data.EventModified, Group: &data.Group{Name: "wheel", GID: 0, Members: []string{"dwoodlins"}}},
+	} {
+		if e.ID > lastEventID {
+			res.Backlog = append(res.Backlog, e)
+		}
+	}
+	return res
+}
+
+// History has the generations 2 and 3, the current one
+func (dummyPasswdMgr) History() []*data.Version {
+	return []*data.Version{
+		&data.Version{Generation: 2, Hash: "abcd0123", Modified: dummyModified.Add(-time.Hour)},
+		&data.Version{Generation: 3, Hash: "0123abcd", Modified: dummyModified},
+	}
+}
+
+// Diff only knows the generations 2 and 3, where dwoodlins is added to wheel
+func (d dummyPasswdMgr) Diff(from, to uint64) *data.Diff {
+	history := d.History()
+	if from < 2 || from > 3 || to < 2 || to > 3 {
+		return nil
+	}
+	res := &data.Diff{From: history[from-2], To: history[to-2], Changes: []*data.EntryDiff{}}
+	if from == to {
+		return res
+	}
+	members := [][]string{{"root"}, {"root", "dwoodlins"}}
+	res.Changes = append(res.Changes, &data.EntryDiff{Kind: data.EventKindGroup, Action: data.EventModified,
+		Name: "wheel", ID: 0, Fields: []*data.FieldChange{
+			&data.FieldChange{Field: "members", From: members[from-2], To: members[to-2]},
+		}})
+	return res
+}
+
+// At has the generation 3 of the dummy data, and the generation 1 of no data at all
+func (d dummyPasswdMgr) At(generation uint64) data.Reader {
+	switch generation {
+	case 1:
+		return new(emptyPasswdMgr)
+	case 3:
+		return d
+	}
+	return nil
+}
+
+// AtTime has the dummy data since dummyModified, and no data at all two hours before
+func (d dummyPasswdMgr) AtTime(t time.Time) data.Reader {
+	switch {
+	case !t.Before(dummyModified):
+		return d
+	case !t.Before(dummyModified.Add(-2 * time.Hour)):
+		return new(emptyPasswdMgr)
+	}
+	return nil
+}
+
+func (d dummyPasswdMgr) Snapshot() data.Reader {
+	return d
+}
+
+// Reload fails to read the group file
+func (d dummyPasswdMgr) Reload(ctx context.Context) (*data.ReloadResult, error) {
+	return &data.ReloadResult{Version: d.Version(), Files: []*data.FileReload{
+		&data.FileReload{Path: "/etc/passwd", Kind: data.EventKindUser, State: data.ReloadOK},
+		&data.FileReload{Path: "/etc/group", Kind: data.EventKindGroup, State: data.ReloadFailed,
+			Error: "/etc/group:3: Malformed content broken"},
+	}}, nil
+}
+
 func assert(t *testing.T, condition bool) {
 	if !condition {
 		t.Fatal()
@@ -147,9 +417,11 @@ func TestHandlerUserFunc(t *testing.T) {
 	// verify path "user/{uid}"
 	var dummyUserJSON bytes.Buffer
 	encoder = json.NewEncoder(&dummyUserJSON)
-	err = encoder.Encode(dummyUser[0])
+	err = encoder.Encode(&userWithAccount{User: dummyUser[0], Account: dummyAccount})
 	assert(t, err == nil)
 	verifyResponse(handler, "/users/0", &dummyUserJSON, http.StatusOK, t)
+	assert(t, bytes.Contains(dummyUserJSON.Bytes(),
+		[]byte(`"account":{"locked":true,"passwordExpired":false,"accountExpired":false,"lastChange":"2019-04-14"}`)))
 
 	emptyHandler := New("", new(emptyPasswdMgr))
 	rr = httptest.NewRecorder()
@@ -166,21 +438,498 @@ func TestHandlerGroupFunc(t *testing.T) {
 	err := encoder.Encode(dummyGroup)
 	assert(t, err == nil)
 
-	for _, path := range []string{"/groups", "/groups/query?name=root", "/users/-1/groups"} {
+	for _, path := range []string{"/groups", "/groups/query?name=root", "/groups/query?admin=root"} {
 
 		verifyResponse(handler, path, &dummyGroupArrayJSON, http.StatusOK, t)
 	}
 
+	var dummyUserGroupArrayJSON bytes.Buffer
+	encoder = json.NewEncoder(&dummyUserGroupArrayJSON)
+	err = encoder.Encode(dummyUserGroup)
+	assert(t, err == nil)
+	buf := verifyResponseCode(handler, "/users/-1/groups", http.StatusOK, t)
+	assert(t, bytes.Equal(buf.Bytes(), dummyUserGroupArrayJSON.Bytes()))
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`"membership":"primary"`)))
+
 	var dummyGroupJSON bytes.Buffer
 	encoder = json.NewEncoder(&dummyGroupJSON)
 	err = encoder.Encode(dummyGroup[0])
 	assert(t, err == nil)
 	verifyResponse(handler, "/groups/0", &dummyGroupJSON, http.StatusOK, t)
+
+	var dummyGroupUsersJSON bytes.Buffer
+	encoder = json.NewEncoder(&dummyGroupUsersJSON)
+	err = encoder.Encode(dummyGroupUsers)
+	assert(t, err == nil)
+	verifyResponse(handler, "/groups/0/users", &dummyGroupUsersJSON, http.StatusOK, t)
+}
+
+func TestHandlerQueryOperators(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+	for _, path := range []string{"/users/query?uid=gte:1000&uid=lt:60000", "/users/query?shell=ne:/usr/bin/false",
+		"/users/query?home=iglob:/HOME/*&comment=", "/groups/query?member=notprefix:_&gid=gt:0"} {
+		verifyResponseCode(handler, path, http.StatusOK, t)
+	}
+
+	// the malformed operators are explained
+	for _, path := range []string{"/users/query?shell=like:/bin/sh", "/users/query?uid=gte:abc",
+		"/users/query?uid=root", "/v1/groups/query?name=regex:(", "/groups/query?gid=prefix:1"} {
+		buf := verifyResponseCode(handler, path, http.StatusBadRequest, t)
+		assert(t, bytes.HasPrefix(buf.Bytes(), []byte("Invalid")))
+	}
+
+	// the comparisons written in the key are rejected rather than ignored
+	for _, path := range []string{"/users/query?uid>=1000&uid<60000", "/users/query?name=root&member=root",
+		"/groups/query?gid!=0", "/groups/query?shell=/bin/sh&limit=1"} {
+		buf := verifyResponseCode(handler, path, http.StatusBadRequest, t)
+		assert(t, bytes.Contains(buf.Bytes(), []byte("uid=gte:1000")))
+	}
+	verifyResponseCode(handler, "/users/query?uid=gte:1000&sort=-uid&limit=1&fields=name", http.StatusOK, t)
+}
+
+func TestHandlerSearch(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+	q := url.QueryEscape(`uid >= 1000 and shell != "/usr/sbin/nologin" and memberOf("docker")`)
+	var dummyUserArrayJSON bytes.Buffer
+	assert(t, json.NewEncoder(&dummyUserArrayJSON).Encode(dummyUser) == nil)
+	verifyResponse(handler, "/users/search?q="+q, &dummyUserArrayJSON, http.StatusOK, t)
+	verifyResponseCode(handler, "/groups/search?q="+url.QueryEscape(`hasMember("root")`), http.StatusOK, t)
+
+	// explain responds with the plan instead of the result
+	buf := verifyResponseCode(handler, "/v1/users/search?explain=true&q="+q, http.StatusOK, t)
+	plan := &data.SearchPlan{}
+	assert(t, json.Unmarshal(buf.Bytes(), plan) == nil)
+	assert(t, plan.Index == "uid" && plan.Key == "0")
+	assert(t, plan.Expression == `((uid >= 1000 and shell != "/usr/sbin/nologin") and memberOf("docker"))`)
+
+	for _, path := range []string{"/users/search", "/users/search?q=", "/users/search?q=uid+%3D+0",
+		"/groups/search?q=" + q, "/users/search?explain=maybe&q=" + q} {
+		buf = verifyResponseCode(handler, path, http.StatusBadRequest, t)
+		assert(t, buf.Len() > 0)
+	}
+	buf = verifyResponseCode(handler, "/groups/search?q="+q, http.StatusBadRequest, t)
+	assert(t, strings.Contains(buf.String(), "unknown field uid"))
+
+	verifyResponseCode(New("", new(emptyPasswdMgr)), "/users/search?q="+q, http.StatusNoContent, t)
+}
+
+func TestHandlerByName(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+	var dummyUserJSON bytes.Buffer
+	assert(t, json.NewEncoder(&dummyUserJSON).Encode(dummyUser[0]) == nil)
+	verifyResponse(handler, "/users/name/root", &dummyUserJSON, http.StatusOK, t)
+	var dummyGroupJSON bytes.Buffer
+	assert(t, json.NewEncoder(&dummyGroupJSON).Encode(dummyGroup[0]) == nil)
+	verifyResponse(handler, "/v1/groups/name/wheel", &dummyGroupJSON, http.StatusOK, t)
+
+	emptyHandler := New("", new(emptyPasswdMgr))
+	_ = verifyResponseCode(emptyHandler, "/users/name/root", http.StatusNotFound, t)
+	_ = verifyResponseCode(emptyHandler, "/groups/name/wheel", http.StatusNotFound, t)
+
+	// the duplicated names are a conflict, along with all the entries
+	dir, err := ioutil.TempDir("", "name")
+	assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	passwdPath, groupPath := filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	assert(t, ioutil.WriteFile(passwdPath, []byte("root:*:0:0::/root:/bin/sh\nroot:*:1000:0::/home/root:/bin/sh\n"+
+		"machine$:*:2000:0::/:/usr/sbin/nologin\n"), 0644) == nil)
+	assert(t, ioutil.WriteFile(groupPath, []byte("wheel:*:0:root\nwheel:*:10:\n"), 0644) == nil)
+	src, err := data.NewFileSource(passwdPath, groupPath)
+	assert(t, err == nil)
+	nameMgr, err := data.NewManager([]data.Source{src})
+	assert(t, err == nil)
+	handler = New("", nameMgr)
+
+	var users []*data.User
+	buf := verifyResponseCode(handler, "/users/name/root", http.StatusConflict, t)
+	assert(t, json.Unmarshal(buf.Bytes(), &users) == nil)
+	assert(t, len(users) == 2 && users[0].UID == 0 && users[1].UID == 1000)
+	var groups []*data.Group
+	buf = verifyResponseCode(handler, "/groups/name/wheel", http.StatusConflict, t)
+	assert(t, json.Unmarshal(buf.Bytes(), &groups) == nil)
+	assert(t, len(groups) == 2 && groups[1].GID == 10)
+	buf = verifyResponseCode(handler, "/users/name/machine$", http.StatusOK, t)
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`"uid":2000`)))
+
+	// the status is only written once the body is encoded
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/users/name/root", nil)
+	assert(t, err == nil)
+	encodeJSONStatus(rr, req, http.StatusConflict, make(chan int), "Fail to encode a channel")
+	assert(t, rr.Code == http.StatusInternalServerError && rr.Body.Len() == 0)
+}
+
+func TestHandlerVersionedIDs(t *testing.T) {
+	for _, handler := range []http.Handler{
+		New("", new(dummyPasswdMgr)),
+		New("", new(dummyPasswdMgr), LegacyStringIDs()),
+	} {
+		buf := verifyResponseCode(handler, "/v1/users/0", http.StatusOK, t)
+		assert(t, bytes.Contains(buf.Bytes(), []byte(`"uid":-1,"gid":0,`)))
+		buf = verifyResponseCode(handler, "/v1/groups/0/users", http.StatusOK, t)
+		assert(t, bytes.Contains(buf.Bytes(), []byte(`"uid":-1,"gid":0,`)))
+	}
+
+	buf := verifyResponseCode(New("", new(dummyPasswdMgr)), "/users/0", http.StatusOK, t)
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`"uid":-1,"gid":0,`)))
+
+	legacyHandler := New("", new(dummyPasswdMgr), LegacyStringIDs())
+	buf = verifyResponseCode(legacyHandler, "/users/0", http.StatusOK, t)
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`"uid":"-1","gid":"0",`)))
+	buf = verifyResponseCode(legacyHandler, "/users/-1/groups", http.StatusOK, t)
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`"gid":"0",`)))
+
+	buf = verifyResponseCode(legacyHandler, "/groups/0/users", http.StatusOK, t)
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`{"name":"root","uid":"-1","gid":"0",`)))
+	buf = verifyResponseCode(legacyHandler, "/users/name/root", http.StatusOK, t)
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`"uid":"-1","gid":"0",`)))
+	// the payloads without users or groups are left as they are
+	buf = verifyResponseCode(legacyHandler, "/diff?from=2", http.StatusOK, t)
+	assert(t, bytes.Contains(buf.Bytes(), []byte(`"generation":2,`)) && bytes.Contains(buf.Bytes(), []byte(`"id":0,`)))
+
+	// only the IDs are encoded differently
+	buf = verifyResponseCode(legacyHandler, "/users", http.StatusOK, t)
+	numeric := verifyResponseCode(legacyHandler, "/v1/users", http.StatusOK, t)
+	assert(t, buf.String() == strings.Replace(strings.Replace(numeric.String(), `"uid":-1`, `"uid":"-1"`, 1),
+		`"gid":0`, `"gid":"0"`, 1))
+
+	// the uid inside a string value is not touched
+	user := *dummyUser[0]
+	user.Comment = `"uid":1`
+	req, err := http.NewRequest("GET", "/users/0", nil)
+	assert(t, err == nil)
+	req = req.WithContext(context.WithValue(req.Context(), legacyStringIDsKey, true))
+	encoded, err := marshalJSON(req, &user)
+	assert(t, err == nil)
+	assert(t, string(encoded) ==
+		`{"name":"root","uid":"-1","gid":"0","comment":"\"uid\":1","home":"/var/root","shell":"/bin/sh"}`+"\n")
+
+	_ = verifyResponseCode(legacyHandler, "/users/99999999999999999999", http.StatusBadRequest, t)
+}
+
+func TestHandlerParseDiagnostics(t *testing.T) {
+	var dummyDiagnosticsJSON bytes.Buffer
+	encoder := json.NewEncoder(&dummyDiagnosticsJSON)
+	err := encoder.Encode(dummyDiagnostics)
+	assert(t, err == nil)
+	verifyResponse(New("", new(dummyPasswdMgr)), "/diagnostics/parse", &dummyDiagnosticsJSON, http.StatusOK, t)
+
+	_ = verifyResponseCode(New("", new(emptyPasswdMgr)), "/diagnostics/parse", http.StatusNoContent, t)
+}
+
+func TestHandlerStatus(t *testing.T) {
+	var dummyStatusJSON bytes.Buffer
+	encoder := json.NewEncoder(&dummyStatusJSON)
+	err := encoder.Encode(dummyStatus)
+	assert(t, err == nil)
+	verifyResponse(New("", new(dummyPasswdMgr)), "/status", &dummyStatusJSON, http.StatusOK, t)
+
+	buf := verifyResponseCode(New("", new(dummyPasswdMgr)), "/health", http.StatusServiceUnavailable, t)
+	assert(t, buf.String() == "{\"status\":\"degraded\"}\n")
+	buf = verifyResponseCode(New("", new(emptyPasswdMgr)), "/health", http.StatusOK, t)
+	assert(t, buf.String() == "{\"status\":\"ok\"}\n")
+}
+
+func TestHandlerLint(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+
+	var report data.LintReport
+	buf := verifyResponseCode(handler, "/lint", http.StatusOK, t)
+	assert(t, json.Unmarshal(buf.Bytes(), &report) == nil)
+	assert(t, report.Errors == 1 && report.Warnings == 1 && len(report.Issues) == 2)
+
+	buf = verifyResponseCode(handler, "/lint?severity=error", http.StatusOK, t)
+	assert(t, json.Unmarshal(buf.Bytes(), &report) == nil)
+	assert(t, report.Errors == 1 && report.Warnings == 0 && len(report.Issues) == 1)
+
+	_ = verifyResponseCode(handler, "/lint?severity=fatal", http.StatusBadRequest, t)
+
+	buf = verifyResponseCode(New("", new(emptyPasswdMgr)), "/lint", http.StatusOK, t)
+	assert(t, buf.String() == "{\"errors\":0,\"warnings\":0,\"infos\":0,\"issues\":[]}\n")
+}
+
+func TestHandlerConditionalRequest(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		assert(t, err == nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/users", nil)
+	assert(t, rr.Code == http.StatusOK)
+	assert(t, rr.Header().Get("ETag") == `"0123abcd"`)
+	assert(t, rr.Header().Get("Last-Modified") == "Sun, 14 Apr 2019 10:30:00 GMT")
+
+	for _, path := range []string{"/users", "/v1/groups", "/groups/0/users", "/users/query?name=root", "/lint"} {
+		rr = get(path, map[string]string{"If-None-Match": `"0123abcd"`})
+		assert(t, rr.Code == http.StatusNotModified)
+		assert(t, rr.Body.Len() == 0)
+		assert(t, rr.Header().Get("ETag") == `"0123abcd"`)
+	}
+	assert(t, get("/groups", map[string]string{"If-None-Match": `"old", W/"0123abcd"`}).Code == http.StatusNotModified)
+	assert(t, get("/groups", map[string]string{"If-None-Match": "*"}).Code == http.StatusNotModified)
+	assert(t, get("/groups", map[string]string{"If-None-Match": `"old"`}).Code == http.StatusOK)
+
+	assert(t, get("/groups", map[string]string{"If-Modified-Since": "Sun, 14 Apr 2019 10:30:00 GMT"}).Code ==
+		http.StatusNotModified)
+	assert(t, get("/groups", map[string]string{"If-Modified-Since": "Sun, 14 Apr 2019 10:29:59 GMT"}).Code ==
+		http.StatusOK)
+	assert(t, get("/groups", map[string]string{"If-Modified-Since": "yesterday"}).Code == http.StatusOK)
+	// If-None-Match takes precedence
+	assert(t, get("/groups", map[string]string{
+		"If-None-Match":     `"old"`,
+		"If-Modified-Since": "Sun, 14 Apr 2019 10:30:00 GMT",
+	}).Code == http.StatusOK)
+
+	// the account status of a user depends on the current date
+	rr = get("/users/0", map[string]string{"If-None-Match": `"0123abcd"`})
+	assert(t, rr.Code == http.StatusOK)
+	assert(t, len(rr.Header().Get("ETag")) == 0)
+
+	// the kept snapshots expire while the content does not change
+	rr = get("/history", map[string]string{"If-None-Match": `"0123abcd"`})
+	assert(t, rr.Code == http.StatusOK && len(rr.Header().Get("ETag")) == 0)
+	rr = get("/diff?from=1", map[string]string{"If-None-Match": `"0123abcd"`})
+	assert(t, rr.Code == http.StatusNotFound && len(rr.Header().Get("ETag")) == 0)
+}
+
+func TestHandlerEvents(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr), LegacyStringIDs())
+	userEvent := "id: 2\nevent: user-added\ndata: {\"id\":2,\"generation\":2,\"time\":\"2019-04-14T10:30:00Z\"," +
+		"\"kind\":\"user\",\"action\":\"added\",\"user\":{\"name\":\"dwoodlins\",\"uid\":1001,\"gid\":1001," +
+		"\"comment\":\"\",\"home\":\"\",\"shell\":\"\"}}\n\n"
+	groupEvent := "id: 3\nevent: group-modified\ndata: {\"id\":3,\"generation\":3,\"time\":\"2019-04-14T10:30:00Z\"," +
+		"\"kind\":\"group\",\"action\":\"modified\",\"group\":{\"name\":\"wheel\",\"gid\":0," +
+		"\"members\":[\"dwoodlins\"]}}\n\n"
+
+	get := func(path, lastEventID string, expectedStatus int) string {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		assert(t, err == nil)
+		if len(lastEventID) > 0 {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		handler.ServeHTTP(rr, req)
+		assert(t, rr.Code == expectedStatus)
+		if expectedStatus == http.StatusOK {
+			assert(t, rr.Header().Get("Content-Type") == "text/event-stream")
+		}
+		return rr.Body.String()
+	}
+
+	assert(t, get("/v1/events", "", http.StatusOK) == "")
+	assert(t, get("/v1/events", "1", http.StatusOK) == userEvent+groupEvent)
+	assert(t, get("/v1/events", "2", http.StatusOK) == groupEvent)
+	assert(t, get("/v1/events?lastEventId=2", "", http.StatusOK) == groupEvent)
+	// the header takes precedence
+	assert(t, get("/v1/events?lastEventId=2", "1", http.StatusOK) == userEvent+groupEvent)
+	assert(t, get("/v1/events?kind=user", "1", http.StatusOK) == userEvent)
+	assert(t, get("/v1/events?kind=group", "1", http.StatusOK) == groupEvent)
+	assert(t, get("/v1/events?id=1001", "1", http.StatusOK) == userEvent)
+	assert(t, get("/v1/events?kind=group&id=1001", "1", http.StatusOK) == "")
+	assert(t, get("/v1/events", "5", http.StatusOK) == "event: resync\ndata: {}\n\n")
+
+	// the legacy mode applies to the events as well
+	legacy := strings.Replace(groupEvent, `"gid":0`, `"gid":"0"`, 1)
+	assert(t, get("/events", "2", http.StatusOK) == legacy)
+
+	_ = get("/events?kind=host", "", http.StatusBadRequest)
+	_ = get("/events?id=root", "", http.StatusBadRequest)
+	_ = get("/events", "-1", http.StatusBadRequest)
+}
+
+func TestHandlerEventsWriteTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	passwdPath, groupPath := filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	passwd, err := ioutil.ReadFile("../testData/passwd")
+	assert(t, err == nil)
+	assert(t, ioutil.WriteFile(passwdPath, passwd, 0644) == nil)
+	group, err := ioutil.ReadFile("../testData/group")
+	assert(t, err == nil)
+	assert(t, ioutil.WriteFile(groupPath, group, 0644) == nil)
+	src, err := data.NewFileSource(passwdPath, groupPath)
+	assert(t, err == nil)
+	eventMgr, err := data.NewManager([]data.Source{src})
+	assert(t, err == nil)
+
+	server := httptest.NewUnstartedServer(New("", eventMgr))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/v1/events")
+	assert(t, err == nil)
+	defer resp.Body.Close()
+	assert(t, resp.StatusCode == http.StatusOK)
+
+	// an event sent after the write timeout still reaches the client
+	time.Sleep(3 * server.Config.WriteTimeout)
+	assert(t, ioutil.WriteFile(passwdPath, append(passwd, "app:*:2000:2000::/srv/app:/bin/sh\n"...), 0644) == nil)
+	_, err = eventMgr.Reload(context.Background())
+	assert(t, err == nil)
+	buf := make([]byte, 4096)
+	n, err := resp.Body.Read(buf)
+	assert(t, err == nil && strings.HasPrefix(string(buf[:n]), "id: 1\nevent: user-added\n"))
+}
+
+func TestHandlerEventsShutdown(t *testing.T) {
+	src, err := data.NewFileSource("../testData/passwd", "../testData/group")
+	assert(t, err == nil)
+	eventMgr, err := data.NewManager([]data.Source{src})
+	assert(t, err == nil)
+	stop := make(chan struct{})
+	server := httptest.NewServer(New("", eventMgr, StopEvents(stop)))
+	defer server.Close()
+	server.Config.RegisterOnShutdown(func() { close(stop) })
+
+	resp, err := http.Get(server.URL + "/v1/events")
+	assert(t, err == nil)
+	defer resp.Body.Close()
+	assert(t, resp.StatusCode == http.StatusOK)
+
+	// the shutdown does not wait for the client to go away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert(t, server.Config.Shutdown(ctx) == nil)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert(t, err == nil)
+}
+
+func TestHandlerWebhookDeliveries(t *testing.T) {
+	_ = verifyResponseCode(New("", new(dummyPasswdMgr)), "/webhooks/deliveries", http.StatusNoContent, t)
+
+	dispatcher, err := webhook.New([]config.WebhookConfig{{URL: "https://example.com/hook"}}, "")
+	assert(t, err == nil)
+	handler := New("", new(dummyPasswdMgr), WebhookDeliveries(dispatcher))
+	_ = verifyResponseCode(handler, "/v1/webhooks/deliveries", http.StatusNoContent, t)
+
+	// a delivery left in the queue by a previous run
+	queueDir, err := ioutil.TempDir("", "webhooks")
+	assert(t, err == nil)
+	defer os.RemoveAll(queueDir)
+	assert(t, ioutil.WriteFile(filepath.Join(queueDir, "0001.json"), []byte(`{"delivery": {"id": "0001",
+		"url": "https://example.com/hook", "event": "group-modified", "eventId": 3, "status": "pending"},
+		"body": {}}`), 0600) == nil)
+	dispatcher, err = webhook.New([]config.WebhookConfig{{URL: "https://example.com/hook"}}, queueDir)
+	assert(t, err == nil)
+	handler = New("", new(dummyPasswdMgr), WebhookDeliveries(dispatcher))
+
+	var deliveries []*webhook.Delivery
+	buf := verifyResponseCode(handler, "/v1/webhooks/deliveries", http.StatusOK, t)
+	assert(t, json.Unmarshal(buf.Bytes(), &deliveries) == nil)
+	assert(t, len(deliveries) == 1)
+	assert(t, deliveries[0].ID == "0001" && deliveries[0].Status == webhook.DeliveryPending)
+	assert(t, deliveries[0].EventID == 3)
+}
+
+func TestHandlerHistory(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+
+	var versions []*data.Version
+	buf := verifyResponseCode(handler, "/v1/history", http.StatusOK, t)
+	assert(t, json.Unmarshal(buf.Bytes(), &versions) == nil)
+	assert(t, len(versions) == 2 && versions[0].Generation == 2 && versions[1].Generation == 3)
+
+	expected := bytes.NewBufferString(`{"from":{"generation":2,"hash":"abcd0123","modified":"2019-04-14T09:30:00Z"},` +
+		`"to":{"generation":3,"hash":"0123abcd","modified":"2019-04-14T10:30:00Z"},"changes":[{"kind":"group",` +
+		`"action":"modified","name":"wheel","id":0,"fields":[{"field":"members","from":["root"],` +
+		`"to":["root","dwoodlins"]}]}]}` + "\n")
+	// to is the current generation by default
+	verifyResponse(handler, "/v1/diff?from=2", expected, http.StatusOK, t)
+	verifyResponse(handler, "/v1/diff?from=2&to=3", expected, http.StatusOK, t)
+
+	var res data.Diff
+	buf = verifyResponseCode(handler, "/v1/diff?from=3&to=2", http.StatusOK, t)
+	assert(t, json.Unmarshal(buf.Bytes(), &res) == nil)
+	assert(t, res.From.Generation == 3 && res.To.Generation == 2 && len(res.Changes) == 1)
+
+	_ = verifyResponseCode(handler, "/v1/diff?from=1", http.StatusNotFound, t)
+	_ = verifyResponseCode(handler, "/v1/diff?from=2&to=4", http.StatusNotFound, t)
+	_ = verifyResponseCode(handler, "/v1/diff", http.StatusBadRequest, t)
+	_ = verifyResponseCode(handler, "/v1/diff?from=-1", http.StatusBadRequest, t)
+	_ = verifyResponseCode(handler, "/v1/diff?from=2&to=latest", http.StatusBadRequest, t)
+	_ = verifyResponseCode(New("", new(emptyPasswdMgr)), "/v1/diff?from=1", http.StatusNotFound, t)
+}
+
+func TestHandlerAdminReload(t *testing.T) {
+	reload := func(handler http.Handler, path, auth string, expectedStatus int) *bytes.Buffer {
+		rr := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", path, nil)
+		assert(t, err == nil)
+		if len(auth) > 0 {
+			req.Header.Set("Authorization", auth)
+		}
+		handler.ServeHTTP(rr, req)
+		assert(t, rr.Code == expectedStatus)
+		return rr.Body
+	}
+
+	// not served without an admin token
+	_ = reload(New("", new(emptyPasswdMgr)), "/admin/reload", "Bearer s3cret", http.StatusNotFound)
+
+	handler := New("", new(emptyPasswdMgr), AdminToken("s3cret"))
+	_ = reload(handler, "/admin/reload", "", http.StatusUnauthorized)
+	_ = reload(handler, "/admin/reload", "Bearer wrong", http.StatusUnauthorized)
+	_ = reload(handler, "/admin/reload", "Basic s3cret", http.StatusUnauthorized)
+	_ = verifyResponseCode(handler, "/admin/reload", http.StatusMethodNotAllowed, t)
+	var res data.ReloadResult
+	buf := reload(handler, "/v1/admin/reload", "Bearer s3cret", http.StatusOK)
+	assert(t, json.Unmarshal(buf.Bytes(), &res) == nil)
+	assert(t, res.OK && res.Version.Generation == 1)
+
+	// the failed files are reported
+	handler = New("", new(dummyPasswdMgr), AdminToken("s3cret"))
+	buf = reload(handler, "/admin/reload", "Bearer s3cret", http.StatusUnprocessableEntity)
+	assert(t, json.Unmarshal(buf.Bytes(), &res) == nil)
+	assert(t, !res.OK && len(res.Files) == 2)
+	assert(t, res.Files[1].State == data.ReloadFailed && res.Files[1].Path == "/etc/group")
+}
+
+func TestHandlerTimeTravel(t *testing.T) {
+	handler := New("", new(dummyPasswdMgr))
+	current := verifyResponseCode(handler, "/v1/users", http.StatusOK, t).String()
+
+	assert(t, verifyResponseCode(handler, "/v1/users?generation=3", http.StatusOK, t).String() == current)
+	_ = verifyResponseCode(handler, "/v1/users?generation=1", http.StatusNoContent, t)
+	_ = verifyResponseCode(handler, "/v1/users?generation=2", http.StatusNotFound, t)
+	_ = verifyResponseCode(handler, "/v1/users?generation=latest", http.StatusBadRequest, t)
+
+	assert(t, verifyResponseCode(handler, "/v1/users?at=2019-04-14T10:30:00Z", http.StatusOK, t).String() ==
+		current)
+	_ = verifyResponseCode(handler, "/v1/groups?at=2019-04-14T10:29:59Z", http.StatusNoContent, t)
+	_ = verifyResponseCode(handler, "/v1/groups?at=2019-04-14T14:29:59%2B04:00", http.StatusNoContent, t)
+	_ = verifyResponseCode(handler, "/v1/groups?at=2019-04-14T08:29:59Z", http.StatusNotFound, t)
+	_ = verifyResponseCode(handler, "/v1/groups?at=yesterday", http.StatusBadRequest, t)
+	_ = verifyResponseCode(handler, "/v1/groups?at=2019-04-14T10:30:00Z&generation=3", http.StatusBadRequest, t)
+
+	// every read endpoint supports it
+	for _, path := range []string{"/users/query?name=root&", "/users/0?", "/users/0/groups?", "/groups/0?",
+		"/groups/0/users?", "/groups/query?name=wheel&", "/diagnostics/parse?"} {
+		_ = verifyResponseCode(handler, path+"generation=3", http.StatusOK, t)
+		_ = verifyResponseCode(handler, path+"generation=2", http.StatusNotFound, t)
+	}
+	_ = verifyResponseCode(handler, "/lint?generation=1", http.StatusOK, t)
+
+	// the version is the one of the snapshot
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/v1/groups?generation=1", nil)
+	assert(t, err == nil)
+	req.Header.Set("If-None-Match", `"empty"`)
+	handler.ServeHTTP(rr, req)
+	assert(t, rr.Code == http.StatusNotModified)
 }
 
 func TestHandlerEmptyGroupFunc(t *testing.T) {
 	emptyHandler := New("", new(emptyPasswdMgr))
 	_ = verifyResponseCode(emptyHandler, "/group/0", http.StatusNotFound, t)
+	_ = verifyResponseCode(emptyHandler, "/groups/0/users", http.StatusNotFound, t)
 
 	for _, path := range []string{"/groups", "/groups/query?name=root"} {
 		_ = verifyResponseCode(emptyHandler, path, http.StatusNoContent, t)
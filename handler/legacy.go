@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"github.com/chaowang101/paas/data"
+)
+
+// legacyUser is a data.User encoding its IDs as JSON strings. It is converted from a data.User, so that it no
+// longer compiles if their fields differ.
+type legacyUser struct {
+	Name    string `json:"name"`
+	UID     int    `json:"uid,string"`
+	GID     int    `json:"gid,string"`
+	Comment string `json:"comment"`
+	Home    string `json:"home"`
+	Shell   string `json:"shell"`
+	Source  string `json:"source,omitempty"`
+}
+
+// legacyGroup is a data.Group encoding its GID as a JSON string
+type legacyGroup struct {
+	Name          string   `json:"name"`
+	GID           int      `json:"gid,string"`
+	Members       []string `json:"members"`
+	Admins        []string `json:"admins,omitempty"`
+	ShadowMembers []string `json:"shadowMembers,omitempty"`
+	Source        string   `json:"source,omitempty"`
+}
+
+type legacyUserWithAccount struct {
+	*legacyUser
+	Account *data.Account `json:"account,omitempty"`
+}
+
+type legacyUserGroup struct {
+	*legacyGroup
+	Membership data.Membership `json:"membership"`
+}
+
+type legacyGroupMember struct {
+	*legacyUser
+	Membership data.Membership `json:"membership"`
+}
+
+type legacyGroupUsers struct {
+	Users      []*legacyGroupMember `json:"users"`
+	Unresolved []string             `json:"unresolved"`
+}
+
+// legacyEvent shadows the entries of the embedded data.Event
+type legacyEvent struct {
+	*data.Event
+	User          *legacyUser  `json:"user,omitempty"`
+	Group         *legacyGroup `json:"group,omitempty"`
+	PreviousUser  *legacyUser  `json:"previousUser,omitempty"`
+	PreviousGroup *legacyGroup `json:"previousGroup,omitempty"`
+}
+
+func newLegacyUser(user *data.User) *legacyUser {
+	if user == nil {
+		return nil
+	}
+	res := legacyUser(*user)
+	return &res
+}
+
+func newLegacyUsers(users []*data.User) []*legacyUser {
+	if users == nil {
+		return nil
+	}
+	res := make([]*legacyUser, len(users))
+	for i, u := range users {
+		res[i] = newLegacyUser(u)
+	}
+	return res
+}
+
+func newLegacyGroup(group *data.Group) *legacyGroup {
+	if group == nil {
+		return nil
+	}
+	return &legacyGroup{
+		Name:          group.Name,
+		GID:           group.GID,
+		Members:       group.Members,
+		Admins:        group.Admins,
+		ShadowMembers: group.ShadowMembers,
+		Source:        group.Source,
+	}
+}
+
+func newLegacyGroups(groups []*data.Group) []*legacyGroup {
+	if groups == nil {
+		return nil
+	}
+	res := make([]*legacyGroup, len(groups))
+	for i, g := range groups {
+		res[i] = newLegacyGroup(g)
+	}
+	return res
+}
+
+// legacyView returns the users and groups of v with their IDs encoded as JSON strings, the payloads without
+// users or groups are returned as they are
+func legacyView(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *data.User:
+		return newLegacyUser(v)
+	case []*data.User:
+		return newLegacyUsers(v)
+	case *data.Group:
+		return newLegacyGroup(v)
+	case []*data.Group:
+		return newLegacyGroups(v)
+	case *userWithAccount:
+		return &legacyUserWithAccount{legacyUser: newLegacyUser(v.User), Account: v.Account}
+	case []*data.UserGroup:
+		res := make([]*legacyUserGroup, len(v))
+		for i, g := range v {
+			res[i] = &legacyUserGroup{legacyGroup: newLegacyGroup(g.Group), Membership: g.Membership}
+		}
+		return res
+	case *data.GroupUsers:
+		res := &legacyGroupUsers{Unresolved: v.Unresolved}
+		if v.Users != nil {
+			res.Users = make([]*legacyGroupMember, len(v.Users))
+			for i, u := range v.Users {
+				res.Users[i] = &legacyGroupMember{legacyUser: newLegacyUser(u.User), Membership: u.Membership}
+			}
+		}
+		return res
+	case *data.Event:
+		return &legacyEvent{
+			Event:         v,
+			User:          newLegacyUser(v.User),
+			Group:         newLegacyGroup(v.Group),
+			PreviousUser:  newLegacyUser(v.PreviousUser),
+			PreviousGroup: newLegacyGroup(v.PreviousGroup),
+		}
+	}
+	return v
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chaowang101/paas/data"
+)
+
+const (
+	// the pagination of the lists, the pages of a cursor are the ones of the snapshot it was made on
+	pageQryLimit  = "limit"
+	pageQryCursor = "cursor"
+	pageQrySort   = "sort"
+
+	// the sort keys are the fields, in ascending order unless prefixed by descendingPrefix, e.g. -uid
+	descendingPrefix = "-"
+
+	totalCountHeader = "X-Total-Count"
+	linkHeader       = "Link"
+)
+
+var userSortKeys = []string{qryName, descendingPrefix + qryName, qryUID, descendingPrefix + qryUID}
+var groupSortKeys = []string{qryName, descendingPrefix + qryName, qryGID, descendingPrefix + qryGID}
+
+// the query keys that do not change the list being paginated
+var pageQryKeys = map[string]bool{
+	pageQryLimit:  true,
+	pageQryCursor: true,
+	qryGeneration: true,
+	qryAt:         true,
+	qryFields:     true,
+}
+
+// cursor is the position of a page in a list of a snapshot, handed to the clients as an opaque token
+type cursor struct {
+	Generation uint64 `json:"g"`
+	Offset     int    `json:"o"`
+	// Query is the fingerprint of the query the cursor was made for, see queryFingerprint
+	Query uint32 `json:"q"`
+}
+
+func (c *cursor) encode() string {
+	// the marshaling of integers never fails
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (*cursor, error) {
+	res := &cursor{}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(b, res)
+	}
+	if err != nil || res.Offset < 0 {
+		return nil, fmt.Errorf("Invalid cursor %s", token)
+	}
+	return res, nil
+}
+
+// queryFingerprint hashes the query of r but the pagination, so that a cursor is only used along with the
+// filters and the sort it was made for
+func queryFingerprint(r *http.Request) uint32 {
+	v := r.URL.Query()
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		if !pageQryKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	h := fnv.New32a()
+	for _, key := range keys {
+		for _, value := range v[key] {
+			fmt.Fprintf(h, "%s=%s&", key, value)
+		}
+	}
+	return h.Sum32()
+}
+
+// page is the part of a list requested by the pagination query of a request
+type page struct {
+	// limit is 0 when the list is not paginated
+	limit  int
+	sort   string
+	offset int
+	query  uint32
+}
+
+// parsePage parses the pagination query of r, sortKeys are the keys the list can be sorted by. The
+// generation of the cursor is checked by readerAt.
+func parsePage(r *http.Request, sortKeys []string) (*page, error) {
+	v := r.URL.Query()
+	res := &page{sort: v.Get(pageQrySort), query: queryFingerprint(r)}
+	if limit := v.Get(pageQryLimit); len(limit) > 0 {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid limit %s, expecting a positive integer", limit)
+		}
+		res.limit = n
+	}
+
+	if len(res.sort) > 0 {
+		valid := false
+		for _, key := range sortKeys {
+			valid = valid || key == res.sort
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid sort %s, expecting one of %s", res.sort, strings.Join(sortKeys, ", "))
+		}
+	}
+
+	if token := v.Get(pageQryCursor); len(token) > 0 {
+		c, err := decodeCursor(token)
+		if err != nil {
+			return nil, err
+		}
+		if c.Query != res.query {
+			return nil, fmt.Errorf("The cursor was made for another query")
+		}
+		res.offset = c.Offset
+	}
+	return res, nil
+}
+
+// bounds returns the range of the page in a list of total entries
+func (p *page) bounds(total int) (int, int) {
+	start, end := p.offset, total
+	if start > total {
+		start = total
+	}
+	if p.limit > 0 && start+p.limit < total {
+		end = start + p.limit
+	}
+	return start, end
+}
+
+// setHeaders sets the total count of the list, and the links to the first, previous and next pages of the
+// snapshot of generation
+func (p *page) setHeaders(w http.ResponseWriter, r *http.Request, generation uint64, total int) {
+	w.Header().Set(totalCountHeader, strconv.Itoa(total))
+	if p.limit == 0 {
+		return
+	}
+
+	var links []string
+	link := func(offset int, rel string) {
+		v := r.URL.Query()
+		// the cursor carries the snapshot
+		v.Del(qryGeneration)
+		v.Del(qryAt)
+		v.Set(pageQryCursor, (&cursor{Generation: generation, Offset: offset, Query: p.query}).encode())
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, v.Encode(), rel))
+	}
+	start, end := p.bounds(total)
+	link(0, "first")
+	if start > 0 {
+		prev := start - p.limit
+		if prev < 0 {
+			prev = 0
+		}
+		link(prev, "prev")
+	}
+	if end < total {
+		link(end, "next")
+	}
+	w.Header().Set(linkHeader, strings.Join(links, ", "))
+}
+
+// sortKey returns the field of key, and whether it is in descending order
+func sortKey(key string) (string, bool) {
+	return strings.TrimPrefix(key, descendingPrefix), strings.HasPrefix(key, descendingPrefix)
+}
+
+// pageUsers sorts users of reader and returns the page requested by r, or false after responding 400 if the
+// pagination query is invalid
+func pageUsers(reader data.Reader, users []*data.User, w http.ResponseWriter, r *http.Request) ([]*data.User,
+	bool) {
+	p, err := parsePage(r, userSortKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if len(p.sort) > 0 {
+		// the users are shared by the snapshot
+		users = append([]*data.User{}, users...)
+		field, descending := sortKey(p.sort)
+		sort.SliceStable(users, func(i, j int) bool {
+			a, b := users[i], users[j]
+			if descending {
+				a, b = b, a
+			}
+			if field == qryName {
+				return a.Name < b.Name
+			}
+			return a.UID < b.UID
+		})
+	}
+
+	p.setHeaders(w, r, reader.Version().Generation, len(users))
+	start, end := p.bounds(len(users))
+	return users[start:end], true
+}
+
+// pageGroups sorts groups of reader and returns the page requested by r, see pageUsers
+func pageGroups(reader data.Reader, groups []*data.Group, w http.ResponseWriter, r *http.Request) ([]*data.Group,
+	bool) {
+	p, err := parsePage(r, groupSortKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if len(p.sort) > 0 {
+		groups = append([]*data.Group{}, groups...)
+		field, descending := sortKey(p.sort)
+		sort.SliceStable(groups, func(i, j int) bool {
+			a, b := groups[i], groups[j]
+			if descending {
+				a, b = b, a
+			}
+			if field == qryName {
+				return a.Name < b.Name
+			}
+			return a.GID < b.GID
+		})
+	}
+
+	p.setHeaders(w, r, reader.Version().Generation, len(groups))
+	start, end := p.bounds(len(groups))
+	return groups[start:end], true
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/chaowang101/paas/data"
+)
+
+var linkPattern = regexp.MustCompile(`<([^>]*)>; rel="([a-z]+)"`)
+
+// getPage returns the response to path along with its links by relation
+func getPage(handler http.Handler, path string, expectedStatus int, t *testing.T) (*httptest.ResponseRecorder,
+	map[string]string) {
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", path, nil)
+	assert(t, err == nil)
+	handler.ServeHTTP(rr, req)
+	assert(t, rr.Code == expectedStatus)
+	links := make(map[string]string)
+	for _, match := range linkPattern.FindAllStringSubmatch(rr.Header().Get(linkHeader), -1) {
+		links[match[2]] = match[1]
+	}
+	return rr, links
+}
+
+func pageUIDs(rr *httptest.ResponseRecorder, t *testing.T) []int {
+	var users []*data.User
+	assert(t, json.Unmarshal(rr.Body.Bytes(), &users) == nil)
+	var res []int
+	for _, u := range users {
+		res = append(res, u.UID)
+	}
+	return res
+}
+
+func equalInts(a []int, b ...int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHandlerPagination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "page")
+	assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	passwdPath, groupPath := filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	passwd, err := ioutil.ReadFile("../testData/passwd")
+	assert(t, err == nil)
+	assert(t, ioutil.WriteFile(passwdPath, passwd, 0644) == nil)
+	group, err := ioutil.ReadFile("../testData/group")
+	assert(t, err == nil)
+	assert(t, ioutil.WriteFile(groupPath, group, 0644) == nil)
+	src, err := data.NewFileSource(passwdPath, groupPath)
+	assert(t, err == nil)
+	pageMgr, err := data.NewManager([]data.Source{src}, data.WithHistory(2, 0))
+	assert(t, err == nil)
+	handler := New("", pageMgr)
+
+	// the pages of the first snapshot
+	rr, links := getPage(handler, "/v1/users?sort=-uid&limit=4", http.StatusOK, t)
+	assert(t, rr.Header().Get(totalCountHeader) == "6")
+	assert(t, equalInts(pageUIDs(rr, t), 24, 13, 4, 1))
+	assert(t, len(links) == 2 && len(links["first"]) > 0 && len(links["prev"]) == 0)
+	next := links["next"]
+	rr, links = getPage(handler, next, http.StatusOK, t)
+	assert(t, equalInts(pageUIDs(rr, t), 0, -2))
+	assert(t, len(links["prev"]) > 0 && len(links["next"]) == 0)
+	rr, _ = getPage(handler, links["prev"], http.StatusOK, t)
+	assert(t, equalInts(pageUIDs(rr, t), 24, 13, 4, 1))
+
+	// a cursor keeps reading its snapshot after a reload
+	assert(t, ioutil.WriteFile(passwdPath, append(passwd, "app:*:2000:2000::/srv/app:/bin/sh\n"...), 0644) == nil)
+	_, err = pageMgr.Reload(context.Background())
+	assert(t, err == nil)
+	rr, _ = getPage(handler, next, http.StatusOK, t)
+	assert(t, equalInts(pageUIDs(rr, t), 0, -2))
+	rr, _ = getPage(handler, "/v1/users?sort=uid&limit=4", http.StatusOK, t)
+	assert(t, rr.Header().Get(totalCountHeader) == "7")
+	assert(t, equalInts(pageUIDs(rr, t), -2, 0, 1, 4))
+
+	// the queries are paginated too, and a cursor only applies to the query it was made for
+	rr, links = getPage(handler, "/users/query?shell=/usr/bin/false&limit=1&sort=name", http.StatusOK, t)
+	assert(t, rr.Header().Get(totalCountHeader) == "4" && equalInts(pageUIDs(rr, t), 24))
+	_, _ = getPage(handler, links["next"], http.StatusOK, t)
+	_, _ = getPage(handler, links["next"]+"&sort=uid", http.StatusBadRequest, t)
+	rr, _ = getPage(handler, "/groups?sort=-gid&limit=3", http.StatusOK, t)
+	assert(t, rr.Header().Get(totalCountHeader) == "8")
+	var groups []*data.Group
+	assert(t, json.Unmarshal(rr.Body.Bytes(), &groups) == nil)
+	assert(t, len(groups) == 3 && groups[0].GID == 399 && groups[2].GID == 29)
+	rr, _ = getPage(handler, "/groups/query?gid=gt:1000&limit=3", http.StatusNoContent, t)
+	assert(t, rr.Header().Get(totalCountHeader) == "0")
+
+	// the cursor expires along with its snapshot
+	assert(t, ioutil.WriteFile(passwdPath, passwd, 0644) == nil)
+	_, err = pageMgr.Reload(context.Background())
+	assert(t, err == nil)
+	_, _ = getPage(handler, next, http.StatusGone, t)
+
+	for _, path := range []string{"/users?limit=0", "/users?limit=ten", "/users?sort=shell", "/groups?sort=uid",
+		"/users?cursor=garbage", next + "&generation=1", "/users/query?uid=gte:0&limit=-1"} {
+		_, _ = getPage(handler, path, http.StatusBadRequest, t)
+	}
+}
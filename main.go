@@ -9,30 +9,37 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
 	"time"
 
 	"github.com/chaowang101/paas/config"
 	"github.com/chaowang101/paas/data"
 	"github.com/chaowang101/paas/handler"
+	"github.com/chaowang101/paas/webhook"
 )
 
 const (
 	logFilePerm = 0644
 	logFlags    = log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile | log.LUTC
+	// the time given to the requests in progress to complete on exit
+	shutdownTimeout = 30 * time.Second
 )
 
+// openLog opens or creates the log file at logFilePath, or returns stdout if logFilePath is empty
+func openLog(logFilePath string) (io.WriteCloser, error) {
+	if len(logFilePath) == 0 {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, logFilePerm)
+}
+
 // TODO: upgrade the logger with more sophisticated log level control, like INFO,DEBUG,VERBOSE
-func initLog(logFilePath string) (res io.WriteCloser) {
-	if len(logFilePath) != 0 {
-		f, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, logFilePerm)
-		if err != nil {
-			fmt.Fprintf(os.Stdout, "Fail to open or create the log file %s\n", logFilePath)
-			os.Exit(-1)
-		}
-		res = f
-	} else {
-		res = os.Stdout
+func initLog(logFilePath string) io.WriteCloser {
+	res, err := openLog(logFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "Fail to open or create the log file %s\n", logFilePath)
+		os.Exit(-1)
 	}
 
 	log.SetOutput(res)
@@ -40,6 +47,66 @@ func initLog(logFilePath string) (res io.WriteCloser) {
 	return res
 }
 
+// liveConfig applies the changes of the configuration file that are safe while running, i.e. the log file
+// and the sources. The other settings only apply after a restart.
+type liveConfig struct {
+	configFile     string
+	logFilePath    string
+	logWriteCloser io.WriteCloser
+	sources        []config.SourceConfig
+}
+
+// reload is called by data.Manager.Reload, it returns the new sources if their settings have changed. Their
+// settings are recorded once they are served, so that a failure to start them is tried again by the next
+// reload.
+func (c *liveConfig) reload() ([]data.Source, func(), error) {
+	setting, err := config.Init(c.configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the sources are instantiated first, as they check their settings
+	var sources []data.Source
+	var applied func()
+	sourceConfigs := setting.SourceConfigs()
+	if !reflect.DeepEqual(sourceConfigs, c.sources) {
+		if sources, err = data.NewSources(sourceConfigs); err != nil {
+			return nil, nil, err
+		}
+		applied = func() {
+			c.sources = sourceConfigs
+		}
+	}
+
+	if setting.LogFilePath != c.logFilePath {
+		logWriteCloser, err := openLog(setting.LogFilePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Log to %q from now on\n", setting.LogFilePath)
+		log.SetOutput(logWriteCloser)
+		if c.logWriteCloser != os.Stdout {
+			c.logWriteCloser.Close()
+		}
+		c.logFilePath, c.logWriteCloser = setting.LogFilePath, logWriteCloser
+	}
+	return sources, applied, nil
+}
+
+// reload reads the configuration file and the sources again, and logs the files that have failed
+func reload(dataMgr data.Manager) {
+	res, err := dataMgr.Reload(context.Background())
+	if err != nil {
+		log.Printf("Fail to reload, err:%s\n", err.Error())
+		return
+	}
+	for _, f := range res.Files {
+		if f.State != data.ReloadOK {
+			log.Printf("The %s file %s is %s %s\n", f.Kind, f.Path, f.State, f.Error)
+		}
+	}
+}
+
 func main() {
 	configFile := flag.String("Config", "", "The path of the configuration file")
 	flag.Parse()
@@ -49,10 +116,26 @@ func main() {
 		log.Fatalf("Fail to load configuration file %s, err:%s\n", *configFile, err.Error())
 	}
 
-	logWriteCloser := initLog(setting.LogFilePath)
-	defer logWriteCloser.Close()
+	live := &liveConfig{
+		configFile:     *configFile,
+		logFilePath:    setting.LogFilePath,
+		logWriteCloser: initLog(setting.LogFilePath),
+		sources:        setting.SourceConfigs(),
+	}
+	defer func() { live.logWriteCloser.Close() }()
 
-	dataMgr, err := data.NewManager(setting.PasswdFilePath, setting.GroupFilePath)
+	sources, err := data.NewSources(live.sources)
+	if err != nil {
+		log.Fatalf("Fail to instantiate the sources, err:%s\n", err.Error())
+	}
+
+	historyMaxAge := time.Duration(setting.HistoryMaxAgeInSec) * time.Second
+	managerOpts := []data.ManagerOption{data.WithHistory(setting.HistorySize, historyMaxAge),
+		data.WithConfigReload(live.reload)}
+	if len(setting.HistoryDir) > 0 {
+		managerOpts = append(managerOpts, data.WithHistoryDir(setting.HistoryDir))
+	}
+	dataMgr, err := data.NewManager(sources, managerOpts...)
 	if err != nil {
 		log.Fatalf("Fail to instantiate passwdMgr, err:%s\n", err.Error())
 	}
@@ -61,13 +144,34 @@ func main() {
 		log.Fatalf("Fail to start passwdMgr, err:%s\n", err.Error())
 	}
 
+	// the event streams never end by themselves, they are stopped on shutdown
+	stopEvents := make(chan struct{})
+	handlerOpts := []handler.Option{handler.StopEvents(stopEvents)}
+	if setting.LegacyStringIDs {
+		handlerOpts = append(handlerOpts, handler.LegacyStringIDs())
+	}
+	if len(setting.AdminToken) > 0 {
+		handlerOpts = append(handlerOpts, handler.AdminToken(setting.AdminToken))
+	}
+
+	var dispatcher *webhook.Dispatcher
+	if len(setting.Webhooks) > 0 {
+		dispatcher, err = webhook.New(setting.Webhooks, setting.WebhookQueueDir)
+		if err != nil {
+			log.Fatalf("Fail to instantiate the webhooks, err:%s\n", err.Error())
+		}
+		dispatcher.Start(dataMgr)
+		handlerOpts = append(handlerOpts, handler.WebhookDeliveries(dispatcher))
+	}
+
 	srv := &http.Server{
 		Addr:         setting.ListenHost + ":" + setting.Port,
 		WriteTimeout: time.Duration(setting.WriteTimeoutInSec) * time.Second,
 		ReadTimeout:  time.Duration(setting.ReadTimeoutInSec) * time.Second,
 		IdleTimeout:  time.Duration(setting.IdleTimeoutInSec) * time.Second,
-		Handler:      handler.New(setting.RestDomain, dataMgr),
+		Handler:      handler.New(setting.RestDomain, dataMgr, handlerOpts...),
 	}
+	srv.RegisterOnShutdown(func() { close(stopEvents) })
 
 	log.Println("Start listening")
 	// Server starts in a goroutine so that it doesn't block.
@@ -77,6 +181,16 @@ func main() {
 		}
 	}()
 
+	// SIGHUP reloads the configuration file and the sources, like POST /admin/reload
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Reloading on SIGHUP")
+			reload(dataMgr)
+		}
+	}()
+
 	// handle terminating signal to gracefully shutdown
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -86,8 +200,13 @@ func main() {
 	log.Println("PaaS is exiting")
 
 	// cleanup routines should be called here
-	if err = srv.Shutdown(context.Background()); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
 		log.Printf("server shutdown returns err:%s\n", err.Error())
 	}
+	if dispatcher != nil {
+		dispatcher.Stop()
+	}
 	dataMgr.Stop()
 }
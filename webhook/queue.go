@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	queueDirPerm  = 0700
+	queueFilePerm = 0600
+	queueFileExt  = ".json"
+)
+
+// task is a pending delivery along with the request body, it is stored as is in the queue
+type task struct {
+	Delivery *Delivery       `json:"delivery"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// queue keeps the pending tasks in a directory, one file per task named after the ID of the delivery. A
+// queue without a directory keeps nothing.
+type queue struct {
+	dir string
+}
+
+// newQueue opens the queue in dir and returns the tasks left over by a previous run, oldest first
+func newQueue(dir string) (*queue, []*task, error) {
+	q := &queue{dir: dir}
+	if len(dir) == 0 {
+		return q, nil, nil
+	}
+	if err := os.MkdirAll(dir, queueDirPerm); err != nil {
+		return nil, nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the IDs of the deliveries start with their creation time
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	var res []*task
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), queueFileExt) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		t := new(task)
+		if err = json.Unmarshal(b, t); err != nil || t.Delivery == nil {
+			// most likely a file being written when the service stopped
+			continue
+		}
+		res = append(res, t)
+	}
+	return q, res, nil
+}
+
+func (q *queue) path(t *task) string {
+	return filepath.Join(q.dir, t.Delivery.ID+queueFileExt)
+}
+
+// save writes t atomically, so that a crash never leaves a truncated task behind
+func (q *queue) save(t *task) error {
+	if len(q.dir) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(q.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Chmod(queueFilePerm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path(t))
+}
+
+func (q *queue) remove(t *task) error {
+	if len(q.dir) == 0 {
+		return nil
+	}
+	if err := os.Remove(q.path(t)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
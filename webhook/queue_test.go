@@ -0,0 +1,47 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert(t, err == nil)
+	defer os.RemoveAll(dir)
+	queueDir := filepath.Join(dir, "webhooks")
+
+	q, tasks, err := newQueue(queueDir)
+	assert(t, err == nil && len(tasks) == 0)
+
+	now := time.Now()
+	first := &task{Delivery: &Delivery{ID: newDeliveryID(now), Event: "user-added"}, Body: []byte(`{"id":1}`)}
+	second := &task{Delivery: &Delivery{ID: newDeliveryID(now.Add(time.Second)), Event: "user-removed"},
+		Body: []byte(`{"id":2}`)}
+	assert(t, q.save(second) == nil)
+	assert(t, q.save(first) == nil)
+	// saving again replaces the task
+	first.Delivery.Attempts = 1
+	assert(t, q.save(first) == nil)
+	// a truncated file is skipped
+	assert(t, ioutil.WriteFile(filepath.Join(queueDir, "broken.json"), []byte(`{"deliv`), 0600) == nil)
+
+	_, tasks, err = newQueue(queueDir)
+	assert(t, err == nil && len(tasks) == 2)
+	assert(t, tasks[0].Delivery.ID == first.Delivery.ID && tasks[0].Delivery.Attempts == 1)
+	assert(t, string(tasks[0].Body) == `{"id":1}`)
+	assert(t, tasks[1].Delivery.Event == "user-removed")
+
+	assert(t, q.remove(first) == nil)
+	assert(t, q.remove(first) == nil)
+	_, tasks, err = newQueue(queueDir)
+	assert(t, err == nil && len(tasks) == 1)
+
+	// a queue without a directory keeps nothing
+	q, tasks, err = newQueue("")
+	assert(t, err == nil && len(tasks) == 0)
+	assert(t, q.save(first) == nil && q.remove(first) == nil)
+}
@@ -0,0 +1,436 @@
+// Package webhook POSTs the changes of the users and groups to the URLs declared in the configuration
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/chaowang101/paas/config"
+	"github.com/chaowang101/paas/data"
+)
+
+const (
+	// EventHeader is the name of the event, e.g. group-modified
+	EventHeader = "X-Paas-Event"
+	// DeliveryHeader is the ID of the delivery, it stays the same across the retries
+	DeliveryHeader = "X-Paas-Delivery"
+	// SignatureHeader is "sha256=" followed by the hex encoded HMAC-SHA256 of the body, see Sign
+	SignatureHeader = "X-Paas-Signature"
+
+	signaturePrefix = "sha256="
+
+	maxAttempts     = 8
+	maxRetryDelay   = 5 * time.Minute
+	requestTimeout  = 10 * time.Second
+	deliveryLogSize = 256
+)
+
+// the delay before the first retry, doubled after every failure
+var retryBaseDelay = time.Second
+
+// DeliveryStatus is the state of a Delivery
+type DeliveryStatus string
+
+const (
+	// DeliveryPending is a delivery not attempted yet, or waiting for a retry
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered is a delivery the webhook has answered with a 2xx status
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryFailed is a delivery given up after too many attempts
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Delivery is the record of an event sent to a webhook
+type Delivery struct {
+	ID string `json:"id"`
+	// URL is the URL of the webhook
+	URL string `json:"url"`
+	// Event is the name of the event, e.g. group-modified, and EventID its ID as in GET /events
+	Event    string         `json:"event"`
+	EventID  uint64         `json:"eventId"`
+	Status   DeliveryStatus `json:"status"`
+	Attempts int            `json:"attempts"`
+	Created  time.Time      `json:"created"`
+	// LastAttempt, StatusCode and LastError are the outcome of the last attempt
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	StatusCode  int        `json:"statusCode,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	// NextAttempt is only set while pending
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+}
+
+// Sign returns the value of SignatureHeader for body, so that a receiver can check it with hmac.Equal
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher sends the events of a data.Manager to the webhooks. The deliveries are retried with an
+// exponential backoff, and kept on disk until they are delivered or given up.
+type Dispatcher struct {
+	hooks  []config.WebhookConfig
+	queue  *queue
+	client *http.Client
+
+	lock    sync.Mutex
+	pending []*task
+	// the last deliveries, oldest first
+	deliveries []*Delivery
+
+	wake chan struct{}
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a Dispatcher to the hooks, resuming the deliveries left in queueDir by a previous run. The
+// deliveries are only kept in memory if queueDir is empty.
+func New(hooks []config.WebhookConfig, queueDir string) (*Dispatcher, error) {
+	for _, hook := range hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid webhook URL %s: %s", hook.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("Invalid webhook URL %s: only http and https are supported", hook.URL)
+		}
+	}
+
+	q, tasks, err := newQueue(queueDir)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to open the webhook queue %s: %s", queueDir, err)
+	}
+
+	d := &Dispatcher{
+		hooks:   hooks,
+		queue:   q,
+		client:  &http.Client{Timeout: requestTimeout},
+		pending: tasks,
+		wake:    make(chan struct{}, 1),
+		exit:    make(chan struct{}),
+	}
+	for _, t := range tasks {
+		d.record(t.Delivery)
+	}
+	if len(tasks) > 0 {
+		log.Printf("Resuming %d webhook deliveries from %s\n", len(tasks), queueDir)
+	}
+	return d, nil
+}
+
+// Start sends the events of dataMgr from now on
+func (d *Dispatcher) Start(dataMgr data.Manager) {
+	// subscribe right away, so that no change is missed once Start returns
+	sub := dataMgr.Subscribe(0)
+	d.wg.Add(2)
+	go d.receive(dataMgr, sub)
+	go d.send()
+}
+
+// Stop stops sending, the pending deliveries are resumed by the next Dispatcher on the same queue directory
+func (d *Dispatcher) Stop() {
+	close(d.exit)
+	d.wg.Wait()
+}
+
+// Deliveries returns the last deliveries, newest first
+func (d *Dispatcher) Deliveries() []*Delivery {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	res := make([]*Delivery, 0, len(d.deliveries))
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		delivery := *d.deliveries[i]
+		res = append(res, &delivery)
+	}
+	return res
+}
+
+// record adds delivery to the log, must be called with lock held
+func (d *Dispatcher) record(delivery *Delivery) {
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > deliveryLogSize {
+		d.deliveries = append([]*Delivery{}, d.deliveries[len(d.deliveries)-deliveryLogSize:]...)
+	}
+}
+
+func eventName(e *data.Event) string {
+	return e.Kind + "-" + string(e.Action)
+}
+
+func entryName(e *data.Event) string {
+	if e.User != nil {
+		return e.User.Name
+	}
+	return e.Group.Name
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(hook *config.WebhookConfig, e *data.Event) bool {
+	if len(hook.Events) > 0 && !contains(hook.Events, eventName(e)) {
+		return false
+	}
+	return len(hook.Names) == 0 || contains(hook.Names, entryName(e))
+}
+
+func newDeliveryID(now time.Time) string {
+	// the creation time first, so that the IDs sort in the order of creation
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Fail to generate a random delivery ID due to error: %s\n", err)
+	}
+	return fmt.Sprintf("%016x-%s", now.UnixNano(), hex.EncodeToString(b))
+}
+
+// receive enqueues the events of sub. When the subscription is dropped for being too slow, e.g. after a
+// reload with many changes, it resumes from the last event received.
+func (d *Dispatcher) receive(dataMgr data.Manager, sub *data.Subscription) {
+	defer d.wg.Done()
+
+	var lastEventID uint64
+	for {
+		if sub.Missed {
+			log.Printf("Some events after %d are lost for the webhooks\n", lastEventID)
+		}
+		for _, e := range sub.Backlog {
+			d.enqueue(e)
+			lastEventID = e.ID
+		}
+
+	Loop:
+		for {
+			select {
+			case <-d.exit:
+				sub.Close()
+				return
+			case e, ok := <-sub.C:
+				if !ok {
+					break Loop
+				}
+				d.enqueue(e)
+				lastEventID = e.ID
+			}
+		}
+		sub.Close()
+		sub = dataMgr.Subscribe(lastEventID)
+	}
+}
+
+// enqueue creates a delivery of e for every matching webhook
+func (d *Dispatcher) enqueue(e *data.Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Fail to encode event %d with err: %s\n", e.ID, err)
+		return
+	}
+
+	now := time.Now()
+	for i := range d.hooks {
+		if !matches(&d.hooks[i], e) {
+			continue
+		}
+		next := now
+		t := &task{
+			Delivery: &Delivery{
+				ID:          newDeliveryID(now),
+				URL:         d.hooks[i].URL,
+				Event:       eventName(e),
+				EventID:     e.ID,
+				Status:      DeliveryPending,
+				Created:     now,
+				NextAttempt: &next,
+			},
+			Body: body,
+		}
+		if err := d.queue.save(t); err != nil {
+			log.Printf("Fail to save webhook delivery %s with err: %s\n", t.Delivery.ID, err)
+		}
+
+		d.lock.Lock()
+		d.pending = append(d.pending, t)
+		d.record(t.Delivery)
+		d.lock.Unlock()
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send attempts the deliveries as they become due
+func (d *Dispatcher) send() {
+	defer d.wg.Done()
+
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait, ok := d.sendDue(); ok {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-d.exit:
+			return
+		case <-d.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// sendDue attempts the deliveries whose time has come. It returns the time until the next attempt, if any
+// delivery is still pending.
+func (d *Dispatcher) sendDue() (time.Duration, bool) {
+	d.lock.Lock()
+	var due []*task
+	for _, t := range d.pending {
+		if !t.Delivery.NextAttempt.After(time.Now()) {
+			due = append(due, t)
+		}
+	}
+	d.lock.Unlock()
+
+	for _, t := range due {
+		select {
+		case <-d.exit:
+			return 0, false
+		default:
+		}
+		d.attempt(t)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var next *time.Time
+	for _, t := range d.pending {
+		if next == nil || t.Delivery.NextAttempt.Before(*next) {
+			next = t.Delivery.NextAttempt
+		}
+	}
+	if next == nil {
+		return 0, false
+	}
+	return time.Until(*next), true
+}
+
+func (d *Dispatcher) hook(url string) *config.WebhookConfig {
+	for i := range d.hooks {
+		if d.hooks[i].URL == url {
+			return &d.hooks[i]
+		}
+	}
+	return nil
+}
+
+// post sends the body of t, it returns the status code of the response
+func (d *Dispatcher) post(hook *config.WebhookConfig, t *task) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(t.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, t.Delivery.Event)
+	req.Header.Set(DeliveryHeader, t.Delivery.ID)
+	if len(hook.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(hook.Secret, t.Body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryDelay returns the delay after the attempts of a delivery have failed
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// attempt sends t once and updates its delivery accordingly
+func (d *Dispatcher) attempt(t *task) {
+	var statusCode int
+	var err error
+	// the queue might have a delivery of a webhook removed from the configuration since
+	hook := d.hook(t.Delivery.URL)
+	if hook != nil {
+		statusCode, err = d.post(hook, t)
+	} else {
+		err = fmt.Errorf("The webhook is no longer configured")
+	}
+
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delivery := t.Delivery
+	delivery.Attempts++
+	delivery.LastAttempt = &now
+	delivery.StatusCode = statusCode
+	delivery.LastError = ""
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.NextAttempt = nil
+	case delivery.Attempts >= maxAttempts || hook == nil:
+		log.Printf("Give up webhook delivery %s to %s with err: %s\n", delivery.ID, delivery.URL, err)
+		delivery.LastError = err.Error()
+		delivery.Status = DeliveryFailed
+		delivery.NextAttempt = nil
+	default:
+		delivery.LastError = err.Error()
+		next := now.Add(retryDelay(delivery.Attempts))
+		delivery.NextAttempt = &next
+		if err := d.queue.save(t); err != nil {
+			log.Printf("Fail to save webhook delivery %s with err: %s\n", delivery.ID, err)
+		}
+		return
+	}
+
+	for i := range d.pending {
+		if d.pending[i] == t {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			break
+		}
+	}
+	if err := d.queue.remove(t); err != nil {
+		log.Printf("Fail to remove webhook delivery %s with err: %s\n", delivery.ID, err)
+	}
+}
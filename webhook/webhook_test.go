@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chaowang101/paas/config"
+	"github.com/chaowang101/paas/data"
+)
+
+const testSecret = "s3cret"
+
+func assert(t *testing.T, condition bool) {
+	if !condition {
+		t.Fatal()
+	}
+}
+
+// testSource serves the groups set by the test, which calls notify to reload them
+type testSource struct {
+	lock   sync.Mutex
+	groups []*data.Group
+	notify func(change data.Change)
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) LoadUsers() (*data.UserSnapshot, error) {
+	return &data.UserSnapshot{Users: []*data.User{&data.User{Name: "root"}, &data.User{Name: "dwoodlins"}}}, nil
+}
+
+func (s *testSource) LoadGroups() (*data.GroupSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &data.GroupSnapshot{Groups: s.groups}, nil
+}
+
+func (s *testSource) Start(notify func(change data.Change)) error {
+	s.notify = notify
+	return nil
+}
+
+func (s *testSource) Stop() {
+}
+
+func (s *testSource) setGroups(groups ...*data.Group) {
+	s.lock.Lock()
+	s.groups = groups
+	s.lock.Unlock()
+	s.notify(data.GroupChange)
+}
+
+func newTestManager(t *testing.T) (data.Manager, *testSource) {
+	src := &testSource{groups: []*data.Group{&data.Group{Name: "wheel", GID: 0, Members: []string{"root"}}}}
+	dataMgr, err := data.NewManager([]data.Source{src})
+	assert(t, err == nil)
+	assert(t, dataMgr.Start() == nil)
+	return dataMgr, src
+}
+
+// waitFor polls cond as the deliveries happen asynchronously
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+// relay plays a relay to Slack, it checks the signature and reports whoever is added to wheel, i.e. the members
+// of the group missing from the previous one
+type relay struct {
+	lock     sync.Mutex
+	failures int
+	messages []string
+}
+
+func (rl *relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(Sign(testSecret, body))) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.failures > 0 {
+		rl.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var e data.Event
+	if err := json.Unmarshal(body, &e); err != nil || r.Header.Get(EventHeader) != "group-modified" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	previous := make(map[string]bool)
+	for _, m := range e.PreviousGroup.Members {
+		previous[m] = true
+	}
+	for _, m := range e.Group.Members {
+		if !previous[m] {
+			rl.messages = append(rl.messages, m+" is added to "+e.Group.Name)
+		}
+	}
+}
+
+func (rl *relay) get() []string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.messages
+}
+
+func TestDispatcher(t *testing.T) {
+	retryBaseDelay = 10 * time.Millisecond
+	rl := &relay{failures: 2}
+	server := httptest.NewServer(rl)
+	defer server.Close()
+
+	dataMgr, src := newTestManager(t)
+	defer dataMgr.Stop()
+	dispatcher, err := New([]config.WebhookConfig{
+		{URL: server.URL, Events: []string{"group-modified"}, Names: []string{"wheel"}, Secret: testSecret},
+	}, "")
+	assert(t, err == nil)
+	dispatcher.Start(dataMgr)
+	defer dispatcher.Stop()
+	assert(t, len(dispatcher.Deliveries()) == 0)
+
+	// a new group is filtered out
+	src.setGroups(&data.Group{Name: "wheel", GID: 0, Members: []string{"root"}}, &data.Group{Name: "docker", GID: 1})
+	src.setGroups(&data.Group{Name: "wheel", GID: 0, Members: []string{"root", "dwoodlins"}},
+		&data.Group{Name: "docker", GID: 1})
+
+	waitFor(t, func() bool {
+		return len(rl.get()) == 1
+	})
+	assert(t, rl.get()[0] == "dwoodlins is added to wheel")
+
+	waitFor(t, func() bool {
+		deliveries := dispatcher.Deliveries()
+		return len(deliveries) == 1 && deliveries[0].Status == DeliveryDelivered
+	})
+	delivery := dispatcher.Deliveries()[0]
+	assert(t, delivery.URL == server.URL)
+	assert(t, delivery.Event == "group-modified")
+	assert(t, delivery.Attempts == 3)
+	assert(t, delivery.StatusCode == http.StatusOK)
+	assert(t, len(delivery.LastError) == 0 && delivery.NextAttempt == nil)
+}
+
+func TestDispatcherGiveUp(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the secret is wrong
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	dataMgr, src := newTestManager(t)
+	defer dataMgr.Stop()
+	dispatcher, err := New([]config.WebhookConfig{{URL: server.URL, Secret: "wrong"}}, "")
+	assert(t, err == nil)
+	dispatcher.Start(dataMgr)
+	defer dispatcher.Stop()
+
+	src.setGroups()
+	waitFor(t, func() bool {
+		deliveries := dispatcher.Deliveries()
+		return len(deliveries) == 1 && deliveries[0].Status == DeliveryFailed
+	})
+	delivery := dispatcher.Deliveries()[0]
+	assert(t, delivery.Event == "group-removed")
+	assert(t, delivery.Attempts == maxAttempts)
+	assert(t, delivery.StatusCode == http.StatusUnauthorized)
+	assert(t, len(delivery.LastError) > 0)
+}
+
+func TestDispatcherQueue(t *testing.T) {
+	retryBaseDelay = time.Hour
+	queueDir, err := ioutil.TempDir("", "webhooks")
+	assert(t, err == nil)
+	defer os.RemoveAll(queueDir)
+
+	// the receiver is down
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	hooks := []config.WebhookConfig{{URL: server.URL}}
+
+	dataMgr, src := newTestManager(t)
+	defer dataMgr.Stop()
+	dispatcher, err := New(hooks, queueDir)
+	assert(t, err == nil)
+	dispatcher.Start(dataMgr)
+	src.setGroups()
+	waitFor(t, func() bool {
+		deliveries := dispatcher.Deliveries()
+		return len(deliveries) == 1 && deliveries[0].Attempts == 1
+	})
+	dispatcher.Stop()
+	server.Close()
+
+	// the delivery is resumed after a restart, and dropped once delivered
+	delivered := make(chan string, 1)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.Header.Get(EventHeader)
+	}))
+	defer server.Close()
+	// the retry is due right away
+	retryBaseDelay = 0
+	_, tasks, err := newQueue(queueDir)
+	assert(t, err == nil && len(tasks) == 1)
+	next := time.Now()
+	tasks[0].Delivery.NextAttempt = &next
+	tasks[0].Delivery.URL = server.URL
+	assert(t, (&queue{dir: queueDir}).save(tasks[0]) == nil)
+
+	dispatcher, err = New([]config.WebhookConfig{{URL: server.URL}}, queueDir)
+	assert(t, err == nil)
+	deliveries := dispatcher.Deliveries()
+	assert(t, len(deliveries) == 1 && deliveries[0].Status == DeliveryPending)
+	dispatcher.Start(dataMgr)
+	defer dispatcher.Stop()
+
+	assert(t, <-delivered == "group-removed")
+	waitFor(t, func() bool {
+		_, tasks, err := newQueue(queueDir)
+		return err == nil && len(tasks) == 0
+	})
+	delivery := dispatcher.Deliveries()[0]
+	assert(t, delivery.Status == DeliveryDelivered && delivery.Attempts == 2)
+}
+
+func TestNewDispatcher(t *testing.T) {
+	_, err := New([]config.WebhookConfig{{URL: "ftp://example.com"}}, "")
+	assert(t, err != nil)
+	_, err = New([]config.WebhookConfig{{URL: "://example.com"}}, "")
+	assert(t, err != nil)
+	_, err = New([]config.WebhookConfig{{URL: "https://example.com/hook"}}, "")
+	assert(t, err == nil)
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryBaseDelay = time.Second
+	assert(t, retryDelay(1) == time.Second)
+	assert(t, retryDelay(3) == 4*time.Second)
+	assert(t, retryDelay(20) == maxRetryDelay)
+}